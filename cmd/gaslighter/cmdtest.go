@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// A single case of `gaslighter cmd test`. Evaluates the custom command
+// with the input and compares the messages it sent with the expected
+// ones.
+type CommandTestCase struct {
+	Name     string   `json:"name,omitempty"`
+	Command  string   `json:"command"`
+	Input    string   `json:"input"`
+	Platform string   `json:"platform"`
+	Author   string   `json:"author,omitempty"`
+	// Value of count() during the evaluation. 0 means 1.
+	Count    int64    `json:"count,omitempty"`
+	Expected []string `json:"expected"`
+	// Expected evaluation error if any
+	Error    string   `json:"error,omitempty"`
+}
+
+func (testCase CommandTestCase) Title() string {
+	if len(testCase.Name) > 0 {
+		return testCase.Name
+	}
+	return fmt.Sprintf("%s %q on %s", testCase.Command, testCase.Input, testCase.Platform)
+}
+
+// CommandEnvironment that records all the messages instead of sending them
+type RecordingEnvironment struct {
+	Author       string
+	PlatformName string
+	Messages     []string
+}
+
+func (env *RecordingEnvironment) AtAuthor() string {
+	return env.Author
+}
+
+func (env *RecordingEnvironment) Platform() string {
+	return env.PlatformName
+}
+
+func (env *RecordingEnvironment) SendMessage(message string) {
+	env.Messages = append(env.Messages, message)
+}
+
+// Rich messages are recorded the way they look on the platforms without
+// them
+func (env *RecordingEnvironment) SendRichMessage(message internal.RichMessage) {
+	env.SendMessage(message.Flatten())
+}
+
+type CommandTestResult struct {
+	Messages []string
+	Error    string
+}
+
+func runCommandTestCase(testCase CommandTestCase, command internal.CustomCommand, seed int64, now time.Time) CommandTestResult {
+	env := &RecordingEnvironment{
+		Author:       testCase.Author,
+		PlatformName: testCase.Platform,
+		Messages:     []string{},
+	}
+
+	exprs, err := internal.ParseAllExprs(command.Bex)
+	if err != nil {
+		return CommandTestResult{Messages: env.Messages, Error: err.Error()}
+	}
+
+	count := testCase.Count
+	if count == 0 {
+		count = 1
+	}
+	context := internal.NewEvalContext(env, testCase.Input, count)
+	context.Rand = rand.New(rand.NewSource(seed))
+	context.Now = func() time.Time {
+		return now
+	}
+
+	for _, expr := range exprs {
+		_, err := context.EvalExpr(expr)
+		if err != nil {
+			return CommandTestResult{Messages: env.Messages, Error: err.Error()}
+		}
+	}
+	return CommandTestResult{Messages: env.Messages}
+}
+
+func (result CommandTestResult) Matches(testCase CommandTestCase) bool {
+	if result.Error != testCase.Error {
+		return false
+	}
+	if len(result.Messages) != len(testCase.Expected) {
+		return false
+	}
+	for i := range result.Messages {
+		if result.Messages[i] != testCase.Expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func printCommandTestDiff(testCase CommandTestCase, result CommandTestResult) {
+	for _, message := range testCase.Expected {
+		fmt.Printf("  - %q\n", message)
+	}
+	if len(testCase.Error) > 0 {
+		fmt.Printf("  - error: %s\n", testCase.Error)
+	}
+	for _, message := range result.Messages {
+		fmt.Printf("  + %q\n", message)
+	}
+	if len(result.Error) > 0 {
+		fmt.Printf("  + error: %s\n", result.Error)
+	}
+}
+
+func loadCommandTestCases(filePath string) ([]CommandTestCase, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	testCases := []CommandTestCase{}
+	err = json.Unmarshal(content, &testCases)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", filePath, err)
+	}
+	return testCases, nil
+}
+
+func runCmdTest(args []string) int {
+	subFlag := flag.NewFlagSet("cmd test", flag.ExitOnError)
+	input := subFlag.String("f", "commands_test.json", "File with the test cases")
+	commandsFile := subFlag.String("c", "", "File with the exported commands to test. If not provided the commands are taken from the database.")
+	seed := subFlag.Int64("seed", 69, "Seed of the randomness of the commands")
+	nowStr := subFlag.String("now", "2000-01-01T00:00:00Z", "Time the commands are evaluated at in RFC 3339 format")
+	record := subFlag.Bool("record", false, "Overwrite the expected output of the test cases with the actual one")
+
+	subFlag.Parse(args)
+
+	now, err := time.Parse(time.RFC3339, *nowStr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: could not parse -now:", err)
+		return 1
+	}
+
+	testCases, err := loadCommandTestCases(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: could not load test cases:", err)
+		return 1
+	}
+
+	var commands []internal.CustomCommand
+	if len(*commandsFile) > 0 {
+		commands, err = loadCommandsFile(*commandsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: could not load commands:", err)
+			return 1
+		}
+	} else {
+		db := internal.StartPostgreSQL()
+		if db == nil {
+			return 1
+		}
+		defer db.Close()
+
+		commands, err = internal.QueryAllCustomCommands(db)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: could not query commands:", err)
+			return 1
+		}
+	}
+	commandsByName := map[string]internal.CustomCommand{}
+	for _, command := range commands {
+		commandsByName[command.Name] = command
+	}
+
+	failed := 0
+	for i, testCase := range testCases {
+		command, ok := commandsByName[testCase.Command]
+		if !ok {
+			fmt.Printf("FAIL %s: command %s does not exist\n", testCase.Title(), testCase.Command)
+			failed += 1
+			continue
+		}
+
+		result := runCommandTestCase(testCase, command, *seed, now)
+		if *record {
+			testCases[i].Expected = result.Messages
+			testCases[i].Error = result.Error
+			continue
+		}
+		if !result.Matches(testCase) {
+			fmt.Printf("FAIL %s\n", testCase.Title())
+			printCommandTestDiff(testCase, result)
+			failed += 1
+		}
+	}
+
+	if *record {
+		content, err := json.MarshalIndent(testCases, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: could not serialize test cases:", err)
+			return 1
+		}
+		err = ioutil.WriteFile(*input, append(content, '\n'), 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: could not write %s: %s\n", *input, err)
+			return 1
+		}
+		fmt.Printf("Recorded %d test cases to %s\n", len(testCases)-failed, *input)
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Printf("%d passed, %d failed\n", len(testCases)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
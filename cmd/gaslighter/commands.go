@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"io/ioutil"
+	"os"
+)
+
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictRename    ConflictPolicy = "rename"
+)
+
+func freeCommandName(name string, taken map[string]bool) (string, bool) {
+	for i := 2; i < 1000; i += 1 {
+		suffix := fmt.Sprintf("-%d", i)
+		if len(name)+len(suffix) > internal.CommandNameSizeLimit {
+			return "", false
+		}
+		candidate := name + suffix
+		if !taken[candidate] {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func loadCommandsFile(filePath string) ([]internal.CustomCommand, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	commands := []internal.CustomCommand{}
+	err = json.Unmarshal(content, &commands)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", filePath, err)
+	}
+	return commands, nil
+}
+
+// Everything that is wrong with the imported commands regardless of what
+// is in the database. Normalizes the permissions of the commands.
+func verifyImportedCommands(commands []internal.CustomCommand) []string {
+	problems := []string{}
+	seen := map[string]bool{}
+	for i := range commands {
+		name := commands[i].Name
+		if err := internal.VerifyCommandName(name); err != nil {
+			problems = append(problems, err.Error())
+		} else if seen[name] {
+			problems = append(problems, fmt.Sprintf("Command `%s` is defined more than once", name))
+		}
+		seen[name] = true
+
+		// The files exported before the permissions existed
+		if len(commands[i].Permission) == 0 {
+			commands[i].Permission = internal.PermissionNames[0]
+			continue
+		}
+		permission, err := internal.ParsePermissionName(commands[i].Permission)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Command `%s`: %s", name, err))
+			continue
+		}
+		commands[i].Permission = permission
+	}
+	return problems
+}
+
+func cmdUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: gaslighter cmd <SUBCOMMAND> [OPTIONS]\n")
+	fmt.Fprintf(os.Stderr, "SUBCOMMANDS:\n")
+	for name, _ := range CmdSubcmds {
+		fmt.Fprintf(os.Stderr, "    %s\n", name)
+	}
+}
+
+var CmdSubcmds = map[string]Subcmd{
+	"test": Subcmd{
+		Run: runCmdTest,
+	},
+	"export": Subcmd{
+		Run: func(args []string) int {
+			subFlag := flag.NewFlagSet("cmd export", flag.ExitOnError)
+			output := subFlag.String("o", "commands.json", "File to export the commands to. Use - for stdout.")
+
+			subFlag.Parse(args)
+
+			db := internal.StartPostgreSQL()
+			if db == nil {
+				return 1
+			}
+			defer db.Close()
+
+			commands, err := internal.QueryAllCustomCommands(db)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not query commands:", err)
+				return 1
+			}
+
+			content, err := json.MarshalIndent(commands, "", "  ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not serialize commands:", err)
+				return 1
+			}
+			content = append(content, '\n')
+
+			if *output == "-" {
+				os.Stdout.Write(content)
+				return 0
+			}
+
+			err = ioutil.WriteFile(*output, content, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: could not write %s: %s\n", *output, err)
+				return 1
+			}
+			fmt.Printf("Exported %d commands to %s\n", len(commands), *output)
+			return 0
+		},
+	},
+	"import": Subcmd{
+		Run: func(args []string) int {
+			subFlag := flag.NewFlagSet("cmd import", flag.ExitOnError)
+			input := subFlag.String("f", "commands.json", "File to import the commands from")
+			policy := subFlag.String("c", string(ConflictSkip), "What to do with the commands that already exist: skip, overwrite or rename")
+			dryRun := subFlag.Bool("n", false, "Dry run. Only show what is going to be changed.")
+			overwriteCount := subFlag.Bool("count", false, "Also replace the usage counters of the overwritten commands with the ones from the file")
+
+			subFlag.Parse(args)
+
+			switch ConflictPolicy(*policy) {
+			case ConflictSkip, ConflictOverwrite, ConflictRename:
+			default:
+				fmt.Fprintf(os.Stderr, "ERROR: unknown conflict policy `%s`\n", *policy)
+				return 1
+			}
+
+			imported, err := loadCommandsFile(*input)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not load commands:", err)
+				return 1
+			}
+
+			// Reported in the dry run as well, nothing is imported until the file is fixed
+			if problems := verifyImportedCommands(imported); len(problems) > 0 {
+				for _, problem := range problems {
+					fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", *input, problem)
+				}
+				return 1
+			}
+
+			db := internal.StartPostgreSQL()
+			if db == nil {
+				return 1
+			}
+			defer db.Close()
+
+			existing, err := internal.QueryAllCustomCommands(db)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not query commands:", err)
+				return 1
+			}
+			existingByName := map[string]internal.CustomCommand{}
+			taken := map[string]bool{}
+			for _, command := range existing {
+				existingByName[command.Name] = command
+				taken[command.Name] = true
+			}
+
+			changes := []internal.CustomCommand{}
+			for _, command := range imported {
+				old, exists := existingByName[command.Name]
+				if !exists {
+					fmt.Printf("+ %s: %s\n", command.Name, command.Bex)
+					taken[command.Name] = true
+					changes = append(changes, command)
+					continue
+				}
+
+				if old.Bex == command.Bex && old.Description == command.Description && old.Permission == command.Permission {
+					fmt.Printf("= %s\n", command.Name)
+					continue
+				}
+
+				switch ConflictPolicy(*policy) {
+				case ConflictSkip:
+					fmt.Printf("! %s: already exists, skipping\n", command.Name)
+				case ConflictOverwrite:
+					fmt.Printf("~ %s:\n", command.Name)
+					if old.Description != command.Description {
+						fmt.Printf("  - description: %s\n", old.Description)
+						fmt.Printf("  + description: %s\n", command.Description)
+					}
+					if old.Permission != command.Permission {
+						fmt.Printf("  - permission: %s\n", old.Permission)
+						fmt.Printf("  + permission: %s\n", command.Permission)
+					}
+					if old.Bex != command.Bex {
+						fmt.Printf("  - %s\n", old.Bex)
+						fmt.Printf("  + %s\n", command.Bex)
+					}
+					changes = append(changes, command)
+				case ConflictRename:
+					name, ok := freeCommandName(command.Name, taken)
+					if !ok {
+						fmt.Fprintf(os.Stderr, "ERROR: could not find a free name for command %s\n", command.Name)
+						return 1
+					}
+					fmt.Printf("> %s -> %s: %s\n", command.Name, name, command.Bex)
+					taken[name] = true
+					command.Name = name
+					changes = append(changes, command)
+				default:
+					panic("unreachable")
+				}
+			}
+
+			if *dryRun {
+				fmt.Printf("Dry run: %d commands would be imported\n", len(changes))
+				return 0
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not start transaction:", err)
+				return 1
+			}
+			for _, command := range changes {
+				err = internal.UpsertCustomCommand(tx, command, *overwriteCount)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "ERROR: could not import command %s: %s\n", command.Name, err)
+					err = tx.Rollback()
+					if err != nil {
+						fmt.Fprintln(os.Stderr, "ERROR: could not rollback transaction:", err)
+					}
+					return 1
+				}
+			}
+			err = tx.Commit()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not commit transaction:", err)
+				return 1
+			}
+
+			fmt.Printf("Imported %d commands\n", len(changes))
+			return 0
+		},
+	},
+}
@@ -135,6 +135,179 @@ var Subcmds = map[string]Subcmd{
 			return 0
 		},
 	},
+	"cmd": Subcmd{
+		Run: func(args []string) int {
+			if len(args) < 1 {
+				cmdUsage()
+				fmt.Fprintf(os.Stderr, "ERROR: no cmd subcommand is provided\n")
+				return 1
+			}
+			if subcmd, ok := CmdSubcmds[args[0]]; ok {
+				return subcmd.Run(args[1:])
+			}
+			cmdUsage()
+			fmt.Fprintf(os.Stderr, "ERROR: unknown cmd subcommand `%s`\n", args[0])
+			return 1
+		},
+	},
+	"role": Subcmd{
+		Run: func(args []string) int {
+			subFlag := flag.NewFlagSet("role", flag.ExitOnError)
+			grant := subFlag.String("grant", "", "Role to grant to the user")
+			revoke := subFlag.String("revoke", "", "Role to revoke from the user")
+
+			subFlag.Parse(args)
+
+			db := internal.StartPostgreSQL()
+			if db == nil {
+				return 1
+			}
+			defer db.Close()
+
+			if len(*grant) == 0 && len(*revoke) == 0 {
+				roles, err := internal.QueryRoles(db)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR: could not query roles:", err)
+					return 1
+				}
+				for _, userRole := range roles {
+					fmt.Printf("%s\t%s\n", userRole.UserId, userRole.Role)
+				}
+				return 0
+			}
+
+			if subFlag.NArg() != 1 {
+				fmt.Fprintf(os.Stderr, "ERROR: expected exactly one user id in the format <platform>#<id>\n")
+				return 1
+			}
+			userId := subFlag.Arg(0)
+
+			if len(*grant) > 0 {
+				role, err := internal.ParseRole(*grant)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR:", err)
+					return 1
+				}
+				err = internal.GrantRole(db, userId, role)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR: could not grant role:", err)
+					return 1
+				}
+			}
+
+			if len(*revoke) > 0 {
+				role, err := internal.ParseRole(*revoke)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR:", err)
+					return 1
+				}
+				revoked, err := internal.RevokeRole(db, userId, role)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR: could not revoke role:", err)
+					return 1
+				}
+				if !revoked {
+					fmt.Fprintf(os.Stderr, "ERROR: %s does not have the %s role\n", userId, role)
+					return 1
+				}
+			}
+
+			return 0
+		},
+	},
+	"prefix": Subcmd{
+		Run: func(args []string) int {
+			subFlag := flag.NewFlagSet("prefix", flag.ExitOnError)
+			platform := subFlag.String("platform", "", "Platform the prefixes apply to (discord, twitch, etc). If not provided lists all the prefixes.")
+			channel := subFlag.String("channel", "", "Channel the prefixes apply to. If not provided the prefixes apply to the whole platform.")
+
+			subFlag.Parse(args)
+
+			prefixes := subFlag.Args()
+			if err := internal.VerifyCommandPrefixes(prefixes); err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR:", err)
+				return 1
+			}
+
+			db := internal.StartPostgreSQL()
+			if db == nil {
+				return 1
+			}
+			defer db.Close()
+
+			if len(*platform) == 0 {
+				prefixes, err := internal.QueryCommandPrefixes(db)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR: could not query command prefixes:", err)
+					return 1
+				}
+				for _, prefix := range prefixes {
+					fmt.Printf("%s\t%s\t%s\n", prefix.Platform, prefix.Channel, prefix.Prefix)
+				}
+				return 0
+			}
+
+			err := internal.SetCommandPrefixes(db, *platform, *channel, prefixes)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not set command prefixes:", err)
+				return 1
+			}
+
+			return 0
+		},
+	},
+	"cmdstats": Subcmd{
+		Run: func(args []string) int {
+			subFlag := flag.NewFlagSet("cmdstats", flag.ExitOnError)
+			days := subFlag.Int("d", 7, "Amount of days to report")
+			limit := subFlag.Int("l", 10, "Limit of commands per section")
+
+			subFlag.Parse(args)
+
+			db := internal.StartPostgreSQL()
+			if db == nil {
+				return 1
+			}
+			defer db.Close()
+
+			since := time.Now().AddDate(0, 0, -*days)
+
+			daily, err := internal.QueryDailyTopCommands(db, since, *limit)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not query daily top commands:", err)
+				return 1
+			}
+			fmt.Printf("Top commands per day:\n")
+			for _, day := range daily {
+				fmt.Printf("  %s\n", day.Day.Format("2006-01-02"))
+				for _, stats := range day.Stats {
+					fmt.Printf("    %-24s %8d calls\n", stats.Name, stats.Invocations)
+				}
+			}
+
+			failing, err := internal.QueryCommandStats(db, since, internal.ByFailureRate, *limit)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not query failure rates of commands:", err)
+				return 1
+			}
+			fmt.Printf("Failure rates:\n")
+			for _, stats := range failing {
+				fmt.Printf("  %-24s %6.1f%% (%d out of %d)\n", stats.Name, stats.FailureRate()*100, stats.Failures, stats.Invocations)
+			}
+
+			slowest, err := internal.QueryCommandStats(db, since, internal.ByAvgDuration, *limit)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "ERROR: could not query slowest commands:", err)
+				return 1
+			}
+			fmt.Printf("Slowest commands:\n")
+			for _, stats := range slowest {
+				fmt.Printf("  %-24s avg %10.2fms, max %10.2fms\n", stats.Name, stats.AvgDurationMs, stats.MaxDurationMs)
+			}
+
+			return 0
+		},
+	},
 }
 
 func topUsage(program string) {
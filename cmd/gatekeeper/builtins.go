@@ -0,0 +1,1130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BuiltinPlatform int
+
+const (
+	AnyPlatform BuiltinPlatform = iota
+	DiscordPlatform
+)
+
+type Permission int
+
+// Ordered from the least to the most powerful one, the same way as
+// internal.PermissionNames. See PermissionOfRole
+const (
+	PermissionEveryone Permission = iota
+	// Not a role, granted only by the badges on Twitch. See TwitchBadgePermission
+	PermissionSubscriber
+	PermissionTrusted
+	PermissionModerator
+	PermissionAdmin
+	PermissionOwner
+)
+
+func (permission Permission) String() string {
+	return internal.PermissionNames[permission]
+}
+
+func ParsePermission(name string) (Permission, bool) {
+	for permission := PermissionEveryone; permission <= PermissionOwner; permission += 1 {
+		if permission.String() == strings.ToLower(name) {
+			return permission, true
+		}
+	}
+	return PermissionEveryone, false
+}
+
+type BuiltinFunc = func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error
+
+type BuiltinCommand struct {
+	Name string
+	Usage string
+	Description string
+	// The platform the command is restricted to
+	Platform BuiltinPlatform
+	// Admins are allowed to use the command outside of its Platform
+	AdminAnywhere bool
+	Permission Permission
+	RequiresDB bool
+	// Errors returned from Run are logged and reported to the user as
+	// "Something went wrong". User errors (syntax errors, wrong
+	// arguments, etc) should be reported by Run itself with nil
+	// returned.
+	Run BuiltinFunc
+}
+
+// Human readable summary of the restrictions of the command for the help messages
+func (builtin BuiltinCommand) Restrictions() string {
+	restrictions := []string{}
+	if builtin.Permission > PermissionEveryone {
+		restrictions = append(restrictions, builtin.Permission.String()+" only")
+	}
+	if builtin.Platform == DiscordPlatform {
+		if builtin.AdminAnywhere {
+			restrictions = append(restrictions, "Discord only for non-admins")
+		} else {
+			restrictions = append(restrictions, "Discord only")
+		}
+	}
+	return strings.Join(restrictions, ", ")
+}
+
+// Populated in init() because some of the builtins evaluate other
+// commands which would create an initialization cycle otherwise.
+var BuiltinCommands []BuiltinCommand
+
+func FindBuiltinCommand(name string) (BuiltinCommand, bool) {
+	for _, builtin := range BuiltinCommands {
+		if builtin.Name == name {
+			return builtin, true
+		}
+	}
+	return BuiltinCommand{}, false
+}
+
+func EvalBuiltinCommand(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+	builtin, ok := FindBuiltinCommand(command.Name)
+	if !ok {
+		env.Reply(fmt.Sprintf("command `%s` does not exist", command.Name))
+		return CommandDoesNotExist
+	}
+
+	if !env.HasPermission(builtin.Permission) {
+		env.Reply(fmt.Sprintf("This command requires the %s role", builtin.Permission))
+		return nil
+	}
+
+	if builtin.Platform == DiscordPlatform && env.AsDiscord() == nil {
+		if !(builtin.AdminAnywhere && env.HasPermission(PermissionAdmin)) {
+			env.Reply("This command only works in Discord, sorry")
+			return nil
+		}
+	}
+
+	if builtin.RequiresDB && db == nil {
+		// TODO: add some sort of cooldown for the @admin pings
+		env.Reply("Something went wrong with the database. Commands that require it won't work. Please ask " + env.AtAdmin() + " to check the logs")
+		return DatabaseUnavailable
+	}
+
+	err := builtin.Run(db, command, env, context)
+	if err != nil {
+		log.Printf("Error while evaluating builtin command %s: %s\n", command.Name, err)
+		env.Reply("Something went wrong. Please ask " + env.AtAdmin() + " to check the logs")
+	}
+	return err
+}
+
+// The chat log of the platform and the condition that limits it to the
+// channel of the command (if needed)
+func spammersLogOfEnvironment(env CommandEnvironment) (table string, where string, args []interface{}, ok bool) {
+	switch env.Platform() {
+	case "discord":
+		return "discord_log", "true", nil, true
+	case "twitch":
+		// Every Twitch channel has its own chat
+		return "twitch_log", "channel = $1", []interface{}{env.ChannelID()}, true
+	default:
+		return "", "", nil, false
+	}
+}
+
+func evalSpammersCommand(db *sql.DB, command Command, env CommandEnvironment, title string, order string) error {
+	name := strings.TrimSpace(command.Args)
+
+	table, where, args, ok := spammersLogOfEnvironment(env)
+	if !ok {
+		env.Reply("This command only works in Discord and Twitch, sorry")
+		return nil
+	}
+	if env.Platform() == "twitch" {
+		// Twitch logins are lowercase
+		name = strings.ToLower(strings.TrimPrefix(name, "@"))
+	}
+
+	if len(name) == 0 {
+		rows, err := db.Query("select user_name, count(text) as count from "+table+" where "+where+" group by user_name order by count "+order+" limit 10", args...);
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		message := internal.RichMessage{Title: title, Numbered: true}
+		for rows.Next() {
+			var userName string
+			var count int
+			err := rows.Scan(&userName, &count)
+			if err != nil {
+				log.Printf("%s\n", err)
+			} else {
+				message.Items = append(message.Items, fmt.Sprintf("%s (%d)", userName, count))
+			}
+		}
+		env.ReplyRich(message)
+	} else {
+		args = append(args, name)
+		rows, err := db.Query(fmt.Sprintf("select user_name, count(text) as count from "+table+" where "+where+" and user_name = $%d group by user_name;", len(args)), args...);
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		sb := strings.Builder{}
+		for rows.Next() {
+			var userName string
+			var count int
+			err := rows.Scan(&userName, &count)
+			if err != nil {
+				log.Printf("%s\n", err)
+			} else {
+				sb.WriteString(fmt.Sprintf("%s (%d)\n", userName, count))
+			}
+		}
+		env.Reply(sb.String())
+	}
+	return nil
+}
+
+func evalUpdateCommandCommand(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+	matches := CommandNoPrefixRegexp.FindStringSubmatch(command.Args)
+	if len(matches) == 0 {
+		// TODO: give more info on the syntactic error to the user
+		env.Reply("syntax error")
+		return nil
+	}
+
+	name := matches[1]
+	bex := matches[3]
+
+	description, bex, ok := parseCommandDescription(bex)
+	if !ok {
+		_, err := db.Exec("INSERT INTO Commands (name, bex) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET bex = EXCLUDED.bex;", name, bex);
+		if err != nil {
+			return fmt.Errorf("could not update command %s: %w", name, err)
+		}
+		// TODO: report "added" instead of "updated" when the command didn't exist but was newly created
+		env.Reply(fmt.Sprintf("command %s is updated", name))
+		return nil
+	}
+
+	if len([]rune(description)) > CommandDescriptionLimit {
+		env.Reply(fmt.Sprintf("description must be max %d characters long", CommandDescriptionLimit))
+		return nil
+	}
+
+	if len(bex) == 0 {
+		res, err := db.Exec("UPDATE Commands SET description = $2 WHERE name = $1;", name, description);
+		if err != nil {
+			return fmt.Errorf("could not update description of command %s: %w", name, err)
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			env.Reply(fmt.Sprintf("command %s does not exist", name))
+			return nil
+		}
+		env.Reply(fmt.Sprintf("description of command %s is updated", name))
+		return nil
+	}
+
+	_, err := db.Exec("INSERT INTO Commands (name, bex, description) VALUES ($1, $2, $3) ON CONFLICT (name) DO UPDATE SET bex = EXCLUDED.bex, description = EXCLUDED.description;", name, bex, description);
+	if err != nil {
+		return fmt.Errorf("could not update command %s: %w", name, err)
+	}
+	// TODO: report "added" instead of "updated" when the command didn't exist but was newly created
+	env.Reply(fmt.Sprintf("command %s is updated", name))
+	return nil
+}
+
+func evalCommandPermissionCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	fields := strings.Fields(command.Args)
+	if len(fields) < 1 || len(fields) > 2 {
+		env.Reply("Expected a command name and optionally a permission")
+		return nil
+	}
+	name := fields[0]
+
+	if len(fields) == 1 {
+		var permission string
+		err := db.QueryRow("SELECT coalesce(permission, 'everyone') FROM Commands WHERE name = $1", name).Scan(&permission)
+		if err == sql.ErrNoRows {
+			env.Reply(fmt.Sprintf("command %s does not exist", name))
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not query permission of command %s: %w", name, err)
+		}
+		env.Reply(fmt.Sprintf("command %s requires the %s role", name, permission))
+		return nil
+	}
+
+	permission, ok := ParsePermission(fields[1])
+	if !ok {
+		env.Reply(fmt.Sprintf("Unknown permission `%s`. Available permissions: everyone, subscriber, trusted, moderator, admin, owner", fields[1]))
+		return nil
+	}
+	// Otherwise admins could lock themselves out of the command
+	if !env.HasPermission(permission) {
+		env.Reply(fmt.Sprintf("You are not allowed to restrict commands to the %s role", permission))
+		return nil
+	}
+
+	res, err := db.Exec("UPDATE Commands SET permission = $2 WHERE name = $1;", name, permission.String())
+	if err != nil {
+		return fmt.Errorf("could not update permission of command %s: %w", name, err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		env.Reply(fmt.Sprintf("command %s does not exist", name))
+		return nil
+	}
+	env.Reply(fmt.Sprintf("command %s now requires the %s role", name, permission))
+	return nil
+}
+
+const (
+	BrokEngagementThreshold = 15.0
+)
+
+var (
+	BrokLastPrompt string = ""
+	BrokLastYes bool = false
+	BrokLastTimestamp time.Time
+)
+
+func init() {
+	BuiltinCommands = []BuiltinCommand{
+		{
+			Name: "help",
+			Usage: "[command]",
+			Description: "Show the list of builtin commands or the description of a specific command",
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalHelpCommand(db, command, env)
+			},
+		},
+		{
+			Name: "commands",
+			Usage: "[search] [page]",
+			Description: "List builtin and custom commands, optionally filtered by a search string",
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalCommandsCommand(db, command, env)
+			},
+		},
+		{
+			Name: "cmdstats",
+			Usage: "[top|failing|slow|<name>]",
+			Description: "Show usage statistics of the commands for the last week",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalCmdStatsCommand(db, command, env)
+			},
+		},
+		{
+			Name: "prefix",
+			Description: "Show the command prefixes of this channel",
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				env.Reply(fmt.Sprintf("Command prefixes of this channel: %s", strings.Join(Prefixes.Lookup(env.Platform(), env.ChannelID()), " ")))
+				return nil
+			},
+		},
+		{
+			Name: "setprefix",
+			Usage: "[prefixes...]",
+			Description: "Set the command prefixes of this channel. No prefixes resets them to the defaults",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalSetPrefixCommand(db, command, env)
+			},
+		},
+		{
+			Name: "twitchchannel",
+			Usage: "[<channel> [<commands|sowon2|timers|carrotson|events> <on|off>]]",
+			Description: "Show or change what the bot does in the Twitch channels",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalTwitchChannelCommand(db, command, env)
+			},
+		},
+		{
+			Name: "twitchevent",
+			Usage: "[<event> [<bex>|off]]",
+			Description: "Show or change the announcements of the Twitch subs, gift subs and raids. The event is available to the bex via event_user(), event_months(), event_viewers(), etc",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalTwitchEventCommand(db, command, env)
+			},
+		},
+		{
+			Name: "addmodrule",
+			Usage: "[dry] <delete|timeout[:<seconds>]|warn|log> <phrase|regex|domain|links|caps|repeat|emoji> <pattern>",
+			Description: "Act on the Discord and Twitch messages matching the rule. The pattern is the phrase, the regexp, the comma separated denied (domain) or allowed (links) domains, the percent of caps, the amount of repeats or emojis. The dry rules are only reported to the mod log",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalAddModRuleCommand(db, command, env)
+			},
+		},
+		{
+			Name: "delmodrule",
+			Usage: "<id>",
+			Description: "Delete a mod rule",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalDelModRuleCommand(db, command, env)
+			},
+		},
+		{
+			Name: "modruledry",
+			Usage: "<id> <on|off>",
+			Description: "Switch the dry run of a mod rule",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalModRuleDryCommand(db, command, env)
+			},
+		},
+		{
+			Name: "modrules",
+			Usage: "[page]",
+			Description: "List the mod rules",
+			Permission: PermissionModerator,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalModRulesCommand(db, command, env)
+			},
+		},
+		{
+			Name: "addtimer",
+			Usage: "<interval-minutes> <min-chat-messages> <command> [args]",
+			Description: "Run a custom command in this channel every N minutes if there were enough chat messages since the last time",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalAddTimerCommand(db, command, env)
+			},
+		},
+		{
+			Name: "deltimer",
+			Usage: "<id>",
+			Description: "Delete a timer of this channel",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalDelTimerCommand(db, command, env)
+			},
+		},
+		{
+			Name: "timers",
+			Description: "List the timers of this channel",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalTimersCommand(db, command, env)
+			},
+		},
+		{
+			Name: "addtrigger",
+			Usage: "\"<regexp>\" [cooldown-seconds] <bex>",
+			Description: "Evaluate bex whenever a non-command message matches the regexp. The message is available via input()",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalAddTriggerCommand(db, command, env)
+			},
+		},
+		{
+			Name: "deltrigger",
+			Usage: "<id>",
+			Description: "Delete a trigger",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalDelTriggerCommand(db, command, env)
+			},
+		},
+		{
+			Name: "triggers",
+			Usage: "[page]",
+			Description: "List the triggers",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalTriggersCommand(db, command, env)
+			},
+		},
+		{
+			Name: "grant",
+			Usage: "<role> <user>",
+			Description: "Grant a role (owner, admin, moderator, trusted) to a user",
+			Permission: PermissionModerator,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalGrantCommand(db, command, env)
+			},
+		},
+		{
+			Name: "revoke",
+			Usage: "<role> <user>",
+			Description: "Revoke a role from a user",
+			Permission: PermissionModerator,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalRevokeCommand(db, command, env)
+			},
+		},
+		{
+			Name: "roles",
+			Usage: "[page]",
+			Description: "List the users with roles",
+			Permission: PermissionModerator,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalRolesCommand(db, command, env)
+			},
+		},
+		{
+			Name: "link",
+			Usage: "[code]",
+			Description: "Link your accounts on different platforms. Run it on Discord to get a code, then confirm the code on the other platform",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalLinkCommand(db, command, env)
+			},
+		},
+		{
+			Name: "unlink",
+			Description: "Unlink this account from your accounts on other platforms",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return EvalUnlinkCommand(db, command, env)
+			},
+		},
+		{
+			Name: "song",
+			Description: "Show the last song played on stream",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				song := LastSongPlayed(db)
+				if song != nil {
+					if len(song.link) > 0 {
+						env.Reply(fmt.Sprintf("🎶 🎵 Last Song: \"%s\" by %s %s 🎵 🎶", song.title, song.artist, song.link));
+					} else {
+						env.Reply(fmt.Sprintf("🎶 🎵 Last Song: \"%s\" by %s 🎵 🎶", song.title, song.artist))
+					}
+				} else {
+					env.Reply("No song has been played so far")
+				}
+				return nil
+			},
+		},
+		{
+			Name: "search",
+			Usage: "<prefix>",
+			Description: "Search Discord members by the prefix of their name",
+			Platform: DiscordPlatform,
+			Permission: PermissionAdmin,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordEnv := env.AsDiscord()
+				prefix := command.Args
+				st, err := discordEnv.dg.GuildMembersSearch(discordEnv.m.GuildID, prefix, 1000);
+				if err != nil {
+					return err
+				}
+
+				env.Reply("There are "+strconv.Itoa(len(st))+" members that start with "+prefix);
+				if 0 < len(st) && len(st) <= 100 {
+					sb := strings.Builder{}
+					for _, s := range st {
+						sb.WriteString(s.User.Username)
+						sb.WriteString(" ")
+					}
+					env.SendMessage("Their names are: "+sb.String());
+				}
+				return nil
+			},
+		},
+		{
+			Name: "actualban",
+			Usage: "<prefix>",
+			Description: "Ban all Discord members whose name starts with the prefix",
+			Platform: DiscordPlatform,
+			Permission: PermissionAdmin,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordEnv := env.AsDiscord()
+				prefix := strings.TrimSpace(command.Args)
+
+				if len(prefix) == 0 {
+					env.Reply("Prefix cannot be empty")
+					return nil
+				}
+
+				st, err := discordEnv.dg.GuildMembersSearch(discordEnv.m.GuildID, prefix, 1000);
+				if err != nil {
+					return err
+				}
+
+				if len(st) == 0 {
+					return nil
+				}
+
+				for i := range st {
+					err = discordEnv.dg.GuildBanCreate(discordEnv.m.GuildID, st[i].User.ID, 0)
+					if err != nil {
+						return err
+					}
+
+					env.Reply(st[i].User.Username + " is banned")
+				}
+
+				env.Reply("Done 🙂")
+				return nil
+			},
+		},
+		{
+			Name: "topspammers",
+			Usage: "[user]",
+			Description: "Show the users with the most messages",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return evalSpammersCommand(db, command, env, "Top Spammers", "desc")
+			},
+		},
+		{
+			Name: "bottomspammers",
+			Usage: "[user]",
+			Description: "Show the users with the least messages",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return evalSpammersCommand(db, command, env, "Bottom Spammers", "asc")
+			},
+		},
+		{
+			Name: "edlimit",
+			Description: "Show the limits of the ed buffer",
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				env.Reply(fmt.Sprintf("Line Count: %d, Line Size: %d", EdLineCountLimit, EdLineSizeLimit))
+				return nil
+			},
+		},
+		{
+			Name: "ed",
+			Usage: "[command]",
+			Description: "The standard text editor",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				userId := CanonicalUserID(env)
+				if len(userId) == 0 {
+					replyUnidentifiedAuthor(env)
+					return nil
+				}
+				ed, err := LoadEdStateByUserId(db, userId)
+				if err != nil {
+					return fmt.Errorf("could not load Ed_State of user %s: %w", userId, err)
+				}
+				ed.ExecCommand(env, command.Args);
+				err = SaveEdStateByUserId(db, userId, ed)
+				if err != nil {
+					return fmt.Errorf("could not save %#v of user %s: %w", ed, userId, err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "showcmd",
+			Usage: "<name>",
+			Description: "Show the bex source code of a custom command",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				matches := CommandNoPrefixRegexp.FindStringSubmatch(command.Args)
+				if len(matches) == 0 {
+					// TODO: give more info on the syntactic error to the user
+					env.Reply("syntax error")
+					return nil
+				}
+
+				name := matches[1]
+				row := db.QueryRow("SELECT bex FROM commands WHERE name = $1", name);
+				var bex string
+				err := row.Scan(&bex)
+				if err == sql.ErrNoRows {
+					env.Reply(fmt.Sprintf("command %s does not exist", name))
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("could not query command %s: %w", name, err)
+				}
+				env.Reply(bex)
+				return nil
+			},
+		},
+		{
+			Name: "addcmd",
+			Usage: "<name> [\"description\"] <bex>",
+			Description: "Add a custom command",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: evalUpdateCommandCommand,
+		},
+		{
+			Name: "updcmd",
+			Usage: "<name> [\"description\"] [bex]",
+			Description: "Update a custom command or its description",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: evalUpdateCommandCommand,
+		},
+		{
+			Name: "delcmd",
+			Usage: "<name>",
+			Description: "Delete a custom command",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				matches := CommandNoPrefixRegexp.FindStringSubmatch(command.Args)
+				if len(matches) == 0 {
+					// TODO: give more info on the syntactic error to the user
+					env.Reply("syntax error")
+					return nil
+				}
+
+				name := matches[1]
+				_, err := db.Exec("DELETE FROM commands WHERE name = $1", name);
+				if err != nil {
+					return fmt.Errorf("could not delete command %s: %w", name, err)
+				}
+				// TODO: report "does not exist" when the deleted command didn't exist
+				env.Reply(fmt.Sprintf("deleted %s", name))
+				return nil
+			},
+		},
+		{
+			Name: "cmdperm",
+			Usage: "<name> [permission]",
+			Description: "Show or set the permission required to run a custom command (everyone, subscriber, trusted, moderator, admin, owner)",
+			Permission: PermissionAdmin,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				return evalCommandPermissionCommand(db, command, env)
+			},
+		},
+		{
+			Name: "remind",
+			Usage: "<delay> <message>",
+			Description: "Set a reminder, for example `remind 1h30m touch grass`",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordUserId, ok := DiscordUserIdOfAuthor(env)
+				if !ok {
+					env.Reply("Reminders are sent on Discord. Link your Discord account with the link command to use them here.")
+					return nil
+				}
+
+				args := ReminderArgsRegexp.FindStringSubmatch(command.Args)
+				if (args == nil) {
+					env.Reply("Coudn't parse the reminder arguments, expected `" + ReminderArgsDef + "`")
+					return nil
+				}
+
+				durationStr := args[1]
+				message := args[5]
+
+				delay, err := ParseReminderDelayStr(durationStr)
+				if err != nil {
+					env.Reply("Delay ammount overflows when parsing the duration string." + "\n")
+					return nil
+				}
+
+				now := time.Now()
+				remindAt, err := AddDelayToTimestamp(now, delay)
+				if err != nil {
+					env.Reply("Delay ammount overflows." + "\n")
+					return nil
+				}
+
+				err = SetReminder(db, Reminder{
+					UserId:   discordUserId,
+					Message:  message,
+					RemindAt: remindAt,
+				})
+				if err != nil {
+					env.Reply(err.Error())
+					return nil
+				}
+
+				env.Reply("Reminder has been successfully set to fire in " + DurationToString(now, remindAt) + ".")
+				return nil
+			},
+		},
+		{
+			Name: "reminders",
+			Description: "List your reminders",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordUserId, ok := DiscordUserIdOfAuthor(env)
+				if !ok {
+					env.Reply("Reminders are sent on Discord. Link your Discord account with the link command to use them here.")
+					return nil
+				}
+
+				reminders, err := QueryUserReminders(discordUserId, db)
+				if err != nil {
+					return fmt.Errorf("could not query user reminders: %w", err)
+				}
+
+				if len(reminders) == 0 {
+					env.Reply("You have no reminders")
+					return nil
+				}
+
+				message := internal.RichMessage{Title: "Your reminders"}
+				for i, r := range reminders {
+					remaining := DurationToString(time.Now(), r.RemindAt)
+					message.Fields = append(message.Fields, internal.RichField{
+						Name: fmt.Sprintf("%d. In %s", i, remaining),
+						Value: r.Message,
+					})
+				}
+				env.ReplyRich(message)
+				return nil
+			},
+		},
+		{
+			Name: "delreminder",
+			Usage: "<index>",
+			Description: "Delete one of your reminders by its index",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordUserId, ok := DiscordUserIdOfAuthor(env)
+				if !ok {
+					env.Reply("Reminders are sent on Discord. Link your Discord account with the link command to use them here.")
+					return nil
+				}
+
+				i, err := strconv.Atoi(command.Args)
+				if err != nil || i < 0 {
+					env.Reply("Command needs a valid positive number index")
+					return nil
+				}
+
+				reminders, err := QueryUserReminders(discordUserId, db)
+				if err != nil {
+					return fmt.Errorf("could not query user reminders: %w", err)
+				}
+
+				if len(reminders) == 0 {
+					env.Reply("You have no reminders")
+					return nil
+				}
+
+				if len(reminders) <= i {
+					env.Reply(fmt.Sprintf("Index '%v' is out of bounds", i))
+					return nil
+				}
+
+				err = DelReminder(db, reminders[i].Id)
+				if err != nil {
+					env.Reply(err.Error())
+					return nil
+				}
+
+				env.Reply(fmt.Sprintf("Reminder '%v' has been deleted", i))
+				return nil
+			},
+		},
+		{
+			Name: "eval",
+			Usage: "<bex>",
+			Description: "Evaluate bex expressions",
+			Platform: DiscordPlatform,
+			AdminAnywhere: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				exprs, err := internal.ParseAllExprs(command.Args)
+				if err != nil {
+					env.Reply(fmt.Sprintf("could not parse expression `%s`: %s", command.Args, err))
+					return nil
+				}
+				if len(exprs) == 0 {
+					env.Reply("no expressions were provided for evaluation")
+					return nil
+				}
+				for _, expr := range exprs {
+					_, err := context.EvalExpr(expr)
+					if err != nil {
+						env.Reply(fmt.Sprintf("could not evaluate expression `%s`: %s", command.Args, err))
+						return nil
+					}
+				}
+				return nil
+			},
+		},
+		// TODO: uncarrot discord message by its id
+		{
+			Name: "carrot",
+			Usage: "[prefix]",
+			Description: "Generate a message with the Carrotson model",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				message, err := internal.CarrotsonGenerate(db, command.Args, 256)
+				if err != nil {
+					return err
+				}
+
+				env.Reply(maskDiscordPings(message))
+				return nil
+			},
+		},
+		{
+			Name: "profile",
+			Usage: "<command>",
+			Description: "Measure how long a command takes to execute",
+			Permission: PermissionAdmin,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				innerCommand, ok := parseCommandInEnvironment(env, command.Args)
+				if !ok {
+					env.Reply("failed to parse inner command")
+					return nil
+				}
+				start := time.Now()
+				EvalCommand(db, innerCommand, env)
+				elapsed := time.Since(start)
+				env.Reply("`" + command.Args + "` took " + elapsed.String() + " to executed")
+				return nil
+			},
+		},
+		{
+			Name: "brok",
+			Usage: "<question>",
+			Description: "Ask Brok a yes or no question",
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				prompt := command.Args
+				yesP, noP, err := internal.GrokQuery(db, command.Args)
+				if err != nil {
+					env.Reply("grok shat his pants")
+					log.Println("Error while checking the weather for:", err)
+				}
+
+				yesPP := math.Pow(math.E, yesP)
+				noPP  := math.Pow(math.E, noP)
+				pp    := yesPP / (yesPP + noPP)
+				yes   := rand.Float64() < pp
+				timestamp := time.Now()
+
+				log.Printf("BROK QUERY: prompt=%v, yesPP=%v, noPP=%v, outcomeYes=%v", internal.GrokTokenizeMessage(prompt), yesPP, noPP, yes)
+
+				if env.AsDiscord() != nil {
+					if len(BrokLastPrompt) != 0 {
+						if timestamp.Sub(BrokLastTimestamp).Seconds() < BrokEngagementThreshold {
+							// TODO: we should probably make sure that the consequent engaging broks are within the same channel/platform
+							log.Printf("BROK REINFORCE: prompt=%v, outcomeYes=%v", internal.GrokTokenizeMessage(BrokLastPrompt), BrokLastYes)
+							err := internal.GrokReinforce(db, BrokLastPrompt, BrokLastYes)
+							if err != nil {
+								env.Reply("Error during broking. " + env.AtAdmin() + " please check the logs");
+								log.Printf("BROK ERROR: %v\n", err)
+								// NOTE: the user is already notified about the error
+								return nil
+							}
+						} else {
+							log.Printf("BROK NOT ENGAGING: prompt=%v, outcomeYes=%v", internal.GrokTokenizeMessage(BrokLastPrompt), BrokLastYes)
+						}
+					}
+				}
+
+				if yes {
+					env.Reply("Yes")
+				} else {
+					env.Reply("No")
+				}
+
+				BrokLastPrompt    = prompt
+				BrokLastYes       = yes
+				BrokLastTimestamp = timestamp
+				return nil
+			},
+		},
+		{
+			Name: "weather",
+			Usage: "<place>",
+			Description: "Check the weather at the place",
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				place := command.Args
+
+				var response string
+				var err error
+				if len(place) > 0 {
+					response, err = checkWeatherOf(place)
+					if err == PlaceNotFound {
+						response = "Could not find `" + place + "`"
+					} else if err == SomebodyTryingToHackWeather {
+						response = "Are you trying to hack me or something? ._."
+					} else if err != nil {
+						response = "Something went wrong while querying the weather for `" + place + "`. Please ask the admin to check the logs."
+						log.Println("Error while checking the weather for `"+place+"`:", err)
+					}
+				} else {
+					response = "No place is provided for the weather command"
+				}
+
+				env.Reply(response)
+				return nil
+			},
+		},
+		{
+			Name: "version",
+			Description: "Show the commit the bot was built from",
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				env.Reply(Commit)
+				return nil
+			},
+		},
+		{
+			Name: "count",
+			Description: "Show how many trusts you have used",
+			Platform: DiscordPlatform,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordEnv := env.AsDiscord()
+
+				if !env.HasPermission(PermissionTrusted) {
+					env.Reply("Only trusted users can trust others")
+					return nil
+				}
+				count, err := TrustedTimesOfUser(db, discordEnv.m.Author)
+				if err != nil {
+					return fmt.Errorf("could not get amount of trusted times: %w", err)
+				}
+				if count > MaxTrustedTimes {
+					env.Reply(fmt.Sprintf("Used %d out of %d trusts <:tsodinSus:940724160680845373>", count, MaxTrustedTimes))
+				} else {
+					env.Reply(fmt.Sprintf("Used %d out of %d trusts", count, MaxTrustedTimes))
+				}
+				return nil
+			},
+		},
+		/*
+		{
+			Name: "trust",
+			Usage: "<@user>",
+			Description: "Trust a user",
+			Platform: DiscordPlatform,
+			RequiresDB: true,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				discordEnv := env.AsDiscord()
+
+				if !env.HasPermission(PermissionTrusted) {
+					env.Reply("Only trusted users can trust others")
+					return nil
+				}
+
+				if len(discordEnv.m.Mentions) == 0 {
+					env.Reply("Please ping the user you want to trust")
+					return nil
+				}
+
+				if len(discordEnv.m.Mentions) > 1 {
+					env.Reply("You can't trust several people simultaneously")
+					return nil
+				}
+
+				mention := discordEnv.m.Mentions[0]
+
+				count, err := TrustedTimesOfUser(db, discordEnv.m.Author)
+				if err != nil {
+					return fmt.Errorf("could not get amount of trusted times: %w", err)
+				}
+				if count >= MaxTrustedTimes {
+					if !env.HasPermission(PermissionAdmin) {
+						env.Reply(fmt.Sprintf("You ran out of trusts. Used %d out of %d", count, MaxTrustedTimes))
+						return nil
+					} else {
+						env.Reply(fmt.Sprintf("You ran out of trusts. Used %d out of %d. But since you are the %s I'll make an exception for you.", count, MaxTrustedTimes, env.AtAdmin()))
+					}
+				}
+
+				if mention.ID == discordEnv.m.Author.ID {
+					env.Reply("On this server you can't trust yourself!")
+					return nil
+				}
+
+				mentionMember, err := discordEnv.dg.GuildMember(discordEnv.m.GuildID, mention.ID)
+				if err != nil {
+					return fmt.Errorf("could not get roles of user %s: %w", mention.ID, err)
+				}
+
+				if isMemberTrusted(mentionMember) {
+					env.Reply("That member is already trusted")
+					return nil
+				}
+
+				// TODO: do all of that in a transation that is rollbacked when GuildMemberRoleAdd fails
+				// TODO: add record to trusted users table
+				_, err = db.Exec("INSERT INTO TrustLog (trusterId, trusteeId) VALUES ($1, $2);", discordEnv.m.Author.ID, mention.ID)
+				if err != nil {
+					return fmt.Errorf("could not save a TrustLog entry: %w", err)
+				}
+
+				err = discordEnv.dg.GuildMemberRoleAdd(discordEnv.m.GuildID, mention.ID, TrustedRoleId)
+				if err != nil {
+					return fmt.Errorf("could not assign role %s to user %s: %w", TrustedRoleId, mention.ID, err)
+				}
+
+				discordEnv.AllowMention(mention.ID)
+				env.Reply(fmt.Sprintf("Trusted %s. Used %d out of %d trusts.", AtUser(mention), count+1, MaxTrustedTimes))
+				return nil
+			},
+		},
+		*/
+		{
+			Name: "mine",
+			Usage: "[seed]",
+			Description: "Generate a Minesweeper field",
+			Platform: DiscordPlatform,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				// TODO: make the field size customizable via the command parameters
+				var seed string
+				if len(command.Args) > 0 {
+					seed = command.Args
+				} else {
+					seed = randomMinesweeperSeed()
+				}
+
+				r := rand.New(seedAsSource(seed))
+				env.SendMessage(renderMinesweeperFieldForDiscord(randomMinesweeperField(r), seed))
+				return nil
+			},
+		},
+		{
+			Name: "mineopen",
+			Usage: "<seed>",
+			Description: "Show the opened Minesweeper field of the seed",
+			Platform: DiscordPlatform,
+			Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+				if len(command.Args) == 0 {
+					env.Reply("please provide the seed")
+					return nil
+				}
+
+				seed := command.Args
+				r := rand.New(seedAsSource(seed))
+				env.SendMessage(renderOpenMinesweeperFieldForDiscord(randomMinesweeperField(r), seed))
+				return nil
+			},
+		},
+	}
+
+	for _, transform := range internal.Transforms {
+		BuiltinCommands = append(BuiltinCommands, transformBuiltin(transform))
+	}
+}
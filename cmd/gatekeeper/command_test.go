@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/tsoding/gatekeeper/internal"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		source string
+		ok     bool
+		prefix string
+		name   string
+		args   string
+	}{
+		{"!ping", true, "!", "ping", ""},
+		{"$ping", true, "$", "ping", ""},
+		{"  ! ping   hello world", true, "!", "ping", "hello world"},
+		{"!add-cmd_2 x", true, "!", "add-cmd_2", "x"},
+		{"ping", false, "", "", ""},
+		{"?ping", false, "", "", ""},
+		{"!", false, "", "", ""},
+	}
+	for _, c := range cases {
+		command, ok := parseCommand(c.source)
+		if ok != c.ok {
+			t.Errorf("%q: expected ok=%v, but got %v", c.source, c.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if command.Prefix != c.prefix || command.Name != c.name || command.Args != c.args {
+			t.Errorf("%q: expected %q %q %q, but got %q %q %q", c.source, c.prefix, c.name, c.args, command.Prefix, command.Name, command.Args)
+		}
+	}
+}
+
+func TestParseCommandWithPrefixes(t *testing.T) {
+	command, ok := parseCommandWithPrefixes("?? carrot top", []string{"??", "."})
+	if !ok || command.Prefix != "??" || command.Name != "carrot" || command.Args != "top" {
+		t.Fatalf("unexpected %#v %v", command, ok)
+	}
+	if _, ok := parseCommandWithPrefixes("!carrot", []string{"??", "."}); ok {
+		t.Fatalf("the default prefix must not work when the prefixes are overridden")
+	}
+}
+
+func TestParseCommandDescription(t *testing.T) {
+	description, bex, ok := parseCommandDescription(`"Greets you" say("Hello")`)
+	if !ok || description != "Greets you" || bex != `say("Hello")` {
+		t.Fatalf("unexpected %q %q %v", description, bex, ok)
+	}
+	_, bex, ok = parseCommandDescription(`say("Hello")`)
+	if ok || bex != `say("Hello")` {
+		t.Fatalf("unexpected %q %v", bex, ok)
+	}
+}
+
+func evalTestCommand(t *testing.T, env CommandEnvironment, source string) {
+	t.Helper()
+	command, ok := parseCommandInEnvironment(env, source)
+	if !ok {
+		t.Fatalf("could not parse command %q", source)
+	}
+	EvalCommand(nil, command, env)
+}
+
+func TestEvalUnknownCommand(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!nonexistent")
+	expectMessages(t, env.Messages, "@alice command `nonexistent` does not exist")
+}
+
+func TestEvalBuiltinCommand(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!edlimit")
+	expectMessages(t, env.Messages, fmt.Sprintf("@alice Line Count: %d, Line Size: %d", EdLineCountLimit, EdLineSizeLimit))
+}
+
+func TestEvalCommandPermission(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!profile !edlimit")
+	expectMessages(t, env.Messages, "@alice This command requires the admin role")
+
+	env = newFakeEnvironment("twitch", "alice")
+	env.Permission = PermissionModerator
+	evalTestCommand(t, env, "!profile !edlimit")
+	expectMessages(t, env.Messages, "@alice This command requires the admin role")
+
+	env = newFakeEnvironment("twitch", "alice")
+	env.Permission = PermissionAdmin
+	evalTestCommand(t, env, "!profile !edlimit")
+	if len(env.Messages) != 2 || !strings.HasPrefix(env.Messages[1], "@alice `!edlimit` took ") {
+		t.Fatalf("unexpected messages %q", env.Messages)
+	}
+}
+
+func TestEvalCommandDiscordOnly(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, `!eval say("hi")`)
+	expectMessages(t, env.Messages, "@alice This command only works in Discord, sorry")
+
+	// Admins may use such commands anywhere
+	env = newFakeEnvironment("twitch", "alice")
+	env.Permission = PermissionAdmin
+	evalTestCommand(t, env, `!eval say("hi")`)
+	expectMessages(t, env.Messages, "hi")
+
+	// AdminAnywhere does not apply to the rest of the Discord commands
+	env = newFakeEnvironment("twitch", "alice")
+	env.Permission = PermissionAdmin
+	evalTestCommand(t, env, "!mine 69")
+	expectMessages(t, env.Messages, "@alice This command only works in Discord, sorry")
+}
+
+func TestEvalCommandRequiresDB(t *testing.T) {
+	for _, source := range []string{"!ed", "!remind 1h touch grass", "!addcmd hello say(\"hi\")"} {
+		env := newFakeEnvironment("twitch", "alice")
+		env.Permission = PermissionOwner
+		evalTestCommand(t, env, source)
+		expectMessages(t, env.Messages, "@alice Something went wrong with the database. Commands that require it won't work. Please ask @admin to check the logs")
+	}
+}
+
+func TestEvalCommandOnDiscord(t *testing.T) {
+	withRoles(t, nil)
+	env, session := newFakeDiscordEnvironment("69")
+	evalTestCommand(t, env, `!eval say(author(), " ", twitch_or_discord("twitch", "discord"))`)
+	expectMessages(t, session.Contents(), "<@69> discord")
+	if session.Messages[0].ChannelID != "test" {
+		t.Fatalf("expected the message in the channel of the command, but got %q", session.Messages[0].ChannelID)
+	}
+}
+
+func TestDiscordEnvironmentPermission(t *testing.T) {
+	withRoles(t, []internal.UserRole{
+		{UserId: "discord#1", Role: internal.RoleAdmin},
+	})
+
+	admin, _ := newFakeDiscordEnvironment("1")
+	if !admin.HasPermission(PermissionAdmin) || admin.HasPermission(PermissionOwner) {
+		t.Errorf("discord#1 must be exactly an admin")
+	}
+
+	nobody, _ := newFakeDiscordEnvironment("2")
+	if nobody.HasPermission(PermissionTrusted) {
+		t.Errorf("discord#2 must not be trusted")
+	}
+
+	trusted, _ := newFakeDiscordEnvironment("3")
+	trusted.m.Member = &discordgo.Member{Roles: []string{TrustedRoleId}}
+	if !trusted.HasPermission(PermissionTrusted) || trusted.HasPermission(PermissionModerator) {
+		t.Errorf("members with the Discord trusted role must be exactly trusted")
+	}
+
+	// Environments without an author (timers) must not pass any checks
+	system, _ := newFakeDiscordEnvironment("")
+	system.m.Author = nil
+	if system.HasPermission(PermissionTrusted) {
+		t.Errorf("environment without an author must not be trusted")
+	}
+}
+
+func TestSendDirectMessage(t *testing.T) {
+	env, session := newFakeDiscordEnvironment("69")
+	if err := env.SendDirectMessage("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Messages) != 1 || session.Messages[0].ChannelID != "dm-69" || session.Messages[0].Content != "secret" {
+		t.Fatalf("unexpected messages %#v", session.Messages)
+	}
+}
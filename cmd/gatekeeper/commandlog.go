@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	CommandStatsPeriod = 7 * 24 * time.Hour
+	CommandStatsLimit = 5
+)
+
+func LogCommandInvocation(db *sql.DB, command Command, env CommandEnvironment, duration time.Duration, err error) {
+	if db == nil {
+		return
+	}
+	// Typos and the commands of the other bots (!so, !uptime, etc)
+	// are not invocations of anything
+	if errors.Is(err, CommandDoesNotExist) {
+		return
+	}
+	logErr := internal.LogCommandInvocation(db, internal.CommandInvocation{
+		Name:     command.Name,
+		Platform: env.Platform(),
+		Channel:  env.ChannelID(),
+		UserId:   CanonicalUserID(env),
+		Duration: duration,
+		Err:      err,
+	})
+	if logErr != nil {
+		log.Printf("ERROR: LogCommandInvocation: could not log invocation of command %s: %s\n", command.Name, logErr)
+	}
+}
+
+func formatCommandStats(stats internal.CommandStats) string {
+	return fmt.Sprintf("%s: %d calls, %.0f%% failed, avg %.1fms, max %.1fms", stats.Name, stats.Invocations, stats.FailureRate()*100, stats.AvgDurationMs, stats.MaxDurationMs)
+}
+
+func EvalCmdStatsCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	since := time.Now().Add(-CommandStatsPeriod)
+	arg := strings.TrimSpace(command.Args)
+
+	var title string
+	var order internal.CommandStatsOrder
+	switch arg {
+	case "", "top":
+		title = "Top commands"
+		order = internal.ByInvocations
+	case "failing":
+		title = "Most failing commands"
+		order = internal.ByFailureRate
+	case "slow":
+		title = "Slowest commands"
+		order = internal.ByAvgDuration
+	default:
+		stats, err := internal.QueryCommandStatsByName(db, arg, since)
+		if err != nil {
+			return fmt.Errorf("could not query stats of command %s: %w", arg, err)
+		}
+		if stats.Invocations == 0 {
+			env.Reply(fmt.Sprintf("command %s was not used in the last %s", arg, DurationToString(since, time.Now())))
+			return nil
+		}
+		env.Reply(formatCommandStats(stats))
+		return nil
+	}
+
+	stats, err := internal.QueryCommandStats(db, since, order, CommandStatsLimit)
+	if err != nil {
+		return fmt.Errorf("could not query command stats: %w", err)
+	}
+	if len(stats) == 0 {
+		env.Reply("No commands were used so far")
+		return nil
+	}
+
+	message := internal.RichMessage{
+		Title: fmt.Sprintf("%s (%s)", title, DurationToString(since, time.Now())),
+		Numbered: true,
+	}
+	for _, s := range stats {
+		message.Items = append(message.Items, formatCommandStats(s))
+	}
+	env.ReplyRich(message)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"regexp"
 	"log"
+	"time"
 )
 
 var DiscordPingRegexp = regexp.MustCompile("<@[0-9]+>")
@@ -30,6 +31,9 @@ func maskDiscordPings(message string) string {
 }
 
 func isMemberTrusted(member *discordgo.Member) bool {
+	if member == nil {
+		return false
+	}
 	for _, roleId := range member.Roles {
 		if roleId == TrustedRoleId {
 			return true
@@ -64,38 +68,160 @@ func TrustedTimesOfUser(db *sql.DB, user *discordgo.User) (int, error) {
 	return 0, fmt.Errorf("TrustedTimesOfUser: expected at least one row with result")
 }
 
+// The part of *discordgo.Session the bot uses. Allows to replace the
+// session with a fake one in tests.
+type DiscordSession interface {
+	// There is no ChannelMessageSend on purpose. All the messages must
+	// be sent with DiscordAllowedMentions.
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error)
+	UserChannelCreate(recipientID string) (*discordgo.Channel, error)
+	GuildMember(guildID, userID string) (*discordgo.Member, error)
+	GuildMembersSearch(guildID, query string, limit int) ([]*discordgo.Member, error)
+	GuildMemberRoleAdd(guildID, userID, roleID string) error
+	GuildBanCreate(guildID, userID string, days int) error
+	ChannelMessageDelete(channelID, messageID string) error
+	GuildMemberTimeout(guildID string, userID string, until *time.Time) error
+}
+
 type DiscordEnvironment struct {
-	dg *discordgo.Session
+	dg DiscordSession
 	m *discordgo.MessageCreate
+	// Ids of the users the messages of this environment may ping
+	// besides the author. See DiscordAllowedMentions().
+	mentionable []string
 }
 
 func (env *DiscordEnvironment) AsDiscord() *DiscordEnvironment {
 	return env
 }
 
+func (env *DiscordEnvironment) BotID() string {
+	if session, ok := env.dg.(*discordgo.Session); ok && session.State != nil && session.State.User != nil {
+		return session.State.User.ID
+	}
+	return ""
+}
+
+func (env *DiscordEnvironment) Platform() string {
+	return "discord"
+}
+
+func (env *DiscordEnvironment) ChannelID() string {
+	return env.m.ChannelID
+}
+
 func (env *DiscordEnvironment) AtAdmin() string {
-	return AtID(AdminID)
+	if ownerId, ok := Roles.OwnerOn(env.Platform()); ok {
+		// Asking the owner for help is an intended ping
+		env.AllowMention(ownerId)
+		return AtID(ownerId)
+	}
+	return "the owner"
+}
+
+// Allows the messages of this environment to ping the user
+func (env *DiscordEnvironment) AllowMention(userId string) {
+	env.mentionable = appendUnique(env.mentionable, userId)
+}
+
+func (env *DiscordEnvironment) allowedMentions() *discordgo.MessageAllowedMentions {
+	userIds := env.mentionable
+	if env.m.Author != nil {
+		userIds = appendUnique(userIds, env.m.Author.ID)
+	}
+	return DiscordAllowedMentions(userIds...)
 }
 
 func (env *DiscordEnvironment) UniversalPlatformAgnosticUserID() string {
+	if env.m.Author == nil {
+		return ""
+	}
 	return "discord#"+env.m.Author.ID
 }
 
 func (env *DiscordEnvironment) AtAuthor() string {
+	// The author could be nil if the environment was created not by
+	// a message. For instance, by a timer.
+	if env.m.Author == nil {
+		return ""
+	}
 	return AtUser(env.m.Author)
 }
 
-func (env *DiscordEnvironment) IsAuthorAdmin() bool {
-	return env.m.Author.ID == AdminID
+func (env *DiscordEnvironment) HasPermission(permission Permission) bool {
+	if env.m.Author == nil {
+		return permission == PermissionEveryone
+	}
+	authorPermission := Roles.PermissionOfUser(env.UniversalPlatformAgnosticUserID())
+	// The members with the Discord trusted role are trusted by the bot as well
+	if authorPermission < PermissionTrusted && isMemberTrusted(env.m.Member) {
+		authorPermission = PermissionTrusted
+	}
+	return authorPermission >= permission
 }
 
 func (env *DiscordEnvironment) SendMessage(message string) {
-	_, err := env.dg.ChannelMessageSend(env.m.ChannelID, message)
+	env.sendComplex(&discordgo.MessageSend{Content: message})
+}
+
+func (env *DiscordEnvironment) sendComplex(data *discordgo.MessageSend) {
+	data.AllowedMentions = env.allowedMentions()
+	_, err := env.dg.ChannelMessageSendComplex(env.m.ChannelID, data)
 	if err != nil {
 		log.Println("Error during sending discord message", err)
 	}
 }
 
+func (env *DiscordEnvironment) SendRichMessage(message internal.RichMessage) {
+	env.sendComplex(&discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{DiscordEmbedOfRichMessage(message)},
+	})
+}
+
+func (env *DiscordEnvironment) repliesNatively() bool {
+	// The environment could be created not by a message. For instance, by a timer.
+	return env.m.Author != nil && len(env.m.ID) > 0 && ReplyStyleOfPlatform(env.Platform()) == ReplyNative
+}
+
+// The reply itself does not ping the author, since RepliedUser of
+// DiscordAllowedMentions() is false
+func (env *DiscordEnvironment) nativeReply(data *discordgo.MessageSend) *discordgo.MessageSend {
+	data.Reference = env.m.Reference()
+	return data
+}
+
+func (env *DiscordEnvironment) Reply(message string) {
+	if !env.repliesNatively() {
+		env.SendMessage(withAuthorMention(env, message))
+		return
+	}
+	env.sendComplex(env.nativeReply(&discordgo.MessageSend{Content: message}))
+}
+
+func (env *DiscordEnvironment) ReplyRich(message internal.RichMessage) {
+	data := &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{DiscordEmbedOfRichMessage(message)},
+	}
+	if !env.repliesNatively() {
+		data.Content = env.AtAuthor()
+		env.sendComplex(data)
+		return
+	}
+	env.sendComplex(env.nativeReply(data))
+}
+
+func (env *DiscordEnvironment) SendDirectMessage(message string) error {
+	channel, err := env.dg.UserChannelCreate(env.m.Author.ID)
+	if err != nil {
+		return err
+	}
+	_, err = env.dg.ChannelMessageSendComplex(channel.ID, &discordgo.MessageSend{
+		Content: message,
+		AllowedMentions: DiscordAllowedMentions(),
+	})
+	return err
+}
+
 func logDiscordMessage(db *sql.DB, m *discordgo.MessageCreate) {
 	_, err := db.Exec("INSERT INTO Discord_Log (message_id, user_id, user_name, text) VALUES ($1, $2, $3, $4)", m.ID, m.Author.ID, m.Author.Username, m.Content);
 	if err != nil {
@@ -111,24 +237,37 @@ func handleDiscordMessage(db *sql.DB, dg *discordgo.Session, m *discordgo.Messag
 
 	logDiscordMessage(db, m);
 
-	command, ok := parseCommand(m.Content)
+	env := &DiscordEnvironment{
+		dg: dg,
+		m: m,
+	}
+
+	removed := ModerateMessage(env, ModMessage{
+		Platform: env.Platform(),
+		Channel: env.ChannelID(),
+		UserId: env.UniversalPlatformAgnosticUserID(),
+		Text: m.Content,
+	})
+	if removed {
+		return
+	}
+
+	Activity.Record(env.Platform(), env.ChannelID())
+
+	command, ok := parseCommandInEnvironment(env, m.Content)
 	if !ok {
+		EvalTriggers(env, m.Content)
 		if db != nil {
 			internal.FeedMessageToCarrotson(db, m.Content)
 		}
 		return
 	}
 
-	env := &DiscordEnvironment{
-		dg: dg,
-		m: m,
-	}
 	EvalCommand(db, command, env);
 }
 
 var (
 	// TODO: unhardcode these parameters (config, database, or something else)
-	AdminID = "180406039500292096"
 	MaxTrustedTimes = 1
 	TrustedRoleId = "543864981171470346"
 )
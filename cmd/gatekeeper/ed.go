@@ -62,7 +62,7 @@ func LoadEdStateByUserId(db *sql.DB, userId string) (EdState, error) {
 }
 
 func (ed *EdState) Print(env CommandEnvironment, line string) {
-	env.SendMessage(env.AtAuthor()+" "+line);
+	env.Reply(line);
 }
 
 func (ed *EdState) LineAt(index int) (string, bool) {
@@ -74,7 +74,7 @@ func (ed *EdState) LineAt(index int) (string, bool) {
 }
 
 func (ed *EdState) Huh(env CommandEnvironment) {
-	env.SendMessage(env.AtAuthor()+" ?")
+	env.Reply("?")
 }
 
 func (ed *EdState) ExecCommand(env CommandEnvironment, command string) {
@@ -153,11 +153,11 @@ func (ed *EdState) ExecCommand(env CommandEnvironment, command string) {
 			// new lines. While EdLineSizeLimit is about checking the
 			// size of the line we are about to insert.
 			if len(ed.Buffer) >= EdLineCountLimit {
-				env.SendMessage(fmt.Sprintf("%s Your message exceeded line count limit (You may have %d lines maximum)", env.AtAuthor(), EdLineCountLimit))
+				env.Reply(fmt.Sprintf("Your message exceeded line count limit (You may have %d lines maximum)", EdLineCountLimit))
 				return
 			}
 			if utf8.RuneCountInString(command) > EdLineSizeLimit {
-				env.SendMessage(fmt.Sprintf("%s Your message exceeded line size limit (Your lines may have %d characters maximum)", env.AtAuthor(), EdLineSizeLimit))
+				env.Reply(fmt.Sprintf("Your message exceeded line size limit (Your lines may have %d characters maximum)", EdLineSizeLimit))
 				return
 			}
 			if _, ok := ed.LineAt(ed.Cursor); ok {
@@ -172,7 +172,7 @@ func (ed *EdState) ExecCommand(env CommandEnvironment, command string) {
 		}
 	default:
 		log.Printf("Invalid mode of Ed State: %#v\n", ed)
-		env.SendMessage(fmt.Sprintf("%s something went wrong with the state of your Ed. I've tried to correct it. Try again and ask %s to check the logs if the problem persists.", env.AtAuthor(), env.AtAdmin()));
+		env.Reply(fmt.Sprintf("something went wrong with the state of your Ed. I've tried to correct it. Try again and ask %s to check the logs if the problem persists.", env.AtAdmin()));
 		ed.Mode = EdCommandMode
 	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func execEd(ed *EdState, env *FakeEnvironment, commands ...string) {
+	for _, command := range commands {
+		ed.ExecCommand(env, command)
+	}
+}
+
+func TestEdInsertAndPrint(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	ed := EdState{}
+	execEd(&ed, env, "a", "first", "second", "third", ".", ",p")
+	expectMessages(t, env.Messages, "@alice first", "@alice second", "@alice third")
+	if ed.Cursor != 2 || ed.Mode != EdCommandMode {
+		t.Fatalf("unexpected state %#v", ed)
+	}
+}
+
+func TestEdNavigation(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	ed := EdState{Buffer: []string{"foo", "bar", "baz"}}
+	execEd(&ed, env, "p", "", "", "", "1", "n", ",n")
+	expectMessages(t, env.Messages,
+		"@alice foo",
+		"@alice bar",
+		"@alice baz",
+		"@alice ?",
+		"@alice foo",
+		"@alice 1        foo",
+		"@alice 1        foo",
+		"@alice 2        bar",
+		"@alice 3        baz",
+	)
+}
+
+func TestEdInsertAfterCursor(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	ed := EdState{Buffer: []string{"foo", "baz"}}
+	execEd(&ed, env, "a", "bar", ".")
+	if strings.Join(ed.Buffer, ",") != "foo,bar,baz" || ed.Cursor != 1 {
+		t.Fatalf("unexpected state %#v", ed)
+	}
+}
+
+func TestEdDelete(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	ed := EdState{Buffer: []string{"foo", "bar"}, Cursor: 1}
+	execEd(&ed, env, "d")
+	if strings.Join(ed.Buffer, ",") != "foo" || ed.Cursor != 0 {
+		t.Fatalf("unexpected state %#v", ed)
+	}
+	execEd(&ed, env, "d", "d", "p", ",p")
+	expectMessages(t, env.Messages, "@alice ?", "@alice ?", "@alice ?")
+	if len(ed.Buffer) != 0 {
+		t.Fatalf("unexpected state %#v", ed)
+	}
+}
+
+func TestEdLimits(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	ed := EdState{}
+	execEd(&ed, env, "a", strings.Repeat("x", EdLineSizeLimit+1))
+	if len(env.Messages) != 1 || !strings.Contains(env.Messages[0], "line size limit") || len(ed.Buffer) != 0 {
+		t.Fatalf("unexpected messages %q and state %#v", env.Messages, ed)
+	}
+
+	env = newFakeEnvironment("twitch", "alice")
+	for i := 0; i < EdLineCountLimit+1; i += 1 {
+		execEd(&ed, env, "line")
+	}
+	if len(env.Messages) != 1 || !strings.Contains(env.Messages[0], "line count limit") || len(ed.Buffer) != EdLineCountLimit {
+		t.Fatalf("unexpected messages %q and state %#v", env.Messages, ed)
+	}
+}
+
+func TestEdInvalidMode(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	ed := EdState{Mode: EdMode(69)}
+	execEd(&ed, env, "p")
+	if len(env.Messages) != 1 || ed.Mode != EdCommandMode {
+		t.Fatalf("unexpected messages %q and state %#v", env.Messages, ed)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/tsoding/gatekeeper/internal"
+	"testing"
+	"time"
+)
+
+// CommandEnvironment that records all the messages instead of sending
+// them. Poses as any platform and any role.
+type FakeEnvironment struct {
+	PlatformName string
+	Channel      string
+	UserId       string
+	Permission   Permission
+	// Returned by AsDiscord(). See newFakeDiscordEnvironment().
+	Discord      *DiscordEnvironment
+	Messages     []string
+}
+
+func newFakeEnvironment(platform string, userId string) *FakeEnvironment {
+	return &FakeEnvironment{
+		PlatformName: platform,
+		Channel:      "test",
+		UserId:       userId,
+		Permission:   PermissionEveryone,
+		Messages:     []string{},
+	}
+}
+
+func (env *FakeEnvironment) AtAdmin() string {
+	return "@admin"
+}
+
+func (env *FakeEnvironment) AtAuthor() string {
+	return "@" + env.UserId
+}
+
+func (env *FakeEnvironment) UniversalPlatformAgnosticUserID() string {
+	return env.PlatformName + "#" + env.UserId
+}
+
+func (env *FakeEnvironment) HasPermission(permission Permission) bool {
+	return env.Permission >= permission
+}
+
+func (env *FakeEnvironment) AsDiscord() *DiscordEnvironment {
+	return env.Discord
+}
+
+func (env *FakeEnvironment) Platform() string {
+	return env.PlatformName
+}
+
+func (env *FakeEnvironment) ChannelID() string {
+	return env.Channel
+}
+
+func (env *FakeEnvironment) SendMessage(message string) {
+	env.Messages = append(env.Messages, message)
+}
+
+// Always replies in the ReplyMention style
+func (env *FakeEnvironment) Reply(message string) {
+	env.SendMessage(withAuthorMention(env, message))
+}
+
+func (env *FakeEnvironment) SendRichMessage(message internal.RichMessage) {
+	env.SendMessage(message.Flatten())
+}
+
+func (env *FakeEnvironment) ReplyRich(message internal.RichMessage) {
+	env.Reply(message.Flatten())
+}
+
+type FakeDiscordMessage struct {
+	ChannelID string
+	Content   string
+	// Id of the message it replies to if any
+	ReplyTo   string
+	Embeds    []*discordgo.MessageEmbed
+	AllowedMentions *discordgo.MessageAllowedMentions
+}
+
+// DiscordSession that records everything instead of talking to Discord
+type FakeDiscordSession struct {
+	Messages []FakeDiscordMessage
+	// "<userID> <roleID>"
+	RolesAdded []string
+	Bans       []string
+	Members    []*discordgo.Member
+	// "<channelID> <messageID>"
+	Deleted    []string
+	// "<userID> <until>"
+	Timeouts   []string
+}
+
+func (session *FakeDiscordSession) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	message := FakeDiscordMessage{
+		ChannelID: channelID,
+		Content: data.Content,
+		Embeds: data.Embeds,
+		AllowedMentions: data.AllowedMentions,
+	}
+	if data.Reference != nil {
+		message.ReplyTo = data.Reference.MessageID
+	}
+	session.Messages = append(session.Messages, message)
+	return &discordgo.Message{ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (session *FakeDiscordSession) UserChannelCreate(recipientID string) (*discordgo.Channel, error) {
+	return &discordgo.Channel{ID: "dm-" + recipientID}, nil
+}
+
+func (session *FakeDiscordSession) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	for _, member := range session.Members {
+		if member.User != nil && member.User.ID == userID {
+			return member, nil
+		}
+	}
+	return &discordgo.Member{GuildID: guildID, User: &discordgo.User{ID: userID}}, nil
+}
+
+func (session *FakeDiscordSession) GuildMembersSearch(guildID, query string, limit int) ([]*discordgo.Member, error) {
+	return session.Members, nil
+}
+
+func (session *FakeDiscordSession) GuildMemberRoleAdd(guildID, userID, roleID string) error {
+	session.RolesAdded = append(session.RolesAdded, userID+" "+roleID)
+	return nil
+}
+
+func (session *FakeDiscordSession) GuildBanCreate(guildID, userID string, days int) error {
+	session.Bans = append(session.Bans, userID)
+	return nil
+}
+
+func (session *FakeDiscordSession) ChannelMessageDelete(channelID, messageID string) error {
+	session.Deleted = append(session.Deleted, channelID+" "+messageID)
+	return nil
+}
+
+func (session *FakeDiscordSession) GuildMemberTimeout(guildID string, userID string, until *time.Time) error {
+	session.Timeouts = append(session.Timeouts, userID+" "+until.Format(time.RFC3339))
+	return nil
+}
+
+func (session *FakeDiscordSession) Contents() []string {
+	contents := []string{}
+	for _, message := range session.Messages {
+		contents = append(contents, message.Content)
+	}
+	return contents
+}
+
+func newFakeDiscordEnvironment(authorId string) (*DiscordEnvironment, *FakeDiscordSession) {
+	session := &FakeDiscordSession{}
+	env := &DiscordEnvironment{
+		dg: session,
+		m: &discordgo.MessageCreate{
+			Message: &discordgo.Message{
+				ID:        "1000",
+				ChannelID: "test",
+				GuildID:   "guild",
+				Author:    &discordgo.User{ID: authorId},
+			},
+		},
+	}
+	return env, session
+}
+
+// Replaces the roles of the users for the duration of the test
+func withRoles(t *testing.T, userRoles []internal.UserRole) {
+	t.Setenv("GATEKEEPER_OWNERS", "")
+	Roles.update(userRoles)
+	t.Cleanup(func() {
+		Roles.update(nil)
+	})
+}
+
+func expectMessages(t *testing.T, actual []string, expected ...string) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d messages %q, but got %d %q", len(expected), expected, len(actual), actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("message %d: expected %q, but got %q", i, expected[i], actual[i])
+		}
+	}
+}
@@ -21,12 +21,21 @@ func main() {
 		defer db.Close()
 	}
 
+	PollCommandPrefixes(db)
+	PollIdentities(db)
+	PollRoles(db)
+	LoadTwitchUsers(db)
+	PollTriggers(db)
+	PollTwitchChannelSettings(db)
+	PollModRules(db)
+
 	// Discord //////////////////////////////
 	dg, err := startDiscord(db)
 	if err != nil {
 		log.Println("Could not open Discord connection:", err);
 	} else {
 		defer dg.Close();
+		ModLog.Start(dg)
 	}
 
 	PollOverdueReminders(db, dg)
@@ -45,6 +54,16 @@ func main() {
 		defer tw.Close()
 	}
 
+	// IRC //////////////////////////////
+	irc, ok := startIrcNetwork(db)
+	if !ok {
+		log.Println("Could not open IRC connection")
+	} else {
+		defer irc.Close()
+	}
+
+	PollTimers(db, dg, tw, irc)
+
 	// Wait here until CTRL-C or other term signal is received.
 	log.Println("Bot is now running.  Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
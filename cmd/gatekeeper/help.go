@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"strconv"
+	"strings"
+)
+
+const (
+	// https://discord.com/developers/docs/resources/channel#create-message
+	DiscordMessageLimit = 2000
+	// https://dev.twitch.tv/docs/irc/#sending-and-receiving-chat-messages
+	// Minus a little bit for the TwitchMessagePrefix that TwitchSendQueue prepends to every message.
+	TwitchMessageLimit = 490
+	CommandDescriptionLimit = 256
+)
+
+func MessageLimitOfEnvironment(env CommandEnvironment) int {
+	if env.AsDiscord() != nil {
+		return DiscordMessageLimit
+	}
+	return TwitchMessageLimit
+}
+
+// Splits items into pages each of which fits into limit bytes
+// (including the header) when joined by separator.
+func paginateItems(items []string, header string, separator string, limit int) [][]string {
+	pages := [][]string{}
+	page := []string{}
+	size := len(header)
+	for _, item := range items {
+		if len(page) > 0 && size+len(separator)+len(item) > limit {
+			pages = append(pages, page)
+			page = []string{}
+			size = len(header)
+		}
+		if len(page) > 0 {
+			size += len(separator)
+		}
+		page = append(page, item)
+		size += len(item)
+	}
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// Extracts the optional trailing page number from the arguments of a
+// command. Pages are 1-based.
+func splitPageArg(args string) (string, int) {
+	args = strings.TrimSpace(args)
+	i := strings.LastIndex(args, " ")
+	page, err := strconv.Atoi(args[i+1:])
+	if err != nil || page <= 0 {
+		return args, 1
+	}
+	return strings.TrimSpace(args[:i+1]), page
+}
+
+func sendPage(env CommandEnvironment, items []string, header string, page int, nextPage string) {
+	// Reserve some space for the author mention and the page footer
+	limit := MessageLimitOfEnvironment(env) - len(env.AtAuthor()) - len(nextPage) - 32
+	pages := paginateItems(items, header, ", ", limit)
+	if len(pages) == 0 {
+		env.Reply(header + "nothing found")
+		return
+	}
+	if page > len(pages) {
+		env.Reply(fmt.Sprintf("There are only %d pages", len(pages)))
+		return
+	}
+	message := header + strings.Join(pages[page-1], ", ")
+	if page < len(pages) {
+		message += fmt.Sprintf(" (page %d/%d, next: %s %d)", page, len(pages), nextPage, page+1)
+	}
+	env.Reply(message)
+}
+
+func matchesSearch(search string, name string, description string) bool {
+	search = strings.ToLower(search)
+	return strings.Contains(strings.ToLower(name), search) || strings.Contains(strings.ToLower(description), search)
+}
+
+func EvalHelpCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	name := strings.TrimSpace(command.Args)
+	if page, err := strconv.Atoi(name); len(name) == 0 || err == nil {
+		if len(name) == 0 {
+			page = 1
+		}
+		names := []string{}
+		for _, builtin := range BuiltinCommands {
+			names = append(names, builtin.Name)
+		}
+		header := fmt.Sprintf("Use %shelp <command> to learn more. Builtins: ", command.Prefix)
+		sendPage(env, names, header, page, command.Prefix+"help")
+		return nil
+	}
+
+	if builtin, ok := FindBuiltinCommand(name); ok {
+		usage := command.Prefix + builtin.Name
+		if len(builtin.Usage) > 0 {
+			usage += " " + builtin.Usage
+		}
+		description := builtin.Description
+		if restrictions := builtin.Restrictions(); len(restrictions) > 0 {
+			description += " (" + restrictions + ")"
+		}
+		env.Reply(fmt.Sprintf("%s — %s", usage, description))
+		return nil
+	}
+
+	if db == nil {
+		env.Reply(fmt.Sprintf("command `%s` does not exist", name))
+		return nil
+	}
+
+	var description string
+	err := db.QueryRow("SELECT coalesce(description, '') FROM Commands WHERE name = $1", name).Scan(&description)
+	if err == sql.ErrNoRows {
+		env.Reply(fmt.Sprintf("command `%s` does not exist", name))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not query description of command %s: %w", name, err)
+	}
+	if len(description) == 0 {
+		description = "custom command without description"
+	}
+	env.Reply(fmt.Sprintf("%s%s — %s", command.Prefix, name, description))
+	return nil
+}
+
+func EvalCommandsCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	search, page := splitPageArg(command.Args)
+
+	names := []string{}
+	for _, builtin := range BuiltinCommands {
+		if matchesSearch(search, builtin.Name, builtin.Description) {
+			names = append(names, builtin.Name)
+		}
+	}
+
+	if db != nil {
+		customs, err := internal.QueryAllCustomCommands(db)
+		if err != nil {
+			return fmt.Errorf("could not query custom commands: %w", err)
+		}
+		for _, custom := range customs {
+			if matchesSearch(search, custom.Name, custom.Description) {
+				names = append(names, custom.Name)
+			}
+		}
+	}
+
+	nextPage := command.Prefix + "commands"
+	if len(search) > 0 {
+		nextPage += " " + search
+	}
+	sendPage(env, names, "Commands: ", page, nextPage)
+	return nil
+}
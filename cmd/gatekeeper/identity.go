@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IdentitiesReloadInterval = 1 * time.Minute
+	LinkCodeLifetime = 10 * time.Minute
+	LinkCodeLength = 8
+	LinkCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+var Identities = IdentityLinks{}
+
+// Live copy of the Identity_Links table
+type IdentityLinks struct {
+	mutex sync.RWMutex
+	// Key is the UniversalPlatformAgnosticUserID() of a linked user
+	canonical map[string]string
+	// Key is the canonical id. Includes the canonical id itself.
+	groups map[string][]string
+}
+
+func (identities *IdentityLinks) update(links []internal.IdentityLink) {
+	canonical := map[string]string{}
+	groups := map[string][]string{}
+	for _, link := range links {
+		canonical[link.UserId] = link.CanonicalId
+		if _, ok := groups[link.CanonicalId]; !ok {
+			groups[link.CanonicalId] = []string{link.CanonicalId}
+		}
+		groups[link.CanonicalId] = append(groups[link.CanonicalId], link.UserId)
+	}
+
+	identities.mutex.Lock()
+	defer identities.mutex.Unlock()
+	identities.canonical = canonical
+	identities.groups = groups
+}
+
+func (identities *IdentityLinks) Reload(db *sql.DB) error {
+	links, err := internal.QueryIdentityLinks(db)
+	if err != nil {
+		return err
+	}
+	identities.update(links)
+	return nil
+}
+
+func (identities *IdentityLinks) Canonical(userId string) string {
+	identities.mutex.RLock()
+	defer identities.mutex.RUnlock()
+	if canonicalId, ok := identities.canonical[userId]; ok {
+		return canonicalId
+	}
+	return userId
+}
+
+// All the identities linked to the user including the user themselves
+func (identities *IdentityLinks) Group(userId string) []string {
+	canonicalId := identities.Canonical(userId)
+	identities.mutex.RLock()
+	defer identities.mutex.RUnlock()
+	if group, ok := identities.groups[canonicalId]; ok {
+		return group
+	}
+	return []string{userId}
+}
+
+// Platform-specific id of the identity of the user on the platform
+func (identities *IdentityLinks) OnPlatform(userId string, platform string) (string, bool) {
+	for _, id := range identities.Group(userId) {
+		if strings.HasPrefix(id, platform+"#") {
+			return strings.TrimPrefix(id, platform+"#"), true
+		}
+	}
+	return "", false
+}
+
+func PollIdentities(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	err := Identities.Reload(db)
+	if err != nil {
+		log.Println("Error loading identity links:", err)
+	}
+	go func() {
+		for {
+			time.Sleep(IdentitiesReloadInterval)
+			err := Identities.Reload(db)
+			if err != nil {
+				log.Println("Error reloading identity links:", err)
+			}
+		}
+	}()
+}
+
+// The id all the state of the author (ed, reminders, stats, etc) should
+// be attached to. The same for all the linked identities.
+func CanonicalUserID(env CommandEnvironment) string {
+	return Identities.Canonical(env.UniversalPlatformAgnosticUserID())
+}
+
+// Some authors can't be told apart from each other, like the IRC users
+// that are not logged in to the services. Nothing can be attached to them.
+func replyUnidentifiedAuthor(env CommandEnvironment) {
+	env.Reply("Could not identify you on this platform. On IRC you have to be logged in to the services.")
+}
+
+// Discord user id of the author if they are on Discord or linked their
+// Discord account
+func DiscordUserIdOfAuthor(env CommandEnvironment) (string, bool) {
+	if discordEnv := env.AsDiscord(); discordEnv != nil && discordEnv.m.Author != nil {
+		return discordEnv.m.Author.ID, true
+	}
+	return Identities.OnPlatform(env.UniversalPlatformAgnosticUserID(), "discord")
+}
+
+func generateLinkCode() (string, error) {
+	code := []byte{}
+	for i := 0; i < LinkCodeLength; i += 1 {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(LinkCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, LinkCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+func EvalLinkCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	userId := env.UniversalPlatformAgnosticUserID()
+	if len(userId) == 0 {
+		replyUnidentifiedAuthor(env)
+		return nil
+	}
+	code := strings.ToUpper(strings.TrimSpace(command.Args))
+
+	if len(code) == 0 {
+		// The code proves the ownership of the identity it was issued
+		// to, so it must never be posted into a public chat
+		discordEnv := env.AsDiscord()
+		if discordEnv == nil {
+			env.Reply("Run this command on Discord first. It will send you a code to confirm here.")
+			return nil
+		}
+
+		code, err := generateLinkCode()
+		if err != nil {
+			return fmt.Errorf("could not generate link code: %w", err)
+		}
+		err = internal.CreateLinkCode(db, userId, code, time.Now().Add(LinkCodeLifetime))
+		if err != nil {
+			return fmt.Errorf("could not save link code of %s: %w", userId, err)
+		}
+
+		err = discordEnv.SendDirectMessage(fmt.Sprintf("Your link code is %s. Confirm it with `link %s` on the other platform within %s. Never share it with anybody.", code, code, DurationToString(time.Now(), time.Now().Add(LinkCodeLifetime))))
+		if err != nil {
+			log.Printf("Could not send link code to %s: %s\n", userId, err)
+			env.Reply("Could not send you a direct message. Please allow direct messages from the server members and try again.")
+			return nil
+		}
+		env.Reply("Check your direct messages")
+		return nil
+	}
+
+	ownerId, ok, err := internal.RedeemLinkCode(db, code)
+	if err != nil {
+		return fmt.Errorf("could not redeem link code: %w", err)
+	}
+	if !ok {
+		env.Reply("The code does not exist or expired")
+		return nil
+	}
+	if strings.SplitN(ownerId, "#", 2)[0] == env.Platform() {
+		env.Reply("The code must be confirmed on a different platform")
+		return nil
+	}
+
+	canonicalId := Identities.Canonical(ownerId)
+	if canonicalId == Identities.Canonical(userId) {
+		env.Reply("Your accounts are already linked")
+		return nil
+	}
+
+	err = internal.LinkIdentity(db, Identities.Canonical(userId), canonicalId)
+	if err != nil {
+		return fmt.Errorf("could not link %s to %s: %w", userId, canonicalId, err)
+	}
+	err = Identities.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload identity links: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Linked your account to %s", ownerId))
+	return nil
+}
+
+func EvalUnlinkCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	userId := env.UniversalPlatformAgnosticUserID()
+	if len(userId) == 0 {
+		replyUnidentifiedAuthor(env)
+		return nil
+	}
+	if len(Identities.Group(userId)) <= 1 {
+		env.Reply("Your account is not linked to anything")
+		return nil
+	}
+
+	err := internal.UnlinkIdentity(db, userId)
+	if err != nil {
+		return fmt.Errorf("could not unlink %s: %w", userId, err)
+	}
+	err = Identities.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload identity links: %w", err)
+	}
+
+	env.Reply("Your account is unlinked")
+	return nil
+}
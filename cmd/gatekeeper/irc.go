@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+	"sort"
 	"strings"
 	"io"
 	"fmt"
 	"regexp"
+	"unicode/utf8"
 )
 
 type IrcCmdName string
@@ -15,17 +24,83 @@ const (
 	IrcCmdPrivmsg			= "PRIVMSG"
 	IrcCmdPing				= "PING"
 	IrcCmdPong				= "PONG"
+	IrcCmdCap				= "CAP"
+	IrcCmdNotice			= "NOTICE"
+	IrcCmdReconnect			= "RECONNECT"
+	IrcCmdUserstate			= "USERSTATE"
+	IrcCmdUsernotice		= "USERNOTICE"
+	IrcCmdUser				= "USER"
+	IrcCmdAuthenticate		= "AUTHENTICATE"
+	IrcCmdError				= "ERROR"
 	IrcCmd001				= "001"
+	// ERR_NICKNAMEINUSE
+	IrcCmd433				= "433"
+	// RPL_LOGGEDIN
+	IrcCmd900				= "900"
+	// RPL_SASLSUCCESS
+	IrcCmd903				= "903"
+	// ERR_SASLFAIL
+	IrcCmd904				= "904"
+	// ERR_SASLTOOLONG
+	IrcCmd905				= "905"
 )
 
 type IrcMsg struct {
+	// IRCv3 message tags https://ircv3.net/specs/extensions/message-tags
+	Tags map[string]string
 	Prefix string
 	Name IrcCmdName
 	Args []string
 }
 
-// TODO: IrcMsg serialization should probably check for max IRC message length
-func (msg *IrcMsg) String() (result string, ok bool) {
+// https://ircv3.net/specs/extensions/message-tags#size-limit
+const (
+	// Including the leading @ and the trailing space
+	IrcMaxTagsLength = 8191
+	// Everything after the tags including the CR LF. From RFC 1459.
+	IrcMaxMessageLength = 512
+	// Twitch does not respect IrcMaxMessageLength in the messages it
+	// sends (500 characters of chat message may take up to 2000
+	// bytes), so we are more lenient when reading.
+	IrcMaxReadLineLength = IrcMaxTagsLength + 4096
+)
+
+func (msg *IrcMsg) serializeTags() (result string, ok bool) {
+	if len(msg.Tags) == 0 {
+		ok = true
+		return
+	}
+
+	keys := []string{}
+	for key := range msg.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString("@")
+	for i, key := range keys {
+		value := EscapeTagValue(msg.Tags[key])
+		if !VerifyTagKey(key) || !VerifyTagValue(value) {
+			return
+		}
+		if i > 0 {
+			sb.WriteString(";")
+		}
+		sb.WriteString(key)
+		if len(value) > 0 {
+			sb.WriteString("=")
+			sb.WriteString(value)
+		}
+	}
+	sb.WriteString(" ")
+	result = sb.String()
+	ok = true
+	return
+}
+
+// Everything except the tags
+func (msg *IrcMsg) serializeMessage() (result string, ok bool) {
 	var sb strings.Builder
 
 	if len(msg.Prefix) > 0 {
@@ -63,6 +138,49 @@ func (msg *IrcMsg) String() (result string, ok bool) {
 	return
 }
 
+// Fails if the message does not fit into IrcMaxTagsLength and
+// IrcMaxMessageLength. See Truncated().
+func (msg *IrcMsg) String() (result string, ok bool) {
+	tags, ok := msg.serializeTags()
+	if !ok || len(tags) > IrcMaxTagsLength {
+		return "", false
+	}
+	message, ok := msg.serializeMessage()
+	if !ok || len(message) + len("\r\n") > IrcMaxMessageLength {
+		return "", false
+	}
+	return tags + message, true
+}
+
+// Cuts the last argument so the message fits into IrcMaxMessageLength.
+// The cut never happens in the middle of a UTF-8 character. Returns the
+// message as is if it already fits or can't be fixed by cutting the last
+// argument.
+func (msg IrcMsg) Truncated() IrcMsg {
+	n := len(msg.Args)
+	if n == 0 {
+		return msg
+	}
+	message, ok := msg.serializeMessage()
+	if !ok {
+		return msg
+	}
+	excess := len(message) + len("\r\n") - IrcMaxMessageLength
+	if excess <= 0 {
+		return msg
+	}
+	trailing := msg.Args[n-1]
+	if excess > len(trailing) {
+		return msg
+	}
+	end := len(trailing) - excess
+	for end > 0 && !utf8.RuneStart(trailing[end]) {
+		end -= 1
+	}
+	msg.Args = append(append([]string{}, msg.Args[:n-1]...), trailing[:end])
+	return msg
+}
+
 func VerifyPrefix(prefix string) bool {
 	// I don't know the exact format of prefix (RFC 1459 redirects to
 	// RFC 952 which I'm too lazy to read), but here I simply assume
@@ -73,6 +191,83 @@ func VerifyPrefix(prefix string) bool {
 	return !strings.ContainsAny(prefix, "\x00 \r\n")
 }
 
+// <key> ::= [ <client_prefix> ] [ <vendor> '/' ] <key_name>
+var TagKeyRegexp = regexp.MustCompile(`^\+?([a-zA-Z0-9.\-]+/)?[a-zA-Z0-9\-]+$`)
+
+func VerifyTagKey(key string) bool {
+	return TagKeyRegexp.MatchString(key)
+}
+
+// Verifies the escaped value. NUL is the only character that can't be
+// escaped, so EscapeTagValue(value) fails only on it.
+func VerifyTagValue(value string) bool {
+	return !strings.ContainsAny(value, "; \x00\r\n")
+}
+
+// https://ircv3.net/specs/extensions/message-tags#escaping-values
+var tagValueEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+func EscapeTagValue(value string) string {
+	return tagValueEscaper.Replace(value)
+}
+
+func UnescapeTagValue(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			sb.WriteByte(value[i])
+			continue
+		}
+		i += 1
+		if i >= len(value) {
+			// A trailing backslash is dropped
+			break
+		}
+		switch value[i] {
+		case ':':  sb.WriteByte(';')
+		case 's':  sb.WriteByte(' ')
+		case 'r':  sb.WriteByte('\r')
+		case 'n':  sb.WriteByte('\n')
+		// Including \\. Unknown escapes are the character itself.
+		default:   sb.WriteByte(value[i])
+		}
+	}
+	return sb.String()
+}
+
+// <tags> ::= <tag> [';' <tag>]*
+// <tag>  ::= <key> ['=' <escaped_value>]
+func ParseIrcTags(source string) (tags map[string]string, ok bool) {
+	tags = map[string]string{}
+	for _, tag := range strings.Split(source, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+		split := strings.SplitN(tag, "=", 2)
+		key := split[0]
+		if !VerifyTagKey(key) {
+			return
+		}
+		value := ""
+		if len(split) == 2 {
+			if !VerifyTagValue(split[1]) {
+				return
+			}
+			value = UnescapeTagValue(split[1])
+		}
+		// If the key is duplicated the last one wins
+		tags[key] = value
+	}
+	ok = true
+	return
+}
+
 var CmdNameRegexp = regexp.MustCompile("^([0-9]{3}|[a-zA-Z]+)$")
 
 func VerifyCmdName(name string) bool {
@@ -115,6 +310,19 @@ func VerifyTrailing(trailing string) bool {
 }
 
 func ParseIrcMsg(source string) (msg IrcMsg, ok bool) {
+	if strings.HasPrefix(source, "@") {
+		split := strings.SplitN(source, " ", 2)
+		if len(split) < 2 {
+			return
+		}
+		tags, tagsOk := ParseIrcTags(strings.TrimPrefix(split[0], "@"))
+		if !tagsOk {
+			return
+		}
+		msg.Tags = tags
+		source = strings.TrimLeft(split[1], " ")
+	}
+
 	if strings.HasPrefix(source, ":") {
 		split := strings.SplitN(source, " ", 2)
 		if len(split) < 2 {
@@ -124,18 +332,19 @@ func ParseIrcMsg(source string) (msg IrcMsg, ok bool) {
 		if !VerifyPrefix(msg.Prefix) {
 			return
 		}
-		source = split[1]
+		source = strings.TrimLeft(split[1], " ")
 	}
 
+	// The commands may have no params at all. For instance, RECONNECT
 	split := strings.SplitN(source, " ", 2)
-	if len(split) < 2 {
-		return
-	}
 	if !VerifyCmdName(split[0]) {
 		return
 	}
 	msg.Name = IrcCmdName(split[0])
-	source = split[1]
+	source = ""
+	if len(split) == 2 {
+		source = split[1]
+	}
 
 Loop:
 	for len(source) > 0 {
@@ -174,6 +383,7 @@ Loop:
 }
 
 func (msg IrcMsg) Send(writer io.Writer) error {
+	msg = msg.Truncated()
 	msgString, ok := msg.String()
 	if !ok {
 		return fmt.Errorf("Could not serialize IRC message %#v", msg)
@@ -196,3 +406,99 @@ func (msg IrcMsg) Nick() string {
 	nick = strings.SplitN(nick, "@", 2)[0]
 	return nick
 }
+
+var IrcLineTooLong = errors.New("IrcLineTooLong")
+
+// Reads CR LF (or just LF) terminated lines regardless of how they are
+// split between the reads of the underlying reader
+type IrcLineReader struct {
+	reader *bufio.Reader
+}
+
+func NewIrcLineReader(reader io.Reader) *IrcLineReader {
+	return &IrcLineReader{reader: bufio.NewReaderSize(reader, IrcMaxReadLineLength)}
+}
+
+// Returns IrcLineTooLong if the line exceeded IrcMaxReadLineLength. The
+// line is skipped entirely in that case and the reader can keep going.
+func (lineReader *IrcLineReader) ReadLine() (string, error) {
+	line, err := lineReader.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = lineReader.reader.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", IrcLineTooLong
+	}
+	if err != nil {
+		// The incomplete line at the end of the stream is discarded
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// Shared by all the IRC connections (Twitch and the regular networks)
+const (
+	// Time the server has to welcome the bot after it logged in
+	IrcLoginTimeout = 30 * time.Second
+	IrcMinBackoff = 1 * time.Second
+	IrcMaxBackoff = 2 * time.Minute
+)
+
+// Exponential backoff capped at IrcMaxBackoff. The actual delay is
+// randomly picked between half of it and all of it, so a bunch of bots
+// kicked out at the same time don't come back at the same time.
+func IrcBackoff(attempt int) time.Duration {
+	delay := IrcMaxBackoff
+	if attempt <= 0 {
+		return 0
+	}
+	// Checking the attempt first so the shift can't overflow
+	if attempt < 16 && IrcMinBackoff<<(attempt-1) < IrcMaxBackoff {
+		delay = IrcMinBackoff<<(attempt-1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Reads the messages from the connection into incoming until the
+// connection breaks, then reports it to incomingQuit. The label is the
+// name of the connection in the logs, for example "Twitch" or "IRC libera".
+func ircIncomingLoop(ctx context.Context, label string, conn net.Conn, readTimeout time.Duration, incoming chan IrcMsg, incomingQuit chan int) {
+	lineReader := NewIrcLineReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		line, err := lineReader.ReadLine()
+		if err == IrcLineTooLong {
+			log.Printf("%s: skipping line longer than %d bytes\n", label, IrcMaxReadLineLength)
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("%s: could not read the reply: %s\n", label, err)
+			}
+			break
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		msg, ok := ParseIrcMsg(line)
+		if !ok {
+			// TODO: we should probably restart the connection if parsing commands failed too many times
+			log.Printf("%s: failed to parse command: |%s| %d\n", label, line, len(line))
+			continue
+		}
+		select {
+		case incoming <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	select {
+	case incomingQuit <- 69:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+func TestIrcMsgStringWithTags(t *testing.T) {
+	msg := IrcMsg{
+		Tags: map[string]string{"reply-parent-msg-id": "b34ccfc7-4977-403a-8a94-33c6bac34fb8", "+example.com/flag": ""},
+		Name: IrcCmdPrivmsg,
+		Args: []string{"#tsoding", "hello world"},
+	}
+	result, ok := msg.String()
+	expected := "@+example.com/flag;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8 PRIVMSG #tsoding :hello world"
+	if !ok || result != expected {
+		t.Fatalf("expected %q, but got %q %v", expected, result, ok)
+	}
+
+	msg.Tags = map[string]string{"key": "semi;colon space\\back\r\n"}
+	result, ok = msg.String()
+	expected = `@key=semi\:colon\sspace\\back\r\n PRIVMSG #tsoding :hello world`
+	if !ok || result != expected {
+		t.Fatalf("expected %q, but got %q %v", expected, result, ok)
+	}
+
+	for _, tags := range []map[string]string{
+		{"bad key": "x"},
+		{"key": "nul\x00"},
+	} {
+		msg.Tags = tags
+		if result, ok := msg.String(); ok {
+			t.Errorf("%q: expected to be rejected, but got %q", tags, result)
+		}
+	}
+}
+
+func TestParseIrcMsgWithTags(t *testing.T) {
+	source := `@badge-info=;badges=broadcaster/1;display-name=Tsoding;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;user-id=110240192;msg=hello\sworld\:\\o/;+example.com/flag :tsoding!tsoding@tsoding.tmi.twitch.tv PRIVMSG #tsoding :!ping`
+	msg, ok := ParseIrcMsg(source)
+	if !ok {
+		t.Fatalf("could not parse %q", source)
+	}
+	expectedTags := map[string]string{
+		"badge-info": "",
+		"badges": "broadcaster/1",
+		"display-name": "Tsoding",
+		"id": "b34ccfc7-4977-403a-8a94-33c6bac34fb8",
+		"user-id": "110240192",
+		"msg": `hello world;\o/`,
+		"+example.com/flag": "",
+	}
+	if len(msg.Tags) != len(expectedTags) {
+		t.Fatalf("expected tags %q, but got %q", expectedTags, msg.Tags)
+	}
+	for key, value := range expectedTags {
+		if actual, ok := msg.Tags[key]; !ok || actual != value {
+			t.Errorf("%s: expected %q, but got %q", key, value, actual)
+		}
+	}
+	if msg.Prefix != "tsoding!tsoding@tsoding.tmi.twitch.tv" || msg.Nick() != "tsoding" {
+		t.Errorf("unexpected prefix %q", msg.Prefix)
+	}
+	if msg.Name != IrcCmdPrivmsg || len(msg.Args) != 2 || msg.Args[0] != "#tsoding" || msg.Args[1] != "!ping" {
+		t.Errorf("unexpected command %s %q", msg.Name, msg.Args)
+	}
+
+	for _, bad := range []string{
+		"@bad^key=x PRIVMSG #tsoding :hello",
+		"@key=x",
+	} {
+		if msg, ok := ParseIrcMsg(bad); ok {
+			t.Errorf("%q: expected to be rejected, but got %#v", bad, msg)
+		}
+	}
+}
+
+func TestIrcTagsRoundTrip(t *testing.T) {
+	for _, value := range []string{"", "plain", "a;b c\\d\r\ne", `\:\s`, "ends with \\"} {
+		msg := IrcMsg{Tags: map[string]string{"key": value}, Name: IrcCmdPing}
+		source, ok := msg.String()
+		if !ok {
+			t.Fatalf("%q: could not serialize", value)
+		}
+		parsed, ok := ParseIrcMsg(source)
+		if !ok || parsed.Tags["key"] != value {
+			t.Errorf("%q: round trip through %q gave %q", value, source, parsed.Tags["key"])
+		}
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	cases := map[string]string{
+		`trailing\`: "trailing",
+		`unknown\x`: "unknownx",
+		`\\s`:      `\s`,
+	}
+	for escaped, expected := range cases {
+		if actual := UnescapeTagValue(escaped); actual != expected {
+			t.Errorf("%q: expected %q, but got %q", escaped, expected, actual)
+		}
+	}
+}
+
+func TestParseIrcMsgWithoutParams(t *testing.T) {
+	msg, ok := ParseIrcMsg(":tmi.twitch.tv RECONNECT")
+	if !ok || msg.Name != "RECONNECT" || len(msg.Args) != 0 {
+		t.Fatalf("unexpected result %#v %v", msg, ok)
+	}
+	msg, ok = ParseIrcMsg(":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands")
+	if !ok || msg.Name != IrcCmdCap || len(msg.Args) != 3 || msg.Args[2] != "twitch.tv/tags twitch.tv/commands" {
+		t.Fatalf("unexpected result %#v %v", msg, ok)
+	}
+}
+
+func TestTwitchCapReq(t *testing.T) {
+	msg := IrcMsg{Name: IrcCmdCap, Args: []string{"REQ", strings.Join(TwitchCapabilities, " ")}}
+	result, ok := msg.String()
+	expected := "CAP REQ :twitch.tv/tags twitch.tv/commands twitch.tv/membership"
+	if !ok || result != expected {
+		t.Fatalf("expected %q, but got %q %v", expected, result, ok)
+	}
+}
+
+// Returns the data in the chunks of the given sizes, like the network
+// would
+type ChunkedReader struct {
+	data   string
+	chunks []int
+}
+
+func (reader *ChunkedReader) Read(p []byte) (int, error) {
+	if len(reader.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(reader.data)
+	if len(reader.chunks) > 0 {
+		n = reader.chunks[0]
+		reader.chunks = reader.chunks[1:]
+	}
+	if n > len(reader.data) {
+		n = len(reader.data)
+	}
+	n = copy(p, reader.data[:n])
+	reader.data = reader.data[n:]
+	return n, nil
+}
+
+func readAllIrcLines(t *testing.T, reader io.Reader) []string {
+	t.Helper()
+	lineReader := NewIrcLineReader(reader)
+	lines := []string{}
+	for {
+		line, err := lineReader.ReadLine()
+		if err == io.EOF {
+			return lines
+		}
+		if err == IrcLineTooLong {
+			lines = append(lines, "<too long>")
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestIrcLineReaderSplitReads(t *testing.T) {
+	data := "PING :tmi.twitch.tv\r\n@id=42 :abc!abc@abc.tmi.twitch.tv PRIVMSG #tsoding :hello world\r\nPING :x\n"
+	expected := []string{"PING :tmi.twitch.tv", "@id=42 :abc!abc@abc.tmi.twitch.tv PRIVMSG #tsoding :hello world", "PING :x"}
+
+	// The line straddling the reads, CR and LF in different reads, etc
+	for _, chunks := range [][]int{nil, {10, 15, 40}, {20}, {19, 1, 1}, {21, 5}} {
+		reader := &ChunkedReader{data: data, chunks: chunks}
+		expectMessages(t, readAllIrcLines(t, reader), expected...)
+	}
+	expectMessages(t, readAllIrcLines(t, iotest.OneByteReader(strings.NewReader(data))), expected...)
+	expectMessages(t, readAllIrcLines(t, iotest.HalfReader(strings.NewReader(data))), expected...)
+}
+
+func TestIrcLineReaderTooLongLine(t *testing.T) {
+	data := "PING :a\r\n" + "PRIVMSG #tsoding :" + strings.Repeat("x", IrcMaxReadLineLength*2) + "\r\nPING :b\r\nPING :incomplete"
+	expectMessages(t, readAllIrcLines(t, iotest.HalfReader(strings.NewReader(data))), "PING :a", "<too long>", "PING :b")
+}
+
+func TestIrcMsgStringLength(t *testing.T) {
+	// "PRIVMSG #tsoding :" + trailing + CR LF
+	maxTrailing := IrcMaxMessageLength - len("PRIVMSG #tsoding :\r\n")
+	msg := IrcMsg{Name: IrcCmdPrivmsg, Args: []string{"#tsoding", strings.Repeat("x", maxTrailing)}}
+	if _, ok := msg.String(); !ok {
+		t.Fatalf("expected the message of max length to be serialized")
+	}
+	msg.Args[1] += "x"
+	if _, ok := msg.String(); ok {
+		t.Fatalf("expected too long message to be rejected")
+	}
+
+	msg.Args[1] = "hello"
+	msg.Tags = map[string]string{"key": strings.Repeat("v", IrcMaxTagsLength)}
+	if _, ok := msg.String(); ok {
+		t.Fatalf("expected too long tags to be rejected")
+	}
+}
+
+func TestIrcMsgTruncated(t *testing.T) {
+	maxTrailing := IrcMaxMessageLength - len("PRIVMSG #tsoding :\r\n")
+
+	short := IrcMsg{Name: IrcCmdPrivmsg, Args: []string{"#tsoding", "hello"}}
+	if truncated := short.Truncated(); truncated.Args[1] != "hello" {
+		t.Errorf("expected the short message to stay as is, but got %q", truncated.Args[1])
+	}
+
+	long := IrcMsg{Name: IrcCmdPrivmsg, Args: []string{"#tsoding", strings.Repeat("x", maxTrailing+100)}}
+	truncated := long.Truncated()
+	if _, ok := truncated.String(); !ok || truncated.Args[1] != strings.Repeat("x", maxTrailing) {
+		t.Errorf("unexpected truncation %q", truncated.Args[1])
+	}
+	if len(long.Args[1]) != maxTrailing+100 {
+		t.Errorf("the original message was modified")
+	}
+
+	// Never cuts a character in half. After the "x" there is an odd
+	// amount of bytes left, so the last "я" does not fit.
+	cyrillic := IrcMsg{Name: IrcCmdPrivmsg, Args: []string{"#tsoding", "x" + strings.Repeat("я", maxTrailing)}}
+	truncated = cyrillic.Truncated()
+	if _, ok := truncated.String(); !ok || !utf8.ValidString(truncated.Args[1]) || len(truncated.Args[1]) != maxTrailing-1 {
+		t.Errorf("unexpected truncation %q", truncated.Args[1])
+	}
+}
+
+func TestIrcBackoff(t *testing.T) {
+	if delay := IrcBackoff(0); delay != 0 {
+		t.Errorf("expected no delay for the first attempt, but got %s", delay)
+	}
+	for attempt := 1; attempt < 100; attempt += 1 {
+		max := IrcMaxBackoff
+		if attempt < 16 && IrcMinBackoff<<(attempt-1) < max {
+			max = IrcMinBackoff<<(attempt-1)
+		}
+		delay := IrcBackoff(attempt)
+		if delay < max/2 || delay > max {
+			t.Errorf("attempt %d: expected delay between %s and %s, but got %s", attempt, max/2, max, delay)
+		}
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Adapter for the regular IRC networks like Libera. The IRC protocol is
+// in irc.go, Twitch has its own adapter in twitch.go.
+
+const (
+	// Time between the messages so the network does not kick the bot for flooding
+	IrcSendInterval = 500 * time.Millisecond
+	IrcOutgoingLimit = 100
+	// Multi-line messages are sent line by line, but not more than that
+	IrcMaxLinesPerMessage = 5
+	// The servers prepend ":nick!user@host " to the messages they
+	// relay. Those are not the bytes we can use.
+	IrcRelayPrefixReserve = 100
+	// How long to wait for NickServ to confirm the identification
+	// before joining the channels anyway
+	IrcIdentifyTimeout = 10 * time.Second
+	// https://ircv3.net/specs/extensions/sasl-3.1#the-authenticate-command
+	IrcSaslChunkSize = 400
+	// Attempts to register with the alternative nicks on 433
+	IrcMaxNickAttempts = 5
+	// The servers PING the idle clients every few minutes. Not hearing
+	// anything for longer than that means the connection is dead.
+	IrcReadTimeout = 10 * time.Minute
+)
+
+type IrcNetworkState int
+const (
+	IrcConnect IrcNetworkState = iota
+	IrcRegister
+	// Waiting for NickServ to confirm the identification
+	IrcIdentify
+	IrcChat
+)
+
+type IrcNetworkConfig struct {
+	// Name of the network in the UniversalPlatformAgnosticUserID(), for example "libera"
+	Network string
+	Address string
+	Nick string
+	// The channels to join
+	Channels []string
+	// SASL PLAIN credentials. Empty password disables SASL.
+	SaslUser string
+	SaslPass string
+	// Empty password disables the NickServ identification
+	NickServPass string
+}
+
+type IrcNetworkConn struct {
+	Config IrcNetworkConfig
+	State IrcNetworkState
+	Reconnected int
+	// The nick we actually got. Differs from Config.Nick if it was taken.
+	Nick string
+	nickAttempts int
+	// Capability requests the server didn't answer yet. The
+	// registration is finished with CAP END when it's 0.
+	pendingCaps int
+	saslInProgress bool
+	// The server attaches the account the user is logged in with
+	// https://ircv3.net/specs/extensions/account-tag
+	accountTag bool
+	// Connects to Config.Address. Can be replaced with a fake server in
+	// the tests.
+	Dial func(ctx context.Context) (net.Conn, error)
+	Conn net.Conn
+	Incoming chan IrcMsg
+	IncomingQuit chan int
+	// All the outgoing messages of the IrcEnvironments go through it,
+	// so they survive reconnects and are sent with IrcSendInterval
+	Outgoing chan IrcMsg
+	Timers chan internal.Timer
+
+	ctx context.Context
+	cancel context.CancelFunc
+	connCancel context.CancelFunc
+	done chan struct{}
+}
+
+func ircNetworkConfigFromEnv() (IrcNetworkConfig, bool) {
+	config := IrcNetworkConfig{
+		Address: os.Getenv("GATEKEEPER_IRC_ADDRESS"),
+		Network: os.Getenv("GATEKEEPER_IRC_NETWORK"),
+		Nick: os.Getenv("GATEKEEPER_IRC_NICK"),
+		SaslUser: os.Getenv("GATEKEEPER_IRC_SASL_USER"),
+		SaslPass: os.Getenv("GATEKEEPER_IRC_SASL_PASS"),
+		NickServPass: os.Getenv("GATEKEEPER_IRC_NICKSERV_PASS"),
+	}
+	if config.Address == "" {
+		log.Println("No GATEKEEPER_IRC_ADDRESS envar is provided.")
+		return config, false
+	}
+	if config.Nick == "" {
+		log.Println("No GATEKEEPER_IRC_NICK envar is provided.")
+		return config, false
+	}
+	if config.Network == "" {
+		// irc.libera.chat:6697 -> libera
+		host, _, err := net.SplitHostPort(config.Address)
+		if err != nil {
+			host = config.Address
+		}
+		parts := strings.Split(strings.TrimPrefix(host, "irc."), ".")
+		config.Network = strings.ToLower(parts[0])
+	}
+	if config.SaslUser == "" {
+		config.SaslUser = config.Nick
+	}
+	for _, channel := range strings.Split(os.Getenv("GATEKEEPER_IRC_CHANNELS"), ",") {
+		channel = strings.TrimSpace(channel)
+		if len(channel) == 0 {
+			continue
+		}
+		if !VerifyMiddle(channel) || strings.Contains(channel, ",") {
+			log.Printf("IRC: ignoring invalid channel %s in GATEKEEPER_IRC_CHANNELS\n", channel)
+			continue
+		}
+		config.Channels = appendUnique(config.Channels, channel)
+	}
+	return config, true
+}
+
+func newIrcNetworkConn(config IrcNetworkConfig) *IrcNetworkConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &IrcNetworkConn{
+		Config: config,
+		Nick: config.Nick,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			dialer := tls.Dialer{}
+			return dialer.DialContext(ctx, "tcp", config.Address)
+		},
+		Outgoing: make(chan IrcMsg, IrcOutgoingLimit),
+		Timers: make(chan internal.Timer),
+		ctx: ctx,
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
+}
+
+func startIrcNetwork(db *sql.DB) (*IrcNetworkConn, bool) {
+	config, ok := ircNetworkConfigFromEnv()
+	if !ok {
+		return nil, false
+	}
+	ircConn := newIrcNetworkConn(config)
+	go ircConn.run(db)
+	return ircConn, true
+}
+
+// Blocks until the connection is shut down
+func (ircConn *IrcNetworkConn) Close() {
+	ircConn.cancel()
+	<-ircConn.done
+}
+
+func (ircConn *IrcNetworkConn) disconnect() {
+	if ircConn.connCancel != nil {
+		ircConn.connCancel()
+		ircConn.connCancel = nil
+	}
+	if ircConn.Conn != nil {
+		ircConn.Conn.Close()
+		ircConn.Conn = nil
+	}
+}
+
+func (ircConn *IrcNetworkConn) send(msg IrcMsg) bool {
+	err := msg.Send(ircConn.Conn)
+	if err != nil {
+		log.Printf("IRC %s: %s\n", ircConn.Config.Network, err)
+		return false
+	}
+	return true
+}
+
+// Queues the message to the target (a channel or a nick). Every line of
+// the message becomes a separate PRIVMSG, split further if it's too long.
+func (ircConn *IrcNetworkConn) Push(target string, message string) {
+	byteLimit := IrcMaxMessageLength - IrcRelayPrefixReserve - len(IrcCmdPrivmsg + " " + target + " :\r\n")
+	lines := 0
+	for _, line := range strings.Split(message, "\n") {
+		line = FilterTrailingForbidden(line)
+		for _, part := range SplitChatMessage(line, byteLimit, byteLimit) {
+			if lines >= IrcMaxLinesPerMessage {
+				log.Printf("IRC %s: message for %s is too long, dropping the rest\n", ircConn.Config.Network, target)
+				return
+			}
+			lines += 1
+			ircConn.queue(IrcMsg{Name: IrcCmdPrivmsg, Args: []string{target, part}})
+		}
+	}
+}
+
+// Everything the users can trigger goes through the Outgoing queue so
+// it's throttled by IrcSendInterval
+func (ircConn *IrcNetworkConn) queue(msg IrcMsg) {
+	select {
+	case ircConn.Outgoing <- msg:
+	default:
+		log.Printf("IRC %s: outgoing queue is full, dropping %s %q\n", ircConn.Config.Network, msg.Name, msg.Args)
+	}
+}
+
+// SASL PLAIN credentials split into the AUTHENTICATE arguments
+// https://ircv3.net/specs/extensions/sasl-3.1#the-authenticate-command
+func ircSaslPlainChunks(user string, pass string) []string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(user + "\x00" + user + "\x00" + pass))
+	chunks := []string{}
+	for len(encoded) >= IrcSaslChunkSize {
+		chunks = append(chunks, encoded[:IrcSaslChunkSize])
+		encoded = encoded[IrcSaslChunkSize:]
+	}
+	if len(encoded) > 0 {
+		chunks = append(chunks, encoded)
+	} else {
+		// The last chunk of exactly IrcSaslChunkSize must be followed by an empty one
+		chunks = append(chunks, "+")
+	}
+	return chunks
+}
+
+// The alternative nick on 433: gatekeeper, gatekeeper_, gatekeeper__, ...
+func ircAlternativeNick(nick string, attempt int) string {
+	return nick + strings.Repeat("_", attempt)
+}
+
+// Splits the CTCP request out of the PRIVMSG text
+// https://modern.ircdocs.horse/ctcp.html
+func parseCtcp(text string) (command string, args string, ok bool) {
+	if !strings.HasPrefix(text, "\x01") {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "\x01"), "\x01")
+	split := strings.SplitN(text, " ", 2)
+	command = strings.ToUpper(split[0])
+	if len(split) == 2 {
+		args = split[1]
+	}
+	return command, args, true
+}
+
+func (ircConn *IrcNetworkConn) requestCap(capability string) {
+	if ircConn.send(IrcMsg{Name: IrcCmdCap, Args: []string{"REQ", capability}}) {
+		ircConn.pendingCaps += 1
+	}
+}
+
+// Finishes the capability negotiation when nothing is pending anymore
+func (ircConn *IrcNetworkConn) maybeEndCap() {
+	if ircConn.pendingCaps == 0 && !ircConn.saslInProgress {
+		ircConn.send(IrcMsg{Name: IrcCmdCap, Args: []string{"END"}})
+	}
+}
+
+// Returns false if the connection has to be abandoned
+func (ircConn *IrcNetworkConn) handleCap(msg IrcMsg) bool {
+	// :server CAP * ACK :sasl
+	if len(msg.Args) < 3 {
+		return true
+	}
+	capability := strings.TrimSpace(msg.Args[2])
+	switch msg.Args[1] {
+	case "ACK":
+		ircConn.pendingCaps -= 1
+		switch capability {
+		case "sasl":
+			ircConn.saslInProgress = true
+			ircConn.send(IrcMsg{Name: IrcCmdAuthenticate, Args: []string{"PLAIN"}})
+		case "account-tag":
+			ircConn.accountTag = true
+		}
+	case "NAK":
+		ircConn.pendingCaps -= 1
+		log.Printf("IRC %s: capability rejected: %s\n", ircConn.Config.Network, capability)
+		if capability == "sasl" {
+			log.Printf("IRC %s: the server does not support SASL. Abandoning IRC.\n", ircConn.Config.Network)
+			return false
+		}
+	default:
+		return true
+	}
+	ircConn.maybeEndCap()
+	return true
+}
+
+func (ircConn *IrcNetworkConn) joinChannels() {
+	if len(ircConn.Config.Channels) > 0 {
+		ircConn.send(IrcMsg{Name: IrcCmdJoin, Args: []string{strings.Join(ircConn.Config.Channels, ",")}})
+	}
+}
+
+func (ircConn *IrcNetworkConn) run(db *sql.DB) {
+	defer close(ircConn.done)
+	defer ircConn.disconnect()
+
+	var registerTimeout <-chan time.Time
+	var identifyTimeout <-chan time.Time
+	var lastSent time.Time
+
+	for {
+		switch ircConn.State {
+		case IrcConnect:
+			ircConn.disconnect()
+
+			if ircConn.Reconnected > 0 {
+				// The same backoff as Twitch
+				delay := IrcBackoff(ircConn.Reconnected)
+				log.Printf("Waiting %s before reconnecting IRC %s\n", delay.Round(time.Millisecond), ircConn.Config.Network)
+				select {
+				case <-ircConn.ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+			}
+			ircConn.Reconnected += 1
+
+			conn, err := ircConn.Dial(ircConn.ctx)
+			if err != nil {
+				if ircConn.ctx.Err() != nil {
+					return
+				}
+				log.Printf("Failed to connect to IRC %s: %s\n", ircConn.Config.Network, err)
+				continue
+			}
+			ircConn.Conn = conn
+			ircConn.Incoming = make(chan IrcMsg)
+			ircConn.IncomingQuit = make(chan int)
+			var connCtx context.Context
+			connCtx, ircConn.connCancel = context.WithCancel(ircConn.ctx)
+			go ircIncomingLoop(connCtx, "IRC "+ircConn.Config.Network, conn, IrcReadTimeout, ircConn.Incoming, ircConn.IncomingQuit)
+
+			ircConn.Nick = ircConn.Config.Nick
+			ircConn.nickAttempts = 0
+			ircConn.pendingCaps = 0
+			ircConn.saslInProgress = false
+			ircConn.accountTag = false
+
+			// The server holds the registration until CAP END
+			// https://ircv3.net/specs/extensions/capability-negotiation
+			ircConn.requestCap("account-tag")
+			if len(ircConn.Config.SaslPass) > 0 {
+				ircConn.requestCap("sasl")
+			}
+			ok := ircConn.send(IrcMsg{Name: IrcCmdNick, Args: []string{ircConn.Nick}}) &&
+				ircConn.send(IrcMsg{Name: IrcCmdUser, Args: []string{ircConn.Config.Nick, "0", "*", "Gatekeeper"}})
+			if !ok {
+				continue
+			}
+			registerTimeout = time.After(IrcLoginTimeout)
+			ircConn.State = IrcRegister
+		case IrcRegister:
+			select {
+			case <-ircConn.ctx.Done():
+				return
+			case <-ircConn.IncomingQuit:
+				ircConn.State = IrcConnect
+			case <-registerTimeout:
+				log.Printf("IRC %s: the server did not welcome us in %s\n", ircConn.Config.Network, IrcLoginTimeout)
+				ircConn.State = IrcConnect
+			case msg := <-ircConn.Incoming:
+				switch msg.Name {
+				case IrcCmdPing:
+					ircConn.send(IrcMsg{Name: IrcCmdPong, Args: msg.Args})
+				case IrcCmdCap:
+					if !ircConn.handleCap(msg) {
+						return
+					}
+				case IrcCmdAuthenticate:
+					if len(msg.Args) > 0 && msg.Args[0] == "+" {
+						for _, chunk := range ircSaslPlainChunks(ircConn.Config.SaslUser, ircConn.Config.SaslPass) {
+							ircConn.send(IrcMsg{Name: IrcCmdAuthenticate, Args: []string{chunk}})
+						}
+					}
+				case IrcCmd903:
+					log.Printf("IRC %s: SASL authentication succeeded\n", ircConn.Config.Network)
+					ircConn.saslInProgress = false
+					ircConn.maybeEndCap()
+				case IrcCmd904, IrcCmd905:
+					log.Printf("IRC %s: SASL authentication failed. Check GATEKEEPER_IRC_SASL_USER and GATEKEEPER_IRC_SASL_PASS. Abandoning IRC.\n", ircConn.Config.Network)
+					return
+				case IrcCmd433:
+					ircConn.nickAttempts += 1
+					if ircConn.nickAttempts > IrcMaxNickAttempts {
+						log.Printf("IRC %s: all the nicks are taken\n", ircConn.Config.Network)
+						ircConn.State = IrcConnect
+						continue
+					}
+					ircConn.Nick = ircAlternativeNick(ircConn.Config.Nick, ircConn.nickAttempts)
+					log.Printf("IRC %s: nick is taken, trying %s\n", ircConn.Config.Network, ircConn.Nick)
+					ircConn.send(IrcMsg{Name: IrcCmdNick, Args: []string{ircConn.Nick}})
+				case IrcCmdError:
+					ircConn.State = IrcConnect
+				case IrcCmd001:
+					if len(msg.Args) > 0 {
+						ircConn.Nick = msg.Args[0]
+					}
+					log.Printf("IRC %s: registered as %s\n", ircConn.Config.Network, ircConn.Nick)
+					// SASL already logged us in
+					if len(ircConn.Config.NickServPass) > 0 && len(ircConn.Config.SaslPass) == 0 {
+						ircConn.send(IrcMsg{Name: IrcCmdPrivmsg, Args: []string{"NickServ", "IDENTIFY " + ircConn.Config.Nick + " " + ircConn.Config.NickServPass}})
+						identifyTimeout = time.After(IrcIdentifyTimeout)
+						ircConn.State = IrcIdentify
+						continue
+					}
+					ircConn.joinChannels()
+					ircConn.State = IrcChat
+				}
+			}
+		case IrcIdentify:
+			select {
+			case <-ircConn.ctx.Done():
+				return
+			case <-ircConn.IncomingQuit:
+				ircConn.State = IrcConnect
+			case <-identifyTimeout:
+				log.Printf("IRC %s: NickServ did not confirm the identification. Joining anyway.\n", ircConn.Config.Network)
+				ircConn.joinChannels()
+				ircConn.State = IrcChat
+			case msg := <-ircConn.Incoming:
+				switch msg.Name {
+				case IrcCmdPing:
+					ircConn.send(IrcMsg{Name: IrcCmdPong, Args: msg.Args})
+				case IrcCmd900:
+					log.Printf("IRC %s: identified with NickServ\n", ircConn.Config.Network)
+					ircConn.joinChannels()
+					ircConn.State = IrcChat
+				case IrcCmdNotice:
+					if strings.EqualFold(msg.Nick(), "NickServ") && len(msg.Args) > 1 {
+						log.Printf("IRC %s: NickServ: %s\n", ircConn.Config.Network, msg.Args[1])
+					}
+				case IrcCmdError:
+					ircConn.State = IrcConnect
+				}
+			}
+		case IrcChat:
+			// Throttled by IrcSendInterval
+			var outgoing chan IrcMsg
+			var sendRetry <-chan time.Time
+			if wait := IrcSendInterval - time.Since(lastSent); wait > 0 {
+				sendRetry = time.After(wait)
+			} else {
+				outgoing = ircConn.Outgoing
+			}
+
+			select {
+			case <-ircConn.ctx.Done():
+				log.Printf("IRC %s: closing connection...\n", ircConn.Config.Network)
+				return
+			case <-ircConn.IncomingQuit:
+				ircConn.State = IrcConnect
+			case <-sendRetry:
+			case msg := <-outgoing:
+				ircConn.send(msg)
+				lastSent = time.Now()
+			case timer := <-ircConn.Timers:
+				env := &IrcEnvironment{
+					Conn: ircConn,
+					Channel: timer.Channel,
+				}
+				EvalCommand(db, timerCommand(timer), env)
+			case msg := <-ircConn.Incoming:
+				ircConn.handleChatMsg(db, msg)
+			}
+		default: panic("unreachable")
+		}
+	}
+}
+
+func (ircConn *IrcNetworkConn) handleChatMsg(db *sql.DB, msg IrcMsg) {
+	switch msg.Name {
+	case IrcCmdPing:
+		// The server is alive and so are we
+		ircConn.Reconnected = 0
+		ircConn.send(IrcMsg{Name: IrcCmdPong, Args: msg.Args})
+	case IrcCmdError:
+		log.Printf("IRC %s: %s\n", ircConn.Config.Network, strings.Join(msg.Args, " "))
+		ircConn.State = IrcConnect
+	case IrcCmdJoin:
+		if len(msg.Args) > 0 && msg.Nick() == ircConn.Nick {
+			log.Printf("IRC %s: joined %s\n", ircConn.Config.Network, msg.Args[0])
+		}
+	case IrcCmdNick:
+		// Somebody changed the nick, maybe us
+		if len(msg.Args) > 0 && msg.Nick() == ircConn.Nick {
+			ircConn.Nick = msg.Args[0]
+		}
+	case IrcCmdPrivmsg:
+		if len(msg.Args) != 2 {
+			log.Printf("IRC %s: unexpected amount of args of PRIVMSG. Expected 2, but got %d\n", ircConn.Config.Network, len(msg.Args))
+			return
+		}
+		target, text := msg.Args[0], msg.Args[1]
+
+		if command, _, ok := parseCtcp(text); ok {
+			if command == "VERSION" {
+				ircConn.queue(IrcMsg{Name: IrcCmdNotice, Args: []string{msg.Nick(), "\x01VERSION Gatekeeper " + Commit + "\x01"}})
+			}
+			// The rest of CTCP (including ACTION) are not commands
+			return
+		}
+
+		env := &IrcEnvironment{
+			Conn: ircConn,
+			AuthorNick: msg.Nick(),
+			Account: msg.Tags["account"],
+			Channel: target,
+		}
+		// The private messages are answered privately
+		if strings.EqualFold(target, ircConn.Nick) {
+			env.Channel = env.AuthorNick
+		}
+
+		Activity.Record(env.Platform(), env.ChannelID())
+
+		command, ok := parseCommandInEnvironment(env, text)
+		if !ok {
+			EvalTriggers(env, text)
+			return
+		}
+		EvalCommand(db, command, env)
+	}
+}
+
+type IrcEnvironment struct {
+	Conn *IrcNetworkConn
+	AuthorNick string
+	// The services account the author is logged in with. Comes from the
+	// account tag. Empty if the author is not logged in or the server
+	// does not support it.
+	Account string
+	// The channel or the nick (for the private messages) to respond to
+	Channel string
+}
+
+func (env *IrcEnvironment) AsDiscord() *DiscordEnvironment {
+	return nil
+}
+
+func (env *IrcEnvironment) Platform() string {
+	return "irc"
+}
+
+func (env *IrcEnvironment) ChannelID() string {
+	return env.Channel
+}
+
+func (env *IrcEnvironment) AtAdmin() string {
+	if owner, ok := Roles.OwnerOn(env.Platform()); ok {
+		// "libera/tsoding" -> "tsoding"
+		split := strings.SplitN(owner, "/", 2)
+		return split[len(split)-1]
+	}
+	return "the owner"
+}
+
+func (env *IrcEnvironment) AtAuthor() string {
+	return env.AuthorNick
+}
+
+// Anybody can take any nick that is not registered with the services.
+// So the identity is the services account of the author, and the authors
+// that are not logged in don't have any.
+func (env *IrcEnvironment) UniversalPlatformAgnosticUserID() string {
+	if len(env.Account) == 0 || env.Account == "*" {
+		return ""
+	}
+	return "irc#" + env.Conn.Config.Network + "/" + strings.ToLower(env.Account)
+}
+
+func (env *IrcEnvironment) HasPermission(permission Permission) bool {
+	userId := env.UniversalPlatformAgnosticUserID()
+	if len(userId) == 0 {
+		return permission == PermissionEveryone
+	}
+	return Roles.PermissionOfUser(userId) >= permission
+}
+
+func (env *IrcEnvironment) SendMessage(message string) {
+	env.Conn.Push(env.Channel, message)
+}
+
+// IRC does not have native replies, so it's always "nick: message"
+func (env *IrcEnvironment) Reply(message string) {
+	if len(env.AuthorNick) == 0 || env.Channel == env.AuthorNick {
+		env.SendMessage(message)
+		return
+	}
+	env.SendMessage(fmt.Sprintf("%s: %s", env.AuthorNick, message))
+}
+
+func (env *IrcEnvironment) SendRichMessage(message internal.RichMessage) {
+	env.SendMessage(message.Flatten())
+}
+
+func (env *IrcEnvironment) ReplyRich(message internal.RichMessage) {
+	env.Reply(message.Flatten())
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/tsoding/gatekeeper/internal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startFakeIrcNetworkConn(t *testing.T, server *FakeIrcServer, config IrcNetworkConfig) *IrcNetworkConn {
+	ircConn := newIrcNetworkConn(config)
+	ircConn.Dial = server.Dial
+	go ircConn.run(nil)
+	return ircConn
+}
+
+func expectIrcClosesIn(t *testing.T, ircConn *IrcNetworkConn) {
+	t.Helper()
+	closed := make(chan struct{})
+	go func() {
+		ircConn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(FakeIrcTimeout):
+		t.Fatal("Close() did not return")
+	}
+}
+
+func TestIrcNetworkSaslLogin(t *testing.T) {
+	server := newFakeIrcServer(t)
+	ircConn := startFakeIrcNetworkConn(t, server, IrcNetworkConfig{
+		Network: "libera",
+		Nick: "gatekeeper",
+		Channels: []string{"#tsoding", "#gatekeeper"},
+		SaslUser: "gatekeeper",
+		SaslPass: "hunter2",
+	})
+	defer expectIrcClosesIn(t, ircConn)
+
+	client := server.Accept(t)
+	client.Expect(t, "CAP REQ :account-tag")
+	client.Expect(t, "CAP REQ :sasl")
+	client.Expect(t, "NICK :gatekeeper")
+	client.Expect(t, "USER gatekeeper 0 * :Gatekeeper")
+	client.Send(t, ":server CAP * ACK :account-tag")
+	client.Send(t, ":server CAP * ACK :sasl")
+	client.Expect(t, "AUTHENTICATE :PLAIN")
+	client.Send(t, "AUTHENTICATE +")
+	credentials := base64.StdEncoding.EncodeToString([]byte("gatekeeper\x00gatekeeper\x00hunter2"))
+	client.Expect(t, "AUTHENTICATE :"+credentials)
+	client.Send(t, ":server 903 gatekeeper :SASL authentication successful")
+	client.Expect(t, "CAP :END")
+	client.Send(t, ":server 001 gatekeeper :Welcome")
+	client.Expect(t, "JOIN :#tsoding,#gatekeeper")
+}
+
+func TestIrcNetworkAbandonsOnSaslFailure(t *testing.T) {
+	server := newFakeIrcServer(t)
+	ircConn := startFakeIrcNetworkConn(t, server, IrcNetworkConfig{
+		Network: "libera",
+		Nick: "gatekeeper",
+		SaslUser: "gatekeeper",
+		SaslPass: "hunter3",
+	})
+	defer expectIrcClosesIn(t, ircConn)
+
+	client := server.Accept(t)
+	client.Expect(t, "CAP REQ :account-tag")
+	client.Expect(t, "CAP REQ :sasl")
+	client.Send(t, ":server CAP * NAK :account-tag")
+	client.Send(t, ":server CAP * ACK :sasl")
+	client.Expect(t, "NICK :gatekeeper")
+	client.Expect(t, "USER ")
+	client.Expect(t, "AUTHENTICATE :PLAIN")
+	client.Send(t, "AUTHENTICATE +")
+	client.Expect(t, "AUTHENTICATE :")
+	client.Send(t, ":server 904 gatekeeper :SASL authentication failed")
+	client.ExpectClosed(t)
+	server.ExpectNoClient(t, 2*IrcMinBackoff)
+}
+
+// Goes through the registration without SASL
+func (client *FakeIrcClient) Register(t *testing.T, nick string) {
+	t.Helper()
+	client.Expect(t, "CAP REQ :account-tag")
+	client.Expect(t, "NICK :"+nick)
+	client.Expect(t, "USER ")
+	client.Send(t, ":server CAP * ACK :account-tag")
+	client.Expect(t, "CAP :END")
+}
+
+func TestIrcNetworkNickCollision(t *testing.T) {
+	server := newFakeIrcServer(t)
+	ircConn := startFakeIrcNetworkConn(t, server, IrcNetworkConfig{
+		Network: "libera",
+		Nick: "gatekeeper",
+		Channels: []string{"#tsoding"},
+	})
+	defer expectIrcClosesIn(t, ircConn)
+
+	client := server.Accept(t)
+	client.Register(t, "gatekeeper")
+	client.Send(t, ":server 433 * gatekeeper :Nickname is already in use")
+	client.Expect(t, "NICK :gatekeeper_")
+	client.Send(t, ":server 433 * gatekeeper_ :Nickname is already in use")
+	client.Expect(t, "NICK :gatekeeper__")
+	client.Send(t, ":server 001 gatekeeper__ :Welcome")
+	client.Expect(t, "JOIN :#tsoding")
+
+	// The private messages are addressed to the nick we actually got
+	client.Send(t, ":rexim!rexim@host PRIVMSG gatekeeper__ :!nonexistingcommand")
+	client.Expect(t, "PRIVMSG rexim :command `nonexistingcommand` does not exist")
+}
+
+func TestIrcNetworkNickServIdentify(t *testing.T) {
+	server := newFakeIrcServer(t)
+	ircConn := startFakeIrcNetworkConn(t, server, IrcNetworkConfig{
+		Network: "libera",
+		Nick: "gatekeeper",
+		Channels: []string{"#tsoding"},
+		NickServPass: "hunter2",
+	})
+	defer expectIrcClosesIn(t, ircConn)
+
+	client := server.Accept(t)
+	client.Register(t, "gatekeeper")
+	client.Send(t, ":server 001 gatekeeper :Welcome")
+	client.Expect(t, "PRIVMSG NickServ :IDENTIFY gatekeeper hunter2")
+	client.Send(t, ":NickServ!NickServ@services. NOTICE gatekeeper :You are now identified for gatekeeper.")
+	client.Send(t, ":server 900 gatekeeper gatekeeper!gatekeeper@host gatekeeper :You are now logged in as gatekeeper")
+	client.Expect(t, "JOIN :#tsoding")
+}
+
+func TestIrcNetworkChat(t *testing.T) {
+	server := newFakeIrcServer(t)
+	ircConn := startFakeIrcNetworkConn(t, server, IrcNetworkConfig{
+		Network: "libera",
+		Nick: "gatekeeper",
+		Channels: []string{"#tsoding"},
+	})
+	defer expectIrcClosesIn(t, ircConn)
+
+	client := server.Accept(t)
+	client.Register(t, "gatekeeper")
+	client.Send(t, ":server 001 gatekeeper :Welcome")
+	client.Expect(t, "JOIN :#tsoding")
+
+	client.Send(t, "PING :server")
+	client.Expect(t, "PONG :server")
+
+	client.Send(t, ":rexim!rexim@host PRIVMSG gatekeeper :\x01VERSION\x01")
+	client.Expect(t, "NOTICE rexim :\x01VERSION Gatekeeper "+Commit+"\x01")
+
+	// The rest of CTCP is ignored, so the next line is the reply to the command
+	client.Send(t, ":rexim!rexim@host PRIVMSG #tsoding :\x01ACTION !nonexistingcommand\x01")
+	client.Send(t, ":rexim!rexim@host PRIVMSG #tsoding :!nonexistingcommand")
+	client.Expect(t, "PRIVMSG #tsoding :rexim: command `nonexistingcommand` does not exist")
+}
+
+func TestIrcNetworkPush(t *testing.T) {
+	ircConn := newIrcNetworkConn(IrcNetworkConfig{Network: "libera", Nick: "gatekeeper"})
+	ircConn.Push("#tsoding", "first\nsecond\r\n"+strings.Repeat("x ", IrcMaxMessageLength))
+	lines := []string{}
+	for len(ircConn.Outgoing) > 0 {
+		msg := <-ircConn.Outgoing
+		// Plus \r\n and the prefix the server adds when it relays the message
+		line, ok := msg.String()
+		if !ok || len(line) + 2 + IrcRelayPrefixReserve > IrcMaxMessageLength {
+			t.Fatalf("%q does not fit into an IRC message", line)
+		}
+		lines = append(lines, msg.Args[1])
+	}
+	if len(lines) != IrcMaxLinesPerMessage {
+		t.Fatalf("expected %d lines, but got %d: %q", IrcMaxLinesPerMessage, len(lines), lines)
+	}
+	if lines[0] != "first" || lines[1] != "second" {
+		t.Errorf("unexpected lines %q", lines[:2])
+	}
+}
+
+func TestIrcEnvironmentPermissions(t *testing.T) {
+	withRoles(t, []internal.UserRole{{UserId: "irc#libera/tsoding", Role: internal.RoleAdmin}})
+	ircConn := newIrcNetworkConn(IrcNetworkConfig{Network: "libera", Nick: "gatekeeper"})
+
+	loggedIn := &IrcEnvironment{Conn: ircConn, AuthorNick: "tsoding", Account: "Tsoding", Channel: "#tsoding"}
+	if loggedIn.UniversalPlatformAgnosticUserID() != "irc#libera/tsoding" {
+		t.Errorf("unexpected user id %s", loggedIn.UniversalPlatformAgnosticUserID())
+	}
+	if !loggedIn.HasPermission(PermissionAdmin) || loggedIn.HasPermission(PermissionOwner) {
+		t.Errorf("expected the logged in user to be admin")
+	}
+
+	impostor := &IrcEnvironment{Conn: ircConn, AuthorNick: "tsoding", Channel: "#tsoding"}
+	if impostor.HasPermission(PermissionSubscriber) || !impostor.HasPermission(PermissionEveryone) {
+		t.Errorf("expected the user without the account to have no roles")
+	}
+	if impostor.UniversalPlatformAgnosticUserID() != "" {
+		t.Errorf("expected the user without the account to have no id, got %s", impostor.UniversalPlatformAgnosticUserID())
+	}
+	otherAccount := &IrcEnvironment{Conn: ircConn, AuthorNick: "tsoding", Account: "rexim", Channel: "#tsoding"}
+	if otherAccount.HasPermission(PermissionSubscriber) {
+		t.Errorf("expected the user logged in to another account to have no roles")
+	}
+	otherNick := &IrcEnvironment{Conn: ircConn, AuthorNick: "tsoding_away", Account: "tsoding", Channel: "#tsoding"}
+	if !otherNick.HasPermission(PermissionAdmin) {
+		t.Errorf("expected the roles to follow the account rather than the nick")
+	}
+}
+
+func TestIrcUnidentifiedAuthorState(t *testing.T) {
+	ircConn := newIrcNetworkConn(IrcNetworkConfig{Network: "libera", Nick: "gatekeeper"})
+	env := &IrcEnvironment{Conn: ircConn, AuthorNick: "tsoding", Channel: "#tsoding"}
+
+	// The db is never touched for the authors without the account
+	if err := EvalLinkCommand(nil, Command{Name: "link", Args: "ABCDEF"}, env); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := EvalUnlinkCommand(nil, Command{Name: "unlink"}, env); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	lines := []string{}
+	for len(ircConn.Outgoing) > 0 {
+		msg := <-ircConn.Outgoing
+		lines = append(lines, msg.Args[1])
+	}
+	expected := "tsoding: Could not identify you on this platform. On IRC you have to be logged in to the services."
+	expectMessages(t, lines, expected, expected)
+}
+
+func TestIrcCtcpVersionIsThrottled(t *testing.T) {
+	ircConn := newIrcNetworkConn(IrcNetworkConfig{Network: "libera", Nick: "gatekeeper"})
+	msg, ok := ParseIrcMsg(":rexim!rexim@localhost PRIVMSG gatekeeper :\x01VERSION\x01")
+	if !ok {
+		t.Fatalf("could not parse the message")
+	}
+	ircConn.handleChatMsg(nil, msg)
+
+	// Nothing is written to the connection directly, the reply waits in the queue
+	if len(ircConn.Outgoing) != 1 {
+		t.Fatalf("expected the reply in the outgoing queue, but got %d messages", len(ircConn.Outgoing))
+	}
+	reply := <-ircConn.Outgoing
+	if reply.Name != IrcCmdNotice || reply.Args[0] != "rexim" || !strings.HasPrefix(reply.Args[1], "\x01VERSION ") {
+		t.Errorf("unexpected reply %s %q", reply.Name, reply.Args)
+	}
+}
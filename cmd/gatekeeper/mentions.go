@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"regexp"
+	"strings"
+)
+
+// The only mentions the bot is allowed to ping on Discord are the users
+// in the list. @everyone, @here, roles and the rest of the users are
+// still rendered, but do not notify anybody. Every message the bot
+// sends to Discord must go through this, since any of them may contain
+// the output of a custom command.
+func DiscordAllowedMentions(userIds ...string) *discordgo.MessageAllowedMentions {
+	return &discordgo.MessageAllowedMentions{
+		Parse: []discordgo.AllowedMentionType{},
+		Users: userIds,
+	}
+}
+
+// Handles that can't possibly be a Twitch user name are left alone.
+// https://discuss.dev.twitch.tv/t/twitch-channel-name-regex/3855
+var TwitchMentionRegexp = regexp.MustCompile(`@([a-zA-Z0-9_]{1,25})`)
+
+var URLRegexp = regexp.MustCompile(`https?://\S+`)
+
+// Breaks all the @mentions of the Twitch users except the allowed ones,
+// so they are not highlighted for the mentioned users. Leaves the links
+// intact.
+func SanitizeTwitchMentions(message string, allowedHandles []string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range URLRegexp.FindAllStringIndex(message, -1) {
+		sb.WriteString(sanitizeTwitchMentionsInText(message[last:loc[0]], allowedHandles))
+		sb.WriteString(message[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	sb.WriteString(sanitizeTwitchMentionsInText(message[last:], allowedHandles))
+	return sb.String()
+}
+
+func sanitizeTwitchMentionsInText(text string, allowedHandles []string) string {
+	return TwitchMentionRegexp.ReplaceAllStringFunc(text, func(mention string) string {
+		handle := strings.TrimPrefix(mention, "@")
+		for _, allowed := range allowedHandles {
+			if strings.EqualFold(handle, allowed) {
+				return mention
+			}
+		}
+		// A zero width space between @ and the name
+		return "@​" + handle
+	})
+}
+
+// Adds the element to the list if it's not there yet
+func appendUnique(list []string, element string) []string {
+	for _, x := range list {
+		if x == element {
+			return list
+		}
+	}
+	return append(list, element)
+}
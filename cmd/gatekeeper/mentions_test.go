@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"testing"
+)
+
+func expectAllowedUsers(t *testing.T, message FakeDiscordMessage, expected ...string) {
+	t.Helper()
+	allowed := message.AllowedMentions
+	if allowed == nil {
+		t.Fatalf("message %q was sent without allowed mentions", message.Content)
+	}
+	if allowed.Parse == nil || len(allowed.Parse) != 0 {
+		t.Fatalf("message %q allows to parse mentions: %#v", message.Content, allowed.Parse)
+	}
+	if len(allowed.Users) != len(expected) {
+		t.Fatalf("expected allowed users %v, but got %v", expected, allowed.Users)
+	}
+	for i := range expected {
+		if allowed.Users[i] != expected[i] {
+			t.Fatalf("expected allowed users %v, but got %v", expected, allowed.Users)
+		}
+	}
+}
+
+func TestDiscordMassPingFromCustomCommand(t *testing.T) {
+	env, session := newFakeDiscordEnvironment("69")
+	context := internal.NewEvalContext(env, "", 0)
+	exprs, err := internal.ParseAllExprs(`say("@everyone @here <@&420> <@1337>")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expr := range exprs {
+		if _, err := context.EvalExpr(expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(session.Messages) != 1 {
+		t.Fatalf("expected 1 message, but got %#v", session.Messages)
+	}
+	expectAllowedUsers(t, session.Messages[0], "69")
+}
+
+func TestDiscordOwnerMentionIsAllowed(t *testing.T) {
+	withRoles(t, []internal.UserRole{{UserId: "discord#42", Role: internal.RoleOwner}})
+	env, session := newFakeDiscordEnvironment("69")
+	env.Reply("Please ask " + env.AtAdmin() + " to check the logs")
+	if len(session.Messages) != 1 {
+		t.Fatalf("expected 1 message, but got %#v", session.Messages)
+	}
+	expectAllowedUsers(t, session.Messages[0], "42", "69")
+}
+
+func TestDiscordDirectMessageMentions(t *testing.T) {
+	env, session := newFakeDiscordEnvironment("69")
+	if err := env.SendDirectMessage("hello @everyone"); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Messages) != 1 {
+		t.Fatalf("expected 1 message, but got %#v", session.Messages)
+	}
+	expectAllowedUsers(t, session.Messages[0])
+}
+
+func TestSanitizeTwitchMentions(t *testing.T) {
+	cases := []struct{
+		message  string
+		expected string
+	}{
+		{"hello @Tsoding", "hello @Tsoding"},
+		{"hello @tsoding", "hello @tsoding"},
+		{"hello @rexim", "hello @​rexim"},
+		{"@rexim @tsoding @rexim", "@​rexim @tsoding @​rexim"},
+		{"see https://example.com/@rexim", "see https://example.com/@rexim"},
+		{"@rexim https://example.com/@rexim @rexim", "@​rexim https://example.com/@rexim @​rexim"},
+		{"just @", "just @"},
+	}
+	for _, c := range cases {
+		actual := SanitizeTwitchMentions(c.message, []string{"Tsoding"})
+		if actual != c.expected {
+			t.Errorf("%q: expected %q, but got %q", c.message, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMinesweeperFieldIsDeterministic(t *testing.T) {
+	for _, seed := range []string{"69", "420", "tsoding"} {
+		a := randomMinesweeperField(rand.New(seedAsSource(seed)))
+		b := randomMinesweeperField(rand.New(seedAsSource(seed)))
+		if a != b {
+			t.Errorf("seed %q generated different fields", seed)
+		}
+	}
+}
+
+func TestMineCommandIsDeterministic(t *testing.T) {
+	withRoles(t, nil)
+	env, session := newFakeDiscordEnvironment("69")
+	evalTestCommand(t, env, "!mine 69")
+	evalTestCommand(t, env, "!mine 69")
+	evalTestCommand(t, env, "!mineopen 69")
+	evalTestCommand(t, env, "!mineopen 69")
+
+	messages := session.Contents()
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, but got %q", messages)
+	}
+	if messages[0] != messages[1] || messages[2] != messages[3] {
+		t.Fatalf("the same seed generated different fields")
+	}
+	if !strings.HasPrefix(messages[0], "👉 69\n") || !strings.HasPrefix(messages[2], "open 👉 69\n") {
+		t.Fatalf("unexpected fields %q", messages)
+	}
+	if strings.Count(messages[0], "||") <= 2 || strings.Count(messages[2], "||") != 2 {
+		t.Fatalf("every cell of the field must be hidden behind a spoiler, but the opened field must be hidden as a whole")
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/bwmarrin/discordgo"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	ModRulesReloadInterval = 1 * time.Minute
+	ModRulePatternSizeLimit = 256
+	DefaultModTimeoutSeconds = 10 * 60
+	// The longest timeout Discord allows
+	MaxModTimeoutSeconds = 28 * 24 * 60 * 60
+	// The caps rule ignores the messages with less letters than that
+	ModCapsMinLetters = 10
+	// The repeat rule counts the same messages of the user within this window
+	ModRepeatWindow = 5 * time.Minute
+	// Forget the expired repeated messages when there are too many of them
+	ModRepeatHistoryLimit = 10000
+	// The reports quote the messages up to that many characters, so
+	// they fit into a Discord message
+	ModReportTextLimit = 500
+)
+
+var (
+	ModRuleKinds = []string{"phrase", "regex", "domain", "links", "caps", "repeat", "emoji"}
+	ModActions = []string{"delete", "timeout", "warn", "log"}
+	ModRules = ModRuleSet{}
+	// http(s) links and the ones that start with www.
+	LinkRegexp = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>]+`)
+	DiscordCustomEmojiRegexp = regexp.MustCompile(`<a?:[a-zA-Z0-9_]+:[0-9]+>`)
+)
+
+// The message the rules are checked against
+type ModMessage struct {
+	Platform string
+	Channel string
+	// The same as CommandEnvironment.UniversalPlatformAgnosticUserID()
+	UserId string
+	Text string
+	// Emotes that are not part of the text as unicode, for instance
+	// the Twitch emotes from the emotes tag
+	Emotes int
+}
+
+type CompiledModRule struct {
+	internal.ModRule
+	Regexp *regexp.Regexp
+	// The domains of the domain and links rules
+	Domains []string
+	// The percent of the caps rule, the amount of the messages of the
+	// repeat rule, the amount of the emojis of the emoji rule
+	Threshold int
+}
+
+func (rule CompiledModRule) Describe() string {
+	description := fmt.Sprintf("%d. %s %q -> %s", rule.Id, rule.Kind, rule.Pattern, rule.Action)
+	if rule.Action == "timeout" {
+		description += fmt.Sprintf(" %ds", rule.TimeoutSeconds)
+	}
+	if rule.DryRun {
+		description += " (dry run)"
+	}
+	return description
+}
+
+func parseModDomains(pattern string) []string {
+	domains := []string{}
+	for _, domain := range strings.Split(pattern, ",") {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+		if len(domain) > 0 {
+			domains = appendUnique(domains, domain)
+		}
+	}
+	return domains
+}
+
+func compileModRule(rule internal.ModRule) (CompiledModRule, error) {
+	compiled := CompiledModRule{ModRule: rule}
+
+	switch rule.Action {
+	case "delete", "warn", "log":
+	case "timeout":
+		if rule.TimeoutSeconds <= 0 || rule.TimeoutSeconds > MaxModTimeoutSeconds {
+			return CompiledModRule{}, fmt.Errorf("timeout must be between 1 and %d seconds", MaxModTimeoutSeconds)
+		}
+	default:
+		return CompiledModRule{}, fmt.Errorf("unknown action `%s`. Expected one of %s", rule.Action, strings.Join(ModActions, ", "))
+	}
+
+	if len(rule.Pattern) > ModRulePatternSizeLimit {
+		return CompiledModRule{}, fmt.Errorf("pattern must be max %d bytes long", ModRulePatternSizeLimit)
+	}
+
+	switch rule.Kind {
+	case "phrase":
+		if len(strings.TrimSpace(rule.Pattern)) == 0 {
+			return CompiledModRule{}, fmt.Errorf("phrase cannot be empty")
+		}
+	case "regex":
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return CompiledModRule{}, fmt.Errorf("could not compile regexp `%s`: %w", rule.Pattern, err)
+		}
+		compiled.Regexp = re
+	case "domain":
+		compiled.Domains = parseModDomains(rule.Pattern)
+		if len(compiled.Domains) == 0 {
+			return CompiledModRule{}, fmt.Errorf("expected comma separated list of the denied domains")
+		}
+	case "links":
+		// Empty list means no links are allowed at all
+		compiled.Domains = parseModDomains(rule.Pattern)
+	case "caps", "repeat", "emoji":
+		threshold, err := strconv.Atoi(strings.TrimSpace(rule.Pattern))
+		if err != nil {
+			return CompiledModRule{}, fmt.Errorf("`%s` is not a number", rule.Pattern)
+		}
+		switch {
+		case rule.Kind == "caps" && (threshold < 1 || threshold > 100):
+			return CompiledModRule{}, fmt.Errorf("caps percent must be between 1 and 100")
+		case rule.Kind == "repeat" && threshold < 2:
+			return CompiledModRule{}, fmt.Errorf("amount of the repeated messages must be at least 2")
+		case rule.Kind == "emoji" && threshold < 0:
+			return CompiledModRule{}, fmt.Errorf("amount of the emojis cannot be negative")
+		}
+		compiled.Threshold = threshold
+	default:
+		return CompiledModRule{}, fmt.Errorf("unknown kind `%s`. Expected one of %s", rule.Kind, strings.Join(ModRuleKinds, ", "))
+	}
+
+	return compiled, nil
+}
+
+// The domains of all the links in the text, lowercase and without www.
+func linkDomains(text string) []string {
+	domains := []string{}
+	for _, link := range LinkRegexp.FindAllString(text, -1) {
+		if !strings.Contains(link, "://") {
+			link = "https://" + link
+		}
+		parsed, err := url.Parse(link)
+		if err != nil || len(parsed.Hostname()) == 0 {
+			// Can't tell where it leads. Better be safe.
+			domains = append(domains, link)
+			continue
+		}
+		domains = append(domains, strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www."))
+	}
+	return domains
+}
+
+// The domain itself or any of its subdomains
+func domainMatches(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func domainMatchesAny(host string, domains []string) bool {
+	for _, domain := range domains {
+		if domainMatches(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Percent of the uppercase letters. Returns false if there are too few
+// letters to tell.
+func capsPercent(text string) (int, bool) {
+	letters := 0
+	upper := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters += 1
+			if unicode.IsUpper(r) {
+				upper += 1
+			}
+		}
+	}
+	if letters < ModCapsMinLetters {
+		return 0, false
+	}
+	return upper * 100 / letters, true
+}
+
+// Unicode emojis and Discord custom emojis
+func countEmojis(text string) int {
+	count := len(DiscordCustomEmojiRegexp.FindAllString(text, -1))
+	for _, r := range DiscordCustomEmojiRegexp.ReplaceAllString(text, "") {
+		if unicode.Is(unicode.So, r) {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Amount of the emotes in the emotes tag of the Twitch message, for
+// example "25:0-4,12-16/1902:6-10" is 3 emotes
+// https://dev.twitch.tv/docs/irc/tags/#privmsg-tags
+func countTwitchEmotes(tag string) int {
+	count := 0
+	for _, emote := range strings.Split(tag, "/") {
+		split := strings.SplitN(emote, ":", 2)
+		if len(split) == 2 && len(split[1]) > 0 {
+			count += len(strings.Split(split[1], ","))
+		}
+	}
+	return count
+}
+
+// repeats is the amount of times the user sent the same message within
+// the ModRepeatWindow, including this one
+func (rule CompiledModRule) Matches(msg ModMessage, repeats int) bool {
+	switch rule.Kind {
+	case "phrase":
+		return strings.Contains(strings.ToLower(msg.Text), strings.ToLower(strings.TrimSpace(rule.Pattern)))
+	case "regex":
+		return rule.Regexp.MatchString(msg.Text)
+	case "domain":
+		for _, host := range linkDomains(msg.Text) {
+			if domainMatchesAny(host, rule.Domains) {
+				return true
+			}
+		}
+		return false
+	case "links":
+		for _, host := range linkDomains(msg.Text) {
+			if !domainMatchesAny(host, rule.Domains) {
+				return true
+			}
+		}
+		return false
+	case "caps":
+		percent, ok := capsPercent(msg.Text)
+		return ok && percent >= rule.Threshold
+	case "repeat":
+		return repeats >= rule.Threshold
+	case "emoji":
+		return countEmojis(msg.Text) + msg.Emotes > rule.Threshold
+	default:
+		return false
+	}
+}
+
+type recentModMessage struct {
+	text string
+	count int
+	at time.Time
+}
+
+// Live copy of the Mod_Rules table
+type ModRuleSet struct {
+	mutex sync.Mutex
+	rules []CompiledModRule
+	// Key is "<platform>#<channel>#<user id>". The last message of
+	// the user for the repeat rules.
+	recent map[string]recentModMessage
+}
+
+func (set *ModRuleSet) update(rows []internal.ModRule) {
+	rules := []CompiledModRule{}
+	for _, row := range rows {
+		rule, err := compileModRule(row)
+		if err != nil {
+			log.Printf("Skipping mod rule %d: %s\n", row.Id, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	set.rules = rules
+}
+
+func (set *ModRuleSet) Reload(db *sql.DB) error {
+	rows, err := internal.QueryModRules(db)
+	if err != nil {
+		return err
+	}
+	set.update(rows)
+	return nil
+}
+
+// Remembers the message for the repeat rules and picks the rules it
+// matches
+func (set *ModRuleSet) Match(msg ModMessage, now time.Time) []CompiledModRule {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if len(set.rules) == 0 {
+		return nil
+	}
+
+	if set.recent == nil {
+		set.recent = map[string]recentModMessage{}
+	}
+	if len(set.recent) >= ModRepeatHistoryLimit {
+		for key, recent := range set.recent {
+			if now.Sub(recent.at) > ModRepeatWindow {
+				delete(set.recent, key)
+			}
+		}
+	}
+	key := msg.Platform + "#" + msg.Channel + "#" + msg.UserId
+	text := strings.ToLower(strings.TrimSpace(msg.Text))
+	recent, ok := set.recent[key]
+	if ok && recent.text == text && now.Sub(recent.at) <= ModRepeatWindow {
+		recent.count += 1
+	} else {
+		recent = recentModMessage{text: text, count: 1}
+	}
+	recent.at = now
+	set.recent[key] = recent
+
+	matched := []CompiledModRule{}
+	for _, rule := range set.rules {
+		if rule.Matches(msg, recent.count) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+func PollModRules(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	err := ModRules.Reload(db)
+	if err != nil {
+		log.Println("Error loading mod rules:", err)
+	}
+	go func() {
+		for {
+			time.Sleep(ModRulesReloadInterval)
+			err := ModRules.Reload(db)
+			if err != nil {
+				log.Println("Error reloading mod rules:", err)
+			}
+		}
+	}()
+}
+
+// Reports of the moderation rules. Always goes to the logs and to the
+// Discord channel from GATEKEEPER_DISCORD_MOD_LOG_CHANNEL if provided.
+type ModLogger struct {
+	mutex sync.Mutex
+	dg DiscordSession
+	channelId string
+}
+
+var ModLog = ModLogger{}
+
+func (modLog *ModLogger) Start(dg DiscordSession) {
+	modLog.mutex.Lock()
+	defer modLog.mutex.Unlock()
+	modLog.dg = dg
+	modLog.channelId = os.Getenv("GATEKEEPER_DISCORD_MOD_LOG_CHANNEL")
+}
+
+func (modLog *ModLogger) Report(report string) {
+	log.Println("Moderation:", report)
+
+	modLog.mutex.Lock()
+	dg, channelId := modLog.dg, modLog.channelId
+	modLog.mutex.Unlock()
+	if dg == nil || len(channelId) == 0 {
+		return
+	}
+	// The reports quote the messages, but must not ping anybody
+	_, err := dg.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
+		Content: report,
+		AllowedMentions: DiscordAllowedMentions(),
+	})
+	if err != nil {
+		log.Println("Error while sending the mod log:", err)
+	}
+}
+
+// Performs the action of the rule. Returns what was actually done,
+// since not all the platforms support all the actions.
+func applyModAction(env CommandEnvironment, rule CompiledModRule) (string, error) {
+	warning := "your message was removed by the moderation rules"
+
+	switch rule.Action {
+	case "log":
+		return "logged", nil
+	case "warn":
+		env.Reply("please follow the rules of the chat")
+		return "warned", nil
+	case "delete", "timeout":
+		discordEnv := env.AsDiscord()
+		if discordEnv == nil {
+			// Twitch removed the /delete and /timeout chat commands
+			// in favor of the Helix API which requires the moderator
+			// OAuth token the bot does not have
+			env.Reply("please follow the rules of the chat")
+			return fmt.Sprintf("warned (%s is not supported on %s)", rule.Action, env.Platform()), nil
+		}
+		if err := discordEnv.dg.ChannelMessageDelete(discordEnv.m.ChannelID, discordEnv.m.ID); err != nil {
+			return "", fmt.Errorf("could not delete message %s: %w", discordEnv.m.ID, err)
+		}
+		if rule.Action == "delete" {
+			env.SendMessage(env.AtAuthor() + " " + warning)
+			return "deleted", nil
+		}
+		until := time.Now().Add(time.Duration(rule.TimeoutSeconds) * time.Second)
+		if err := discordEnv.dg.GuildMemberTimeout(discordEnv.m.GuildID, discordEnv.m.Author.ID, &until); err != nil {
+			return "deleted", fmt.Errorf("could not time out user %s: %w", discordEnv.m.Author.ID, err)
+		}
+		env.SendMessage(env.AtAuthor() + " " + warning)
+		return fmt.Sprintf("deleted and timed out for %ds", rule.TimeoutSeconds), nil
+	default:
+		panic("unreachable")
+	}
+}
+
+// Checks the message against the mod rules and acts on the first
+// matching one. The matches of the dry run rules are only reported.
+// Returns true if the message was removed and should not be processed
+// any further. On the platforms that can't remove the messages it's
+// still true for the delete and timeout rules.
+func ModerateMessage(env CommandEnvironment, msg ModMessage) bool {
+	// Moderators are trusted to know what they are doing
+	if env.HasPermission(PermissionModerator) {
+		return false
+	}
+
+	for _, rule := range ModRules.Match(msg, time.Now()) {
+		report := fmt.Sprintf("rule %d (%s %q) matched %s in %s %s: %q", rule.Id, rule.Kind, rule.Pattern, msg.UserId, msg.Platform, msg.Channel, truncateRunes(msg.Text, ModReportTextLimit))
+		if rule.DryRun {
+			ModLog.Report("[dry run] " + report + " -> would " + rule.Action)
+			continue
+		}
+		done, err := applyModAction(env, rule)
+		if err != nil {
+			log.Printf("Error while applying mod rule %d: %s\n", rule.Id, err)
+			ModLog.Report(report + " -> failed to " + rule.Action)
+			return len(done) > 0
+		}
+		ModLog.Report(report + " -> " + done)
+		return rule.Action == "delete" || rule.Action == "timeout"
+	}
+	return false
+}
+
+// Drops the first whitespace separated field of the text
+func skipField(text string) string {
+	text = strings.TrimSpace(text)
+	i := strings.IndexFunc(text, unicode.IsSpace)
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(text[i:])
+}
+
+// Parses "timeout:600" into ("timeout", 600)
+func parseModAction(source string) (string, int, bool) {
+	split := strings.SplitN(strings.ToLower(source), ":", 2)
+	action := split[0]
+	timeoutSeconds := 0
+	if action == "timeout" {
+		timeoutSeconds = DefaultModTimeoutSeconds
+	}
+	if len(split) == 2 {
+		if action != "timeout" {
+			return "", 0, false
+		}
+		seconds, err := strconv.Atoi(split[1])
+		if err != nil {
+			return "", 0, false
+		}
+		timeoutSeconds = seconds
+	}
+	return action, timeoutSeconds, true
+}
+
+func EvalAddModRuleCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	usage := "Usage: addmodrule [dry] <" + strings.Join(ModActions, "|") + "[:<seconds>]> <" + strings.Join(ModRuleKinds, "|") + "> <pattern>"
+
+	rule := internal.ModRule{}
+	args := strings.TrimSpace(command.Args)
+	if fields := strings.Fields(args); len(fields) > 0 && strings.ToLower(fields[0]) == "dry" {
+		rule.DryRun = true
+		args = skipField(args)
+	}
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		env.Reply(usage)
+		return nil
+	}
+
+	action, timeoutSeconds, ok := parseModAction(fields[0])
+	if !ok {
+		env.Reply(usage)
+		return nil
+	}
+	rule.Action = action
+	rule.TimeoutSeconds = timeoutSeconds
+	rule.Kind = strings.ToLower(fields[1])
+	// The spaces of the phrases and the regexps are kept intact
+	rule.Pattern = skipField(skipField(args))
+
+	if _, err := compileModRule(rule); err != nil {
+		env.Reply(err.Error())
+		return nil
+	}
+
+	id, err := internal.InsertModRule(db, rule)
+	if err != nil {
+		return fmt.Errorf("could not add mod rule: %w", err)
+	}
+	err = ModRules.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload mod rules: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Mod rule %d is added", id))
+	return nil
+}
+
+func parseModRuleId(args string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	return id, err == nil
+}
+
+func EvalDelModRuleCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	id, ok := parseModRuleId(command.Args)
+	if !ok {
+		env.Reply("Usage: delmodrule <id>")
+		return nil
+	}
+
+	deleted, err := internal.DeleteModRule(db, id)
+	if err != nil {
+		return fmt.Errorf("could not delete mod rule %d: %w", id, err)
+	}
+	if !deleted {
+		env.Reply(fmt.Sprintf("Mod rule %d does not exist", id))
+		return nil
+	}
+	err = ModRules.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload mod rules: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Mod rule %d is deleted", id))
+	return nil
+}
+
+func EvalModRuleDryCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	usage := "Usage: modruledry <id> <on|off>"
+	fields := strings.Fields(command.Args)
+	if len(fields) != 2 {
+		env.Reply(usage)
+		return nil
+	}
+	id, ok := parseModRuleId(fields[0])
+	if !ok {
+		env.Reply(usage)
+		return nil
+	}
+	var dryRun bool
+	switch strings.ToLower(fields[1]) {
+	case "on":  dryRun = true
+	case "off": dryRun = false
+	default:
+		env.Reply(usage)
+		return nil
+	}
+
+	updated, err := internal.SetModRuleDryRun(db, id, dryRun)
+	if err != nil {
+		return fmt.Errorf("could not update mod rule %d: %w", id, err)
+	}
+	if !updated {
+		env.Reply(fmt.Sprintf("Mod rule %d does not exist", id))
+		return nil
+	}
+	err = ModRules.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload mod rules: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Dry run of mod rule %d is %s", id, onOff(dryRun)))
+	return nil
+}
+
+func EvalModRulesCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	rows, err := internal.QueryModRules(db)
+	if err != nil {
+		return fmt.Errorf("could not query mod rules: %w", err)
+	}
+	if len(rows) == 0 {
+		env.Reply("There are no mod rules")
+		return nil
+	}
+
+	items := []string{}
+	for _, row := range rows {
+		items = append(items, CompiledModRule{ModRule: row}.Describe())
+	}
+	_, page := splitPageArg(command.Args)
+	sendPage(env, items, "Mod rules: ", page, command.Prefix+command.Name)
+	return nil
+}
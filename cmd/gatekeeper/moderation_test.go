@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replaces the mod rules and the mod log for the duration of the test
+func withModRules(t *testing.T, rules []internal.ModRule) *FakeDiscordSession {
+	t.Setenv("GATEKEEPER_DISCORD_MOD_LOG_CHANNEL", "modlog")
+	modLogSession := &FakeDiscordSession{}
+	ModLog.Start(modLogSession)
+	ModRules.update(rules)
+	ModRules.recent = nil
+	t.Cleanup(func() {
+		ModRules.update(nil)
+		ModRules.recent = nil
+		ModLog.Start(nil)
+	})
+	return modLogSession
+}
+
+func TestCompileModRule(t *testing.T) {
+	invalid := []internal.ModRule{
+		{Kind: "phrase", Pattern: "buy followers", Action: "ban"},
+		{Kind: "phrase", Pattern: "buy followers", Action: "timeout"},
+		{Kind: "phrase", Pattern: "buy followers", Action: "timeout", TimeoutSeconds: MaxModTimeoutSeconds + 1},
+		{Kind: "phrase", Pattern: "  ", Action: "delete"},
+		{Kind: "regex", Pattern: "(", Action: "delete"},
+		{Kind: "domain", Pattern: ",", Action: "delete"},
+		{Kind: "caps", Pattern: "101", Action: "warn"},
+		{Kind: "repeat", Pattern: "1", Action: "warn"},
+		{Kind: "emoji", Pattern: "lots", Action: "warn"},
+		{Kind: "vibes", Pattern: "bad", Action: "warn"},
+	}
+	for _, rule := range invalid {
+		if _, err := compileModRule(rule); err == nil {
+			t.Errorf("%+v: expected to be rejected", rule)
+		}
+	}
+
+	rule, err := compileModRule(internal.ModRule{Kind: "links", Pattern: "github.com, www.YouTube.com", Action: "delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rule.Domains, ",") != "github.com,youtube.com" {
+		t.Errorf("unexpected domains %q", rule.Domains)
+	}
+}
+
+func TestModRuleMatches(t *testing.T) {
+	cases := []struct{
+		kind     string
+		pattern  string
+		text     string
+		emotes   int
+		expected bool
+	}{
+		{"phrase", "buy followers", "Wanna BUY FOLLOWERS cheap?", 0, true},
+		{"phrase", "buy followers", "I don't buy it", 0, false},
+		{"regex", `(?i)free\s+nitro`, "Free   Nitro here", 0, true},
+		{"domain", "bit.ly", "https://bit.ly/abcd", 0, true},
+		{"domain", "bit.ly", "https://sub.bit.ly/abcd", 0, true},
+		{"domain", "bit.ly", "https://notbit.ly/abcd", 0, false},
+		{"links", "github.com,youtube.com", "see https://github.com/tsoding/gatekeeper", 0, false},
+		{"links", "github.com,youtube.com", "see www.youtube.com/watch?v=dQw4w9WgXcQ", 0, false},
+		{"links", "github.com,youtube.com", "see https://github.com and https://example.com", 0, true},
+		{"links", "", "see https://github.com", 0, true},
+		{"links", "", "see main.go", 0, false},
+		{"caps", "70", "WHY IS THE STREAM SO LOUD", 0, true},
+		{"caps", "70", "Why is the stream so loud", 0, false},
+		// Too short to tell
+		{"caps", "70", "LOL OK", 0, false},
+		{"emoji", "3", "🔥🔥🔥🔥", 0, true},
+		{"emoji", "3", "🔥🔥🔥", 0, false},
+		{"emoji", "3", "<:tsodinSus:123456> <a:tsodinDance:654321> 🔥", 0, false},
+		{"emoji", "3", "Kappa Kappa Kappa Kappa", 4, true},
+	}
+	for _, c := range cases {
+		rule, err := compileModRule(internal.ModRule{Kind: c.kind, Pattern: c.pattern, Action: "log"})
+		if err != nil {
+			t.Fatalf("%s %q: %s", c.kind, c.pattern, err)
+		}
+		actual := rule.Matches(ModMessage{Text: c.text, Emotes: c.emotes}, 1)
+		if actual != c.expected {
+			t.Errorf("%s %q %q: expected %v, but got %v", c.kind, c.pattern, c.text, c.expected, actual)
+		}
+	}
+}
+
+func TestModRuleSetRepeat(t *testing.T) {
+	withModRules(t, []internal.ModRule{{Id: 1, Kind: "repeat", Pattern: "3", Action: "log"}})
+	now := time.Now()
+	msg := ModMessage{Platform: "twitch", Channel: "#tsoding", UserId: "twitch#rexim", Text: "first"}
+	other := ModMessage{Platform: "twitch", Channel: "#tsoding", UserId: "twitch#zozin", Text: "first"}
+
+	if len(ModRules.Match(msg, now)) != 0 || len(ModRules.Match(other, now)) != 0 || len(ModRules.Match(msg, now)) != 0 {
+		t.Fatalf("expected no matches before the third repeat")
+	}
+	if len(ModRules.Match(msg, now)) != 1 {
+		t.Errorf("expected the third repeat to match")
+	}
+	// The window is over
+	if len(ModRules.Match(msg, now.Add(ModRepeatWindow + time.Second))) != 0 {
+		t.Errorf("expected the repeats to be forgotten after the window")
+	}
+}
+
+func TestCountTwitchEmotes(t *testing.T) {
+	if count := countTwitchEmotes("25:0-4,12-16/1902:6-10"); count != 3 {
+		t.Errorf("expected 3 emotes, but got %d", count)
+	}
+	if count := countTwitchEmotes(""); count != 0 {
+		t.Errorf("expected no emotes, but got %d", count)
+	}
+}
+
+func TestModerateDiscordMessage(t *testing.T) {
+	withRoles(t, nil)
+	modLog := withModRules(t, []internal.ModRule{
+		{Id: 1, Kind: "phrase", Pattern: "free nitro", Action: "timeout", TimeoutSeconds: 600},
+	})
+	env, session := newFakeDiscordEnvironment("69")
+	removed := ModerateMessage(env, ModMessage{Platform: "discord", Channel: "test", UserId: "discord#69", Text: "Free Nitro <@420>"})
+	if !removed {
+		t.Fatalf("expected the message to be removed")
+	}
+	if len(session.Deleted) != 1 || session.Deleted[0] != "test 1000" {
+		t.Errorf("unexpected deleted messages %q", session.Deleted)
+	}
+	if len(session.Timeouts) != 1 || !strings.HasPrefix(session.Timeouts[0], "69 ") {
+		t.Errorf("unexpected timeouts %q", session.Timeouts)
+	}
+	expectMessages(t, session.Contents(), "<@69> your message was removed by the moderation rules")
+
+	if len(modLog.Messages) != 1 {
+		t.Fatalf("expected one report in the mod log, but got %d", len(modLog.Messages))
+	}
+	report := modLog.Messages[0]
+	if report.ChannelID != "modlog" || !strings.HasSuffix(report.Content, "-> deleted and timed out for 600s") {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.AllowedMentions.Users) != 0 || len(report.AllowedMentions.Parse) != 0 {
+		t.Errorf("expected the reports not to ping anybody")
+	}
+}
+
+func TestModerateDryRun(t *testing.T) {
+	withRoles(t, nil)
+	modLog := withModRules(t, []internal.ModRule{
+		{Id: 1, Kind: "phrase", Pattern: "free nitro", Action: "delete", DryRun: true},
+	})
+	env, session := newFakeDiscordEnvironment("69")
+	if ModerateMessage(env, ModMessage{Platform: "discord", Channel: "test", UserId: "discord#69", Text: "free nitro"}) {
+		t.Errorf("expected the dry run not to remove the message")
+	}
+	if len(session.Deleted) != 0 || len(session.Messages) != 0 {
+		t.Errorf("expected the dry run not to act")
+	}
+	if len(modLog.Messages) != 1 || !strings.HasPrefix(modLog.Messages[0].Content, "[dry run] ") {
+		t.Errorf("expected the dry run to be reported, but got %q", modLog.Contents())
+	}
+}
+
+func TestModerateExemptsModerators(t *testing.T) {
+	modLog := withModRules(t, []internal.ModRule{{Id: 1, Kind: "phrase", Pattern: "free nitro", Action: "warn"}})
+	env := &FakeEnvironment{PlatformName: "twitch", UserId: "69", Permission: PermissionModerator}
+	if ModerateMessage(env, ModMessage{Platform: "twitch", Text: "free nitro"}) || len(env.Messages) != 0 || len(modLog.Messages) != 0 {
+		t.Errorf("expected the moderators to be exempt")
+	}
+}
+
+func TestModerateTwitchFallsBackToWarning(t *testing.T) {
+	modLog := withModRules(t, []internal.ModRule{{Id: 1, Kind: "phrase", Pattern: "buy followers", Action: "timeout", TimeoutSeconds: 600}})
+	env := &FakeEnvironment{PlatformName: "twitch", Channel: "#tsoding", UserId: "69"}
+	if !ModerateMessage(env, ModMessage{Platform: "twitch", Channel: "#tsoding", UserId: "twitch#69", Text: "buy followers"}) {
+		t.Errorf("expected the message not to be processed any further")
+	}
+	expectMessages(t, env.Messages, "@69 please follow the rules of the chat")
+	if len(modLog.Messages) != 1 || !strings.HasSuffix(modLog.Messages[0].Content, "-> warned (timeout is not supported on twitch)") {
+		t.Errorf("unexpected reports %q", modLog.Contents())
+	}
+}
+
+func TestParseModAction(t *testing.T) {
+	cases := []struct{
+		source  string
+		action  string
+		seconds int
+		ok      bool
+	}{
+		{"delete", "delete", 0, true},
+		{"timeout", "timeout", DefaultModTimeoutSeconds, true},
+		{"Timeout:60", "timeout", 60, true},
+		{"timeout:soon", "", 0, false},
+		{"warn:60", "", 0, false},
+	}
+	for _, c := range cases {
+		action, seconds, ok := parseModAction(c.source)
+		if action != c.action || seconds != c.seconds || ok != c.ok {
+			t.Errorf("%q: expected (%q, %d, %v), but got (%q, %d, %v)", c.source, c.action, c.seconds, c.ok, action, seconds, ok)
+		}
+	}
+	if rest := skipField(skipField(" dry  delete   phrase  buy  followers ")); rest != "phrase  buy  followers" {
+		t.Errorf("unexpected rest %q", rest)
+	}
+}
+
+func TestModeratedTwitchMessageIsNotActivity(t *testing.T) {
+	withRoles(t, nil)
+	withModRules(t, []internal.ModRule{{Id: 1, Kind: "phrase", Pattern: "buy followers", Action: "delete"}})
+	twitchConn := newTwitchConn("gatekeeper", "", []string{"#tsoding"}, nil)
+
+	before := Activity.Count("twitch", "#tsoding")
+	for _, source := range []string{
+		"@badges=;id=1;user-id=69 :abc!abc@abc.tmi.twitch.tv PRIVMSG #tsoding :buy followers",
+		"@badges=;id=2;user-id=69 :abc!abc@abc.tmi.twitch.tv PRIVMSG #tsoding :hello",
+	} {
+		msg, ok := ParseIrcMsg(source)
+		if !ok {
+			t.Fatalf("could not parse %s", source)
+		}
+		twitchConn.handleChatMsg(nil, msg)
+	}
+	if got := Activity.Count("twitch", "#tsoding") - before; got != 1 {
+		t.Errorf("expected only the message that passed moderation to be counted, but got %d", got)
+	}
+}
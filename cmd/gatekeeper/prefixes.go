@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CommandPrefixesReloadInterval = 1 * time.Minute
+)
+
+var (
+	DefaultCommandPrefixes = []string{"$", "!"}
+	Prefixes = CommandPrefixes{}
+)
+
+// Live copy of the Command_Prefixes table
+type CommandPrefixes struct {
+	mutex sync.RWMutex
+	// Key is "<platform>#<channel>". Empty channel means the whole platform.
+	scopes map[string][]string
+	regexps map[string]*regexp.Regexp
+}
+
+func prefixesScope(platform string, channel string) string {
+	return platform + "#" + channel
+}
+
+func (prefixes *CommandPrefixes) Reload(db *sql.DB) error {
+	rows, err := internal.QueryCommandPrefixes(db)
+	if err != nil {
+		return err
+	}
+
+	scopes := map[string][]string{}
+	for _, row := range rows {
+		scope := prefixesScope(row.Platform, row.Channel)
+		scopes[scope] = append(scopes[scope], row.Prefix)
+	}
+
+	prefixes.mutex.Lock()
+	defer prefixes.mutex.Unlock()
+	prefixes.scopes = scopes
+	return nil
+}
+
+// Prefixes of the channel falling back to the prefixes of the whole
+// platform and then to the DefaultCommandPrefixes
+func (prefixes *CommandPrefixes) Lookup(platform string, channel string) []string {
+	prefixes.mutex.RLock()
+	defer prefixes.mutex.RUnlock()
+	if result, ok := prefixes.scopes[prefixesScope(platform, channel)]; ok {
+		return result
+	}
+	if result, ok := prefixes.scopes[prefixesScope(platform, "")]; ok {
+		return result
+	}
+	return DefaultCommandPrefixes
+}
+
+func (prefixes *CommandPrefixes) Regexp(set []string) *regexp.Regexp {
+	key := strings.Join(set, " ")
+
+	prefixes.mutex.RLock()
+	re, ok := prefixes.regexps[key]
+	prefixes.mutex.RUnlock()
+	if ok {
+		return re
+	}
+
+	quoted := []string{}
+	for _, prefix := range set {
+		quoted = append(quoted, regexp.QuoteMeta(prefix))
+	}
+	re = regexp.MustCompile("^ *("+strings.Join(quoted, "|")+") *"+CommandDef+"$")
+
+	prefixes.mutex.Lock()
+	defer prefixes.mutex.Unlock()
+	if prefixes.regexps == nil {
+		prefixes.regexps = map[string]*regexp.Regexp{}
+	}
+	prefixes.regexps[key] = re
+	return re
+}
+
+func PollCommandPrefixes(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	err := Prefixes.Reload(db)
+	if err != nil {
+		log.Println("Error loading command prefixes:", err)
+	}
+	go func() {
+		for {
+			time.Sleep(CommandPrefixesReloadInterval)
+			err := Prefixes.Reload(db)
+			if err != nil {
+				log.Println("Error reloading command prefixes:", err)
+			}
+		}
+	}()
+}
+
+func CommandPrefixesOfEnvironment(env CommandEnvironment) []string {
+	prefixes := Prefixes.Lookup(env.Platform(), env.ChannelID())
+	if discordEnv := env.AsDiscord(); discordEnv != nil {
+		if botId := discordEnv.BotID(); len(botId) > 0 {
+			// Mentioning the bot on Discord always works as a prefix
+			prefixes = append([]string{"<@"+botId+">", "<@!"+botId+">"}, prefixes...)
+		}
+	}
+	return prefixes
+}
+
+func parseCommandInEnvironment(env CommandEnvironment, source string) (Command, bool) {
+	return parseCommandWithPrefixes(source, CommandPrefixesOfEnvironment(env))
+}
+
+func EvalSetPrefixCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	prefixes := strings.Fields(command.Args)
+	if err := internal.VerifyCommandPrefixes(prefixes); err != nil {
+		env.Reply(err.Error())
+		return nil
+	}
+
+	err := internal.SetCommandPrefixes(db, env.Platform(), env.ChannelID(), prefixes)
+	if err != nil {
+		return fmt.Errorf("could not set prefixes of %s: %w", prefixesScope(env.Platform(), env.ChannelID()), err)
+	}
+	err = Prefixes.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload prefixes: %w", err)
+	}
+
+	if len(prefixes) == 0 {
+		env.Reply(fmt.Sprintf("Prefixes of this channel are reset to %s", strings.Join(Prefixes.Lookup(env.Platform(), env.ChannelID()), " ")))
+	} else {
+		env.Reply(fmt.Sprintf("Prefixes of this channel are set to %s", strings.Join(prefixes, " ")))
+	}
+	return nil
+}
@@ -59,10 +59,6 @@ type Reminder struct {
 	RemindAt time.Time
 }
 
-type DiscordSession interface {
-	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
-}
-
 func PollOverdueReminders(db *sql.DB, dg DiscordSession) {
 	go func() {
 		for {
@@ -74,9 +70,12 @@ func PollOverdueReminders(db *sql.DB, dg DiscordSession) {
 
 			successfullyFiredReminders := []int64{}
 			for _, reminder := range reminders {
-				_, err := dg.ChannelMessageSend(BotShrineChannelId, AtID(reminder.UserId) + " " + reminder.Message)
+				_, err := dg.ChannelMessageSendComplex(BotShrineChannelId, &discordgo.MessageSend{
+					Content: AtID(reminder.UserId) + " " + reminder.Message,
+					AllowedMentions: DiscordAllowedMentions(reminder.UserId),
+				})
 				if err != nil {
-					log.Printf("Error during sending discord message\n", err)
+					log.Println("Error during sending discord message", err)
 					continue
 				}
 				successfullyFiredReminders = append(successfullyFiredReminders, reminder.Id)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReminderArgs(t *testing.T) {
+	cases := []struct {
+		args     string
+		ok       bool
+		duration string
+		message  string
+	}{
+		{"1h30m touch grass", true, "1h30m", "touch grass"},
+		{"2d do the thing", true, "2d", "do the thing"},
+		{"1y2M3w4d5h6m7s   hi", true, "1y2M3w4d5h6m7s", "hi"},
+		{"touch grass", false, "", ""},
+		{"1h", false, "", ""},
+		{"1x touch grass", false, "", ""},
+	}
+	for _, c := range cases {
+		args := ReminderArgsRegexp.FindStringSubmatch(c.args)
+		if (args != nil) != c.ok {
+			t.Errorf("%q: expected ok=%v, but got %q", c.args, c.ok, args)
+			continue
+		}
+		if args == nil {
+			continue
+		}
+		if args[1] != c.duration || args[5] != c.message {
+			t.Errorf("%q: expected %q %q, but got %q %q", c.args, c.duration, c.message, args[1], args[5])
+		}
+	}
+}
+
+func TestParseReminderDelayStr(t *testing.T) {
+	delay, err := ParseReminderDelayStr("1y2M3w4d5h6m7s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ReminderDelay{Seconds: 7, Minutes: 6, Hours: 5, Days: 4, Weeks: 3, Months: 2, Years: 1}
+	if delay != expected {
+		t.Fatalf("expected %#v, but got %#v", expected, delay)
+	}
+
+	if _, err := ParseReminderDelayStr("99999999999s"); err == nil {
+		t.Fatalf("expected an overflow error")
+	}
+}
+
+func TestAddDelayToTimestamp(t *testing.T) {
+	now := time.Date(2000, time.January, 31, 0, 0, 0, 0, time.UTC)
+	delay, err := ParseReminderDelayStr("1h30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remindAt, err := AddDelayToTimestamp(now, delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remindAt.Equal(now.Add(90 * time.Minute)) {
+		t.Fatalf("unexpected %s", remindAt)
+	}
+	if s := DurationToString(now, remindAt); s != "1h30m" {
+		t.Fatalf("expected 1h30m, but got %s", s)
+	}
+}
+
+func TestDurationToString(t *testing.T) {
+	from := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		to       time.Time
+		expected string
+	}{
+		{from, "0s"},
+		{from.Add(59 * time.Second), "59s"},
+		{from.Add(25 * time.Hour), "1d1h"},
+		{from.AddDate(1, 1, 1), "1y1M1d"},
+		{from.Add(500 * time.Millisecond), "0s"},
+	}
+	for _, c := range cases {
+		if actual := DurationToString(from, c.to); actual != c.expected {
+			t.Errorf("%s: expected %s, but got %s", c.to, c.expected, actual)
+		}
+	}
+}
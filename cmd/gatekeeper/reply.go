@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+type ReplyStyle int
+
+const (
+	// Reply to the message of the command with the native means of the
+	// platform (Discord message references, Twitch reply threads)
+	ReplyNative ReplyStyle = iota
+	// Prefix the response with the mention of the author
+	ReplyMention
+)
+
+// Reply style of the platform from GATEKEEPER_<PLATFORM>_REPLY_STYLE.
+// Either "native" (the default) or "mention".
+func ReplyStyleOfPlatform(platform string) ReplyStyle {
+	envar := "GATEKEEPER_" + strings.ToUpper(platform) + "_REPLY_STYLE"
+	switch style := os.Getenv(envar); style {
+	case "", "native":
+		return ReplyNative
+	case "mention":
+		return ReplyMention
+	default:
+		log.Printf("Unknown %s %q. Expected native or mention. Falling back to native.\n", envar, style)
+		return ReplyNative
+	}
+}
+
+// The message prefixed with the mention of the author if there is one.
+// The fallback for the environments that can't reply natively.
+func withAuthorMention(env CommandEnvironment, message string) string {
+	if atAuthor := env.AtAuthor(); len(atAuthor) > 0 {
+		return atAuthor + " " + message
+	}
+	return message
+}
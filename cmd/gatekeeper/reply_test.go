@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiscordNativeReply(t *testing.T) {
+	t.Setenv("GATEKEEPER_DISCORD_REPLY_STYLE", "")
+	env, session := newFakeDiscordEnvironment("69")
+	env.Reply("hello")
+	if len(session.Messages) != 1 || session.Messages[0].Content != "hello" || session.Messages[0].ReplyTo != "1000" {
+		t.Fatalf("expected a native reply to 1000, but got %#v", session.Messages)
+	}
+}
+
+func TestDiscordMentionReply(t *testing.T) {
+	t.Setenv("GATEKEEPER_DISCORD_REPLY_STYLE", "mention")
+	env, session := newFakeDiscordEnvironment("69")
+	env.Reply("hello")
+	if len(session.Messages) != 1 || session.Messages[0].Content != "<@69> hello" || session.Messages[0].ReplyTo != "" {
+		t.Fatalf("expected a mention, but got %#v", session.Messages)
+	}
+}
+
+func TestDiscordReplyWithoutMessage(t *testing.T) {
+	// For instance, the environments of the timers
+	env, session := newFakeDiscordEnvironment("69")
+	env.m.ID = ""
+	env.m.Author = nil
+	env.Reply("hello")
+	if len(session.Messages) != 1 || session.Messages[0].Content != "hello" || session.Messages[0].ReplyTo != "" {
+		t.Fatalf("expected a plain message, but got %#v", session.Messages)
+	}
+}
+
+func TestReplyStyleOfPlatform(t *testing.T) {
+	cases := map[string]ReplyStyle{
+		"":        ReplyNative,
+		"native":  ReplyNative,
+		"mention": ReplyMention,
+		"bogus":   ReplyNative,
+	}
+	for value, expected := range cases {
+		t.Setenv("GATEKEEPER_TWITCH_REPLY_STYLE", value)
+		if actual := ReplyStyleOfPlatform("twitch"); actual != expected {
+			t.Errorf("%q: expected %d, but got %d", value, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/tsoding/gatekeeper/internal"
+	"strings"
+)
+
+// https://discord.com/developers/docs/resources/channel#embed-object-embed-limits
+const (
+	DiscordEmbedTitleLimit = 256
+	DiscordEmbedDescriptionLimit = 4096
+	DiscordEmbedFieldsLimit = 25
+	DiscordEmbedFieldNameLimit = 256
+	DiscordEmbedFieldValueLimit = 1024
+)
+
+func truncateRunes(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// Discord does not allow empty names and values of the fields
+func nonEmptyEmbedText(s string) string {
+	if len(s) == 0 {
+		return "​"
+	}
+	return s
+}
+
+func DiscordEmbedOfRichMessage(message internal.RichMessage) *discordgo.MessageEmbed {
+	description := []string{}
+	if len(message.Text) > 0 {
+		description = append(description, message.Text)
+	}
+	if len(message.Items) > 0 {
+		description = append(description, strings.Join(message.ItemLines(), "\n"))
+	}
+	if len(message.Code) > 0 {
+		// A zero width space so the code can't close the block early
+		description = append(description, "```\n"+strings.ReplaceAll(message.Code, "```", "`​``")+"\n```")
+	}
+	for _, link := range message.Links {
+		if len(link.Text) > 0 {
+			description = append(description, "["+link.Text+"]("+link.URL+")")
+		} else {
+			description = append(description, link.URL)
+		}
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title: truncateRunes(message.Title, DiscordEmbedTitleLimit),
+		Description: truncateRunes(strings.Join(description, "\n\n"), DiscordEmbedDescriptionLimit),
+	}
+	for i, field := range message.Fields {
+		if i >= DiscordEmbedFieldsLimit {
+			break
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name: nonEmptyEmbedText(truncateRunes(field.Name, DiscordEmbedFieldNameLimit)),
+			Value: nonEmptyEmbedText(truncateRunes(field.Value, DiscordEmbedFieldValueLimit)),
+		})
+	}
+	return embed
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"strings"
+	"testing"
+)
+
+func TestDiscordEmbedOfRichMessage(t *testing.T) {
+	embed := DiscordEmbedOfRichMessage(internal.RichMessage{
+		Title: "Title",
+		Text: "Text",
+		Fields: []internal.RichField{{Name: "", Value: "value"}},
+		Items: []string{"a", "b"},
+		Code: "int main() {}\n```",
+		Links: []internal.RichLink{{Text: "Docs", URL: "https://example.com"}},
+	})
+	if embed.Title != "Title" {
+		t.Errorf("unexpected title %q", embed.Title)
+	}
+	expected := "Text\n\n• a\n• b\n\n```\nint main() {}\n`​``\n```\n\n[Docs](https://example.com)"
+	if embed.Description != expected {
+		t.Errorf("expected description %q, but got %q", expected, embed.Description)
+	}
+	if len(embed.Fields) != 1 || embed.Fields[0].Name != "​" || embed.Fields[0].Value != "value" {
+		t.Errorf("unexpected fields %#v", embed.Fields)
+	}
+}
+
+func TestDiscordEmbedLimits(t *testing.T) {
+	message := internal.RichMessage{Title: strings.Repeat("x", 1000)}
+	for i := 0; i < 30; i += 1 {
+		message.Fields = append(message.Fields, internal.RichField{Name: "name", Value: "value"})
+	}
+	embed := DiscordEmbedOfRichMessage(message)
+	if len([]rune(embed.Title)) != DiscordEmbedTitleLimit || len(embed.Fields) != DiscordEmbedFieldsLimit {
+		t.Fatalf("the embed exceeds the limits: title %d, fields %d", len([]rune(embed.Title)), len(embed.Fields))
+	}
+}
+
+func TestRichMessageOnDiscord(t *testing.T) {
+	withRoles(t, nil)
+	t.Setenv("GATEKEEPER_DISCORD_REPLY_STYLE", "")
+	env, session := newFakeDiscordEnvironment("69")
+	evalTestCommand(t, env, `!eval rich(rich_title("Hello"), rich_item("a"))`)
+	env.ReplyRich(internal.RichMessage{Title: "Reply"})
+	evalTestCommand(t, env, `!uwu !eval rich(rich_title("hello"))`)
+
+	if len(session.Messages) != 3 {
+		t.Fatalf("expected 3 messages, but got %#v", session.Messages)
+	}
+	for _, message := range session.Messages {
+		if len(message.Content) != 0 || len(message.Embeds) != 1 {
+			t.Fatalf("expected a single embed, but got %#v", message)
+		}
+	}
+	if session.Messages[0].Embeds[0].Title != "Hello" || session.Messages[0].Embeds[0].Description != "• a" || session.Messages[0].ReplyTo != "" {
+		t.Errorf("unexpected message %#v", session.Messages[0].Embeds[0])
+	}
+	if session.Messages[1].Embeds[0].Title != "Reply" || session.Messages[1].ReplyTo != "1000" {
+		t.Errorf("expected a native reply, but got %#v", session.Messages[1])
+	}
+	if title := session.Messages[2].Embeds[0].Title; title != internal.UwuTransform.Apply("discord", "hello") {
+		t.Errorf("expected the transformed title, but got %q", title)
+	}
+}
+
+func TestRichMessageOnTwitch(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	env.ReplyRich(internal.RichMessage{Title: "Timers", Items: []string{"a", "b"}})
+	expectMessages(t, env.Messages, "@alice Timers | a, b")
+}
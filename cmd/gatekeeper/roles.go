@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RolesReloadInterval = 1 * time.Minute
+
+var (
+	Roles = UserRoles{}
+	DiscordMentionRegexp = regexp.MustCompile("^<@!?([0-9]+)>$")
+)
+
+func PermissionOfRole(role internal.Role) Permission {
+	switch role {
+	case internal.RoleOwner:     return PermissionOwner
+	case internal.RoleAdmin:     return PermissionAdmin
+	case internal.RoleModerator: return PermissionModerator
+	case internal.RoleTrusted:   return PermissionTrusted
+	default:                     return PermissionEveryone
+	}
+}
+
+// Live copy of the Roles table
+type UserRoles struct {
+	mutex sync.RWMutex
+	// Key is the UniversalPlatformAgnosticUserID()
+	permissions map[string]Permission
+	// In the order they were granted the role
+	owners []string
+}
+
+// Owners from GATEKEEPER_OWNERS. They are the owners regardless of
+// what's in the database, so the bot can be bootstrapped and can't
+// lose all of its owners.
+func ownersFromEnv() []string {
+	owners := []string{}
+	for _, owner := range strings.Split(os.Getenv("GATEKEEPER_OWNERS"), ",") {
+		owner = strings.TrimSpace(owner)
+		if strings.HasPrefix(owner, "twitch#") {
+			log.Printf("Ignoring owner %s in GATEKEEPER_OWNERS. Twitch users must be referred to by their stable id, for example twitch-id#110240192\n", owner)
+			continue
+		}
+		if len(owner) > 0 {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+func (roles *UserRoles) update(userRoles []internal.UserRole) {
+	permissions := map[string]Permission{}
+	owners := []string{}
+	for _, owner := range ownersFromEnv() {
+		permissions[owner] = PermissionOwner
+		owners = append(owners, owner)
+	}
+	for _, userRole := range userRoles {
+		permission := PermissionOfRole(userRole.Role)
+		if permission > permissions[userRole.UserId] {
+			permissions[userRole.UserId] = permission
+		}
+		if permission == PermissionOwner {
+			owners = append(owners, userRole.UserId)
+		}
+	}
+
+	roles.mutex.Lock()
+	defer roles.mutex.Unlock()
+	roles.permissions = permissions
+	roles.owners = owners
+}
+
+func (roles *UserRoles) Reload(db *sql.DB) error {
+	userRoles, err := internal.QueryRoles(db)
+	if err != nil {
+		return err
+	}
+	roles.update(userRoles)
+	return nil
+}
+
+func (roles *UserRoles) Permission(userId string) Permission {
+	roles.mutex.RLock()
+	defer roles.mutex.RUnlock()
+	return roles.permissions[userId]
+}
+
+// The most powerful permission among all the identities linked to the user
+func (roles *UserRoles) PermissionOfUser(userId string) Permission {
+	permission := PermissionEveryone
+	if len(userId) == 0 {
+		return permission
+	}
+	for _, id := range Identities.Group(userId) {
+		if p := roles.Permission(id); p > permission {
+			permission = p
+		}
+	}
+	return permission
+}
+
+func (roles *UserRoles) HasOwners() bool {
+	roles.mutex.RLock()
+	defer roles.mutex.RUnlock()
+	return len(roles.owners) > 0
+}
+
+// Platform-specific id of the first owner on the platform
+func (roles *UserRoles) OwnerOn(platform string) (string, bool) {
+	roles.mutex.RLock()
+	defer roles.mutex.RUnlock()
+	for _, owner := range roles.owners {
+		if strings.HasPrefix(owner, platform+"#") {
+			return strings.TrimPrefix(owner, platform+"#"), true
+		}
+	}
+	return "", false
+}
+
+// Without the owners nobody can grant any roles
+func warnIfNoOwners() {
+	if !Roles.HasOwners() {
+		log.Println("WARNING: ==========================================================")
+		log.Println("WARNING: No owners are configured. Nobody can grant any roles.")
+		log.Println("WARNING: Set GATEKEEPER_OWNERS or run `gaslighter role` to add one.")
+		log.Println("WARNING: ==========================================================")
+	}
+}
+
+func PollRoles(db *sql.DB) {
+	if db == nil {
+		Roles.update(nil)
+		warnIfNoOwners()
+		return
+	}
+	err := Roles.Reload(db)
+	if err != nil {
+		log.Println("Error loading roles:", err)
+		Roles.update(nil)
+	}
+	warnIfNoOwners()
+	go func() {
+		for {
+			time.Sleep(RolesReloadInterval)
+			err := Roles.Reload(db)
+			if err != nil {
+				log.Println("Error reloading roles:", err)
+			}
+		}
+	}()
+}
+
+// Turns a reference to a user from a chat message into its
+// UniversalPlatformAgnosticUserID(). Accepts Discord mentions, Twitch
+// handles (in Twitch chat) and universal ids like "twitch#tsoding". The
+// Twitch nicknames are resolved into the stable ids when the users are
+// known.
+func parseUserReference(env CommandEnvironment, ref string) (string, bool) {
+	if matches := DiscordMentionRegexp.FindStringSubmatch(ref); len(matches) > 0 {
+		return "discord#" + matches[1], true
+	}
+	if strings.HasPrefix(ref, "twitch#") {
+		return twitchUserIdOfLogin(strings.TrimPrefix(ref, "twitch#")), true
+	}
+	if strings.Contains(ref, "#") {
+		return ref, true
+	}
+	if env.Platform() == "twitch" {
+		handle := strings.TrimPrefix(ref, "@")
+		if len(handle) > 0 {
+			return twitchUserIdOfLogin(handle), true
+		}
+	}
+	return "", false
+}
+
+// Owners can grant any role. Everybody else can only grant the roles
+// below their own.
+func canManageRole(env CommandEnvironment, role internal.Role) bool {
+	if env.HasPermission(PermissionOwner) {
+		return true
+	}
+	return env.HasPermission(PermissionOfRole(role) + 1)
+}
+
+func parseRoleArgs(env CommandEnvironment, args string) (internal.Role, string, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("Expected a role and a user")
+	}
+	role, err := internal.ParseRole(fields[0])
+	if err != nil {
+		return "", "", err
+	}
+	userId, ok := parseUserReference(env, fields[1])
+	if !ok {
+		return "", "", fmt.Errorf("Could not recognize user `%s`. Mention them or use platform#id.", fields[1])
+	}
+	return role, userId, nil
+}
+
+func EvalGrantCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	role, userId, err := parseRoleArgs(env, command.Args)
+	if err != nil {
+		env.Reply(err.Error())
+		return nil
+	}
+	if !canManageRole(env, role) {
+		env.Reply(fmt.Sprintf("You are not allowed to grant the %s role", role))
+		return nil
+	}
+
+	err = internal.GrantRole(db, userId, role)
+	if err != nil {
+		return fmt.Errorf("could not grant role %s to %s: %w", role, userId, err)
+	}
+	err = Roles.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload roles: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Granted the %s role to %s", role, userId))
+	return nil
+}
+
+func EvalRevokeCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	role, userId, err := parseRoleArgs(env, command.Args)
+	if err != nil {
+		env.Reply(err.Error())
+		return nil
+	}
+	if !canManageRole(env, role) {
+		env.Reply(fmt.Sprintf("You are not allowed to revoke the %s role", role))
+		return nil
+	}
+
+	revoked, err := internal.RevokeRole(db, userId, role)
+	if err != nil {
+		return fmt.Errorf("could not revoke role %s from %s: %w", role, userId, err)
+	}
+	if !revoked {
+		env.Reply(fmt.Sprintf("%s does not have the %s role", userId, role))
+		return nil
+	}
+	err = Roles.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload roles: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Revoked the %s role from %s", role, userId))
+	return nil
+}
+
+func EvalRolesCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	userRoles, err := internal.QueryRoles(db)
+	if err != nil {
+		return fmt.Errorf("could not query roles: %w", err)
+	}
+
+	items := []string{}
+	for _, owner := range ownersFromEnv() {
+		items = append(items, fmt.Sprintf("%s (%s)", owner, internal.RoleOwner))
+	}
+	for _, userRole := range userRoles {
+		items = append(items, fmt.Sprintf("%s (%s)", userRole.UserId, userRole.Role))
+	}
+
+	_, page := splitPageArg(command.Args)
+	sendPage(env, items, "Roles: ", page, command.Prefix+command.Name)
+	return nil
+}
@@ -16,7 +16,7 @@ type Song struct {
 func LogSong(db *sql.DB, song Song) {
 	_, err := db.Exec("INSERT INTO Song_Log (artist, title, link) VALUES ($1, $2, $3)", song.artist, song.title, song.link);
 	if err != nil {
-		log.Println("ERROR: LogSong: could not insert element %#v: %s", song, err);
+		log.Printf("ERROR: LogSong: could not insert element %#v: %s\n", song, err);
 		return
 	}
 }
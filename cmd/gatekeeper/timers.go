@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TimerPollInterval = 30 * time.Second
+	MinimumTimerIntervalMinutes = 5
+	MaxTimersPerChannel = 10
+)
+
+var Activity = ChatActivity{}
+
+// Counts chat messages per channel so the timers don't post into a
+// dead chat. The counters only grow. Each timer remembers the value of
+// the counter at the moment it fired.
+type ChatActivity struct {
+	mutex sync.Mutex
+	// Key is "<platform>#<channel>"
+	messages map[string]int
+}
+
+func chatActivityKey(platform string, channel string) string {
+	return platform + "#" + channel
+}
+
+func (activity *ChatActivity) Record(platform string, channel string) {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	if activity.messages == nil {
+		activity.messages = map[string]int{}
+	}
+	activity.messages[chatActivityKey(platform, channel)] += 1
+}
+
+func (activity *ChatActivity) Count(platform string, channel string) int {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	return activity.messages[chatActivityKey(platform, channel)]
+}
+
+// Environment of the timers on Discord. Has no author, so it can't
+// pass any permission checks.
+func discordTimerEnvironment(dg *discordgo.Session, channelId string) *DiscordEnvironment {
+	return &DiscordEnvironment{
+		dg: dg,
+		m: &discordgo.MessageCreate{
+			Message: &discordgo.Message{
+				ChannelID: channelId,
+			},
+		},
+	}
+}
+
+func timerCommand(timer internal.Timer) Command {
+	return Command{
+		Name: timer.CommandName,
+		Args: timer.CommandArgs,
+	}
+}
+
+// Returns false if the timer could not be fired right now and should be retried later
+func fireTimer(db *sql.DB, dg *discordgo.Session, tw *TwitchConn, irc *IrcNetworkConn, timer internal.Timer) bool {
+	switch timer.Platform {
+	case "discord":
+		if dg == nil {
+			return false
+		}
+		EvalCommand(db, timerCommand(timer), discordTimerEnvironment(dg, timer.Channel))
+		return true
+	case "twitch":
+		if tw == nil {
+			return false
+		}
+		// The Twitch connection is owned by its own goroutine. If it's
+		// busy or reconnecting we just try again on the next poll.
+		select {
+		case tw.Timers <- timer:
+			return true
+		default:
+			return false
+		}
+	case "irc":
+		if irc == nil {
+			return false
+		}
+		select {
+		case irc.Timers <- timer:
+			return true
+		default:
+			return false
+		}
+	default:
+		log.Printf("Timer %d has unknown platform %s\n", timer.Id, timer.Platform)
+		return false
+	}
+}
+
+func PollTimers(db *sql.DB, dg *discordgo.Session, tw *TwitchConn, irc *IrcNetworkConn) {
+	if db == nil {
+		return
+	}
+	go func() {
+		// Value of the chat activity counter of the channel at the
+		// moment the timer fired. Key is the id of the timer.
+		firedAtActivity := map[int64]int{}
+		for {
+			time.Sleep(TimerPollInterval)
+
+			timers, err := internal.QueryAllTimers(db)
+			if err != nil {
+				log.Println("Error querying timers:", err)
+				continue
+			}
+
+			now := time.Now()
+			for _, timer := range timers {
+				if !timer.IsDue(now) {
+					continue
+				}
+
+				if timer.Platform == "twitch" {
+					// Without the custom commands the timer would end up
+					// running a builtin or complaining about the command
+					settings := TwitchChannels.Settings(timer.Channel)
+					if !settings.Timers || !settings.CustomCommands {
+						continue
+					}
+				}
+
+				activity := Activity.Count(timer.Platform, timer.Channel)
+				if activity - firedAtActivity[timer.Id] < timer.MinChatMessages {
+					continue
+				}
+
+				// Timers are only allowed to run custom commands. If
+				// the command was deleted we don't want to fall back
+				// to a builtin with the same name.
+				_, exists, err := internal.QueryCustomCommand(db, timer.CommandName)
+				if err != nil {
+					log.Printf("Error querying command %s of timer %d: %s\n", timer.CommandName, timer.Id, err)
+					continue
+				}
+				if !exists {
+					continue
+				}
+
+				if !fireTimer(db, dg, tw, irc, timer) {
+					continue
+				}
+
+				firedAtActivity[timer.Id] = activity
+				err = internal.MarkTimerFired(db, timer.Id, now)
+				if err != nil {
+					log.Printf("Error marking timer %d as fired: %s\n", timer.Id, err)
+				}
+			}
+		}
+	}()
+}
+
+func EvalAddTimerCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	usage := "Usage: addtimer <interval-minutes> <min-chat-messages> <command> [args]"
+
+	if !customCommandsEnabled(env) {
+		env.Reply("Custom commands are disabled in this channel. Timers can only run custom commands")
+		return nil
+	}
+
+	args := strings.SplitN(strings.TrimSpace(command.Args), " ", 3)
+	if len(args) < 3 {
+		env.Reply(usage)
+		return nil
+	}
+
+	interval, err := strconv.Atoi(args[0])
+	if err != nil {
+		env.Reply(usage)
+		return nil
+	}
+	if interval < MinimumTimerIntervalMinutes {
+		env.Reply(fmt.Sprintf("Interval must be at least %d minutes", MinimumTimerIntervalMinutes))
+		return nil
+	}
+
+	minChatMessages, err := strconv.Atoi(args[1])
+	if err != nil || minChatMessages < 0 {
+		env.Reply(usage)
+		return nil
+	}
+
+	matches := CommandNoPrefixRegexp.FindStringSubmatch(args[2])
+	if len(matches) == 0 {
+		env.Reply(usage)
+		return nil
+	}
+	name := matches[1]
+	commandArgs := matches[3]
+
+	_, exists, err := internal.QueryCustomCommand(db, name)
+	if err != nil {
+		return fmt.Errorf("could not query command %s: %w", name, err)
+	}
+	if !exists {
+		env.Reply(fmt.Sprintf("Custom command %s does not exist. Timers can only run custom commands", name))
+		return nil
+	}
+
+	timers, err := internal.QueryChannelTimers(db, env.Platform(), env.ChannelID())
+	if err != nil {
+		return fmt.Errorf("could not query timers: %w", err)
+	}
+	if len(timers) >= MaxTimersPerChannel {
+		env.Reply(fmt.Sprintf("This channel may have %d timers maximum", MaxTimersPerChannel))
+		return nil
+	}
+
+	id, err := internal.InsertTimer(db, internal.Timer{
+		Platform:        env.Platform(),
+		Channel:         env.ChannelID(),
+		CommandName:     name,
+		CommandArgs:     commandArgs,
+		IntervalMinutes: interval,
+		MinChatMessages: minChatMessages,
+	})
+	if err != nil {
+		return fmt.Errorf("could not add timer: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Timer %d is added", id))
+	return nil
+}
+
+func EvalDelTimerCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	id, err := strconv.ParseInt(strings.TrimSpace(command.Args), 10, 64)
+	if err != nil {
+		env.Reply("Usage: deltimer <id>")
+		return nil
+	}
+
+	deleted, err := internal.DeleteChannelTimer(db, env.Platform(), env.ChannelID(), id)
+	if err != nil {
+		return fmt.Errorf("could not delete timer %d: %w", id, err)
+	}
+	if !deleted {
+		env.Reply(fmt.Sprintf("Timer %d does not exist in this channel", id))
+		return nil
+	}
+
+	env.Reply(fmt.Sprintf("Timer %d is deleted", id))
+	return nil
+}
+
+func EvalTimersCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	timers, err := internal.QueryChannelTimers(db, env.Platform(), env.ChannelID())
+	if err != nil {
+		return fmt.Errorf("could not query timers: %w", err)
+	}
+	if len(timers) == 0 {
+		env.Reply("This channel has no timers")
+		return nil
+	}
+
+	message := internal.RichMessage{Title: "Timers of this channel"}
+	for _, timer := range timers {
+		item := fmt.Sprintf("%d. %s every %s", timer.Id, strings.TrimSpace(timer.CommandName+" "+timer.CommandArgs), granum(timer.IntervalMinutes, "minute", "minutes"))
+		if timer.MinChatMessages > 0 {
+			item += fmt.Sprintf(" after %s", granum(timer.MinChatMessages, "message", "messages"))
+		}
+		message.Items = append(message.Items, item)
+	}
+	env.ReplyRich(message)
+	return nil
+}
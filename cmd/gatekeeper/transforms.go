@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/tsoding/gatekeeper/internal"
+	"strings"
+)
+
+// Applies the transform to all the messages sent through it
+type TransformEnvironment struct {
+	InnerEnv CommandEnvironment
+	Transform internal.Transform
+}
+
+func (env *TransformEnvironment) UniversalPlatformAgnosticUserID() string {
+	return env.InnerEnv.UniversalPlatformAgnosticUserID()
+}
+
+func (env *TransformEnvironment) AsDiscord() *DiscordEnvironment {
+	return env.InnerEnv.AsDiscord()
+}
+
+func (env *TransformEnvironment) Platform() string {
+	return env.InnerEnv.Platform()
+}
+
+func (env *TransformEnvironment) ChannelID() string {
+	return env.InnerEnv.ChannelID()
+}
+
+func (env *TransformEnvironment) AtAdmin() string {
+	return env.InnerEnv.AtAdmin()
+}
+
+func (env *TransformEnvironment) AtAuthor() string {
+	return env.InnerEnv.AtAuthor()
+}
+
+func (env *TransformEnvironment) HasPermission(permission Permission) bool {
+	return env.InnerEnv.HasPermission(permission)
+}
+
+func (env *TransformEnvironment) SendMessage(message string) {
+	env.InnerEnv.SendMessage(env.Transform.Apply(env.Platform(), message))
+}
+
+func (env *TransformEnvironment) Reply(message string) {
+	env.InnerEnv.Reply(env.Transform.Apply(env.Platform(), message))
+}
+
+func (env *TransformEnvironment) applyRich(message internal.RichMessage) internal.RichMessage {
+	return message.MapText(func(text string) string {
+		return env.Transform.Apply(env.Platform(), text)
+	})
+}
+
+func (env *TransformEnvironment) SendRichMessage(message internal.RichMessage) {
+	env.InnerEnv.SendRichMessage(env.applyRich(message))
+}
+
+func (env *TransformEnvironment) ReplyRich(message internal.RichMessage) {
+	env.InnerEnv.ReplyRich(env.applyRich(message))
+}
+
+// Wraps the output of the command or the text into the transform. The
+// names of other transforms at the beginning of the arguments are
+// chained, so `!cyril fancy !carrot` is fancy then cyrillified carrot.
+func EvalTransformCommand(db *sql.DB, command Command, env CommandEnvironment, transform internal.Transform) error {
+	var transformed CommandEnvironment = &TransformEnvironment{
+		InnerEnv: env,
+		Transform: transform,
+	}
+
+	args := strings.TrimSpace(command.Args)
+	for {
+		fields := strings.SplitN(args, " ", 2)
+		next, ok := internal.FindTransform(fields[0])
+		if !ok || len(fields) < 2 {
+			break
+		}
+		transformed = &TransformEnvironment{
+			InnerEnv: transformed,
+			Transform: next,
+		}
+		args = strings.TrimSpace(fields[1])
+	}
+
+	innerCommand, ok := parseCommandInEnvironment(env, args)
+	if !ok {
+		transformed.SendMessage(args)
+		return nil
+	}
+	EvalCommand(db, innerCommand, transformed)
+	return nil
+}
+
+func transformBuiltin(transform internal.Transform) BuiltinCommand {
+	return BuiltinCommand{
+		Name: transform.Name,
+		Usage: "[transforms...] <text or command>",
+		Description: transform.Description,
+		Run: func(db *sql.DB, command Command, env CommandEnvironment, context internal.EvalContext) error {
+			return EvalTransformCommand(db, command, env, transform)
+		},
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"testing"
+)
+
+func TestCyrilText(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!cyril hello @bob world")
+	expectMessages(t, env.Messages, "нёllф @bob шфгld")
+}
+
+func TestCyrilCommand(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!cyril !version")
+	expectMessages(t, env.Messages, "@alice "+internal.Cyrillify(Commit))
+}
+
+func TestChainedTransforms(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!reverse uwu !edlimit")
+	// The mention of the author is added by the reply itself after the transforms
+	inner := "Line Count: 6, Line Size: 101"
+	expected := "@alice " + internal.ReverseTransform.Apply("twitch", internal.UwuTransform.Apply("twitch", inner))
+	expectMessages(t, env.Messages, expected)
+}
+
+func TestTransformNameAsText(t *testing.T) {
+	// A lone transform name is the text, not a transform
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!leet fancy")
+	expectMessages(t, env.Messages, "f4ncy")
+}
+
+func TestTransformKeepsPermissions(t *testing.T) {
+	env := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, env, "!cyril !profile !edlimit")
+	expectMessages(t, env.Messages, "@alice "+internal.Cyrillify("This command requires the admin role"))
+}
+
+func TestSpoilerOnDiscord(t *testing.T) {
+	withRoles(t, nil)
+	env, session := newFakeDiscordEnvironment("69")
+	evalTestCommand(t, env, "!spoiler a||b")
+	expectMessages(t, session.Contents(), "||a|​|b||")
+
+	twitch := newFakeEnvironment("twitch", "alice")
+	evalTestCommand(t, twitch, "!spoiler a||b")
+	expectMessages(t, twitch.Messages, "a||b")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TriggersReloadInterval = 1 * time.Minute
+	TriggerRegexSizeLimit = 256
+	DefaultTriggerCooldownSeconds = 60
+	// How many triggers may fire in response to a single message
+	MaxTriggersPerMessage = 1
+)
+
+var Triggers = TriggerSet{}
+
+type CompiledTrigger struct {
+	internal.Trigger
+	Regexp *regexp.Regexp
+	Exprs []internal.Expr
+}
+
+// Live copy of the Triggers table
+type TriggerSet struct {
+	mutex sync.Mutex
+	triggers []CompiledTrigger
+	// Key is "<trigger id>#<platform>#<channel>". Cooldowns are per channel.
+	lastFired map[string]time.Time
+}
+
+func compileTrigger(trigger internal.Trigger) (CompiledTrigger, error) {
+	re, err := regexp.Compile(trigger.Regex)
+	if err != nil {
+		return CompiledTrigger{}, fmt.Errorf("could not compile regexp `%s`: %w", trigger.Regex, err)
+	}
+	exprs, err := internal.ParseAllExprs(trigger.Bex)
+	if err != nil {
+		return CompiledTrigger{}, fmt.Errorf("could not parse bex `%s`: %w", trigger.Bex, err)
+	}
+	return CompiledTrigger{
+		Trigger: trigger,
+		Regexp: re,
+		Exprs: exprs,
+	}, nil
+}
+
+func (set *TriggerSet) Reload(db *sql.DB) error {
+	rows, err := internal.QueryTriggers(db)
+	if err != nil {
+		return err
+	}
+
+	triggers := []CompiledTrigger{}
+	for _, row := range rows {
+		trigger, err := compileTrigger(row)
+		if err != nil {
+			log.Printf("Skipping trigger %d: %s\n", row.Id, err)
+			continue
+		}
+		triggers = append(triggers, trigger)
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	set.triggers = triggers
+	return nil
+}
+
+// Picks the triggers matching the message that are not on cooldown in
+// the channel and puts them on cooldown
+func (set *TriggerSet) Match(platform string, channel string, message string, now time.Time) []CompiledTrigger {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if set.lastFired == nil {
+		set.lastFired = map[string]time.Time{}
+	}
+
+	matched := []CompiledTrigger{}
+	for _, trigger := range set.triggers {
+		if len(matched) >= MaxTriggersPerMessage {
+			break
+		}
+		if !trigger.Regexp.MatchString(message) {
+			continue
+		}
+		key := fmt.Sprintf("%d#%s#%s", trigger.Id, platform, channel)
+		if lastFired, ok := set.lastFired[key]; ok && now.Before(lastFired.Add(trigger.Cooldown())) {
+			continue
+		}
+		set.lastFired[key] = now
+		matched = append(matched, trigger)
+	}
+	return matched
+}
+
+func PollTriggers(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	err := Triggers.Reload(db)
+	if err != nil {
+		log.Println("Error loading triggers:", err)
+	}
+	go func() {
+		for {
+			time.Sleep(TriggersReloadInterval)
+			err := Triggers.Reload(db)
+			if err != nil {
+				log.Println("Error reloading triggers:", err)
+			}
+		}
+	}()
+}
+
+// Evaluates the triggers against a message that is not a command. The
+// message is available to the bex of the trigger via input().
+func EvalTriggers(env CommandEnvironment, message string) {
+	// The triggers are global, so they are a part of the custom
+	// commands of the channel
+	if !customCommandsEnabled(env) {
+		return
+	}
+	for _, trigger := range Triggers.Match(env.Platform(), env.ChannelID(), message, time.Now()) {
+		context := EvalContextFromCommandEnvironment(env, Command{Args: message}, 0)
+		for _, expr := range trigger.Exprs {
+			_, err := context.EvalExpr(expr)
+			if err != nil {
+				// Not reporting it to the chat, because nobody asked the bot for anything
+				log.Printf("Error while evaluating trigger %d: %s\n", trigger.Id, err)
+				break
+			}
+		}
+	}
+}
+
+func EvalAddTriggerCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	usage := "Usage: addtrigger \"<regexp>\" [cooldown-seconds] <bex>"
+
+	restRunes, regexExpr, err := internal.ParseExpr([]rune(command.Args))
+	if err != nil || regexExpr.Type != internal.ExprStr {
+		env.Reply(usage)
+		return nil
+	}
+
+	trigger := internal.Trigger{
+		Regex: regexExpr.AsStr,
+		CooldownSeconds: DefaultTriggerCooldownSeconds,
+	}
+	if len(trigger.Regex) > TriggerRegexSizeLimit {
+		env.Reply(fmt.Sprintf("Regexp must be max %d bytes long", TriggerRegexSizeLimit))
+		return nil
+	}
+
+	rest := strings.TrimSpace(string(restRunes))
+	if fields := strings.SplitN(rest, " ", 2); len(fields) == 2 {
+		if cooldown, err := strconv.Atoi(fields[0]); err == nil {
+			if cooldown < 0 {
+				env.Reply("Cooldown cannot be negative")
+				return nil
+			}
+			trigger.CooldownSeconds = cooldown
+			rest = fields[1]
+		}
+	}
+	trigger.Bex = strings.TrimSpace(rest)
+	if len(trigger.Bex) == 0 {
+		env.Reply(usage)
+		return nil
+	}
+
+	if _, err := compileTrigger(trigger); err != nil {
+		env.Reply(err.Error())
+		return nil
+	}
+
+	id, err := internal.InsertTrigger(db, trigger)
+	if err != nil {
+		return fmt.Errorf("could not add trigger: %w", err)
+	}
+	err = Triggers.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload triggers: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Trigger %d is added", id))
+	return nil
+}
+
+func EvalDelTriggerCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	id, err := strconv.ParseInt(strings.TrimSpace(command.Args), 10, 64)
+	if err != nil {
+		env.Reply("Usage: deltrigger <id>")
+		return nil
+	}
+
+	deleted, err := internal.DeleteTrigger(db, id)
+	if err != nil {
+		return fmt.Errorf("could not delete trigger %d: %w", id, err)
+	}
+	if !deleted {
+		env.Reply(fmt.Sprintf("Trigger %d does not exist", id))
+		return nil
+	}
+	err = Triggers.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload triggers: %w", err)
+	}
+
+	env.Reply(fmt.Sprintf("Trigger %d is deleted", id))
+	return nil
+}
+
+func EvalTriggersCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	triggers, err := internal.QueryTriggers(db)
+	if err != nil {
+		return fmt.Errorf("could not query triggers: %w", err)
+	}
+	if len(triggers) == 0 {
+		env.Reply("There are no triggers")
+		return nil
+	}
+
+	items := []string{}
+	for _, trigger := range triggers {
+		items = append(items, fmt.Sprintf("%d. %q (%ds): %s", trigger.Id, trigger.Regex, trigger.CooldownSeconds, trigger.Bex))
+	}
+	_, page := splitPageArg(command.Args)
+	sendPage(env, items, "Triggers: ", page, command.Prefix+command.Name)
+	return nil
+}
@@ -1,26 +1,30 @@
 package main
 
 import (
+	"context"
 	"strings"
 	"log"
 	"fmt"
+	"net"
 	"os"
 	"crypto/tls"
 	"time"
 	"database/sql"
-	_"github.com/tsoding/gatekeeper/internal"
-)
-
-const (
-	BotAdminTwitchHandle = "Tsoding"
+	"github.com/tsoding/gatekeeper/internal"
 )
 
 // https://dev.twitch.tv/docs/irc#connecting-to-the-twitch-irc-server
 const (
 	TwitchIrcAddress = "irc.chat.twitch.tv:6697"
-	TwitchIrcChannel = "#tsoding"
 )
 
+// https://dev.twitch.tv/docs/irc/capabilities/
+var TwitchCapabilities = []string{
+	"twitch.tv/tags",
+	"twitch.tv/commands",
+	"twitch.tv/membership",
+}
+
 type TwitchConnState int
 const (
 	TwitchConnect TwitchConnState = iota
@@ -31,20 +35,57 @@ const (
 
 type TwitchEnvironment struct {
 	AuthorHandle string
-	Conn *tls.Conn
+	// Id of the message the environment was created by. Empty if the
+	// message didn't have it or the environment was created not by a
+	// message.
+	MessageId string
+	// Stable id of the author from the `user-id` tag. Unlike the
+	// handle it does not change when the user renames themselves.
+	// Empty if the message didn't have it.
+	UserId string
+	// Badges of the author from the `badges` tag. See ParseTwitchBadges()
+	Badges map[string]string
+	Queue *TwitchSendQueue
 	Channel string
+	// Handles of the users the messages of this environment may
+	// mention besides the author. See SanitizeTwitchMentions().
+	mentionable []string
 }
 
 func (env *TwitchEnvironment) AsDiscord() *DiscordEnvironment {
 	return nil
 }
 
+func (env *TwitchEnvironment) Platform() string {
+	return "twitch"
+}
+
+func (env *TwitchEnvironment) ChannelID() string {
+	return env.Channel
+}
+
 func (env *TwitchEnvironment) AtAdmin() string {
-	return "@"+BotAdminTwitchHandle
+	if ownerId, ok := Roles.OwnerOn("twitch-id"); ok {
+		if ownerHandle, ok := TwitchUsers.Login(ownerId); ok {
+			// Asking the owner for help is an intended mention
+			env.AllowMention(ownerHandle)
+			return "@"+ownerHandle
+		}
+	}
+	return "the owner"
 }
 
+// The stable user id ("twitch-id#110240192") that survives renames. The
+// nickname ("twitch#tsoding") is only used if the message did not have
+// the user-id tag.
 func (env *TwitchEnvironment) UniversalPlatformAgnosticUserID() string {
-	return "twitch#"+env.AuthorHandle
+	if len(env.UserId) > 0 {
+		return twitchStableUserId(env.UserId)
+	}
+	if len(env.AuthorHandle) > 0 {
+		return twitchLegacyUserId(env.AuthorHandle)
+	}
+	return ""
 }
 
 func (env *TwitchEnvironment) AtAuthor() string {
@@ -56,17 +97,115 @@ func (env *TwitchEnvironment) AtAuthor() string {
 	return ""
 }
 
-func (env *TwitchEnvironment) IsAuthorAdmin() bool {
-	return strings.ToUpper(env.AuthorHandle) == strings.ToUpper(BotAdminTwitchHandle)
+func (env *TwitchEnvironment) IsBroadcaster() bool {
+	_, ok := env.Badges["broadcaster"]
+	return ok
+}
+
+func (env *TwitchEnvironment) IsModerator() bool {
+	_, ok := env.Badges["moderator"]
+	return ok
+}
+
+func (env *TwitchEnvironment) IsVIP() bool {
+	_, ok := env.Badges["vip"]
+	return ok
+}
+
+func (env *TwitchEnvironment) IsSubscriber() bool {
+	_, subscriber := env.Badges["subscriber"]
+	// Founders are the first subscribers of the channel and have this
+	// badge instead of the subscriber one
+	_, founder := env.Badges["founder"]
+	return subscriber || founder
+}
+
+// The permission the badges of the author give them in the chat. The
+// badges in the channels other than TwitchChannels.Main() are granted by
+// their broadcasters, while the permissions are global. So only the
+// subscriber badges count there.
+func (env *TwitchEnvironment) TwitchBadgePermission() Permission {
+	if env.Channel != TwitchChannels.Main() {
+		if env.IsSubscriber() {
+			return PermissionSubscriber
+		}
+		return PermissionEveryone
+	}
+	switch {
+	// The broadcaster is not the bot's admin automatically. Anything
+	// above moderator has to be granted as a role.
+	case env.IsBroadcaster(): return PermissionModerator
+	case env.IsModerator():   return PermissionModerator
+	case env.IsVIP():         return PermissionTrusted
+	case env.IsSubscriber():  return PermissionSubscriber
+	default:                  return PermissionEveryone
+	}
+}
+
+func (env *TwitchEnvironment) HasPermission(permission Permission) bool {
+	if len(env.AuthorHandle) == 0 {
+		return permission == PermissionEveryone
+	}
+	authorPermission := Roles.PermissionOfUser(env.UniversalPlatformAgnosticUserID())
+	if p := env.TwitchBadgePermission(); p > authorPermission {
+		authorPermission = p
+	}
+	return authorPermission >= permission
+}
+
+// Allows the messages of this environment to mention the user
+func (env *TwitchEnvironment) AllowMention(handle string) {
+	env.mentionable = appendUnique(env.mentionable, handle)
+}
+
+func (env *TwitchEnvironment) sendPrivmsg(tags map[string]string, message string) {
+	message = SanitizeTwitchMentions(message, appendUnique(env.mentionable, env.AuthorHandle))
+	env.Queue.Push(env.Channel, tags, FilterTrailingForbidden(message))
 }
 
 func (env *TwitchEnvironment) SendMessage(message string) {
-	message = ". "+FilterTrailingForbidden(message);
-	msg := IrcMsg{Name: IrcCmdPrivmsg, Args: []string{env.Channel, message}}
-	err := msg.Send(env.Conn)
-	if err != nil {
-		log.Println("Error sending Twitch message \"%s\" for channel %s: %s", message, env.Channel, err)
+	env.sendPrivmsg(nil, message)
+}
+
+// https://dev.twitch.tv/docs/irc/send-receive-messages/#replying-to-a-chat-message
+func (env *TwitchEnvironment) Reply(message string) {
+	if len(env.MessageId) == 0 || ReplyStyleOfPlatform(env.Platform()) == ReplyMention {
+		env.SendMessage(withAuthorMention(env, message))
+		return
 	}
+	env.sendPrivmsg(map[string]string{"reply-parent-msg-id": env.MessageId}, message)
+}
+
+func (env *TwitchEnvironment) SendRichMessage(message internal.RichMessage) {
+	env.SendMessage(message.Flatten())
+}
+
+func (env *TwitchEnvironment) ReplyRich(message internal.RichMessage) {
+	env.Reply(message.Flatten())
+}
+
+// https://dev.twitch.tv/docs/irc#keepalive-messages
+const (
+	// Twitch sends PING about every 5 minutes. Not hearing anything
+	// for longer than that means the connection is dead.
+	TwitchReadTimeout = 10 * time.Minute
+)
+
+// The NOTICEs Twitch sends instead of the welcome when the credentials
+// are wrong. Reconnecting with the same credentials is pointless.
+var TwitchAuthFailureNotices = []string{
+	"Login authentication failed",
+	"Login unsuccessful",
+	"Improperly formatted auth",
+}
+
+// msg-id tags of the NOTICEs Twitch sends when it could not join a channel
+// https://dev.twitch.tv/docs/irc/msg-id/
+var TwitchJoinFailureMsgIds = []string{
+	"msg_channel_suspended",
+	"msg_banned",
+	"tos_ban",
+	"invalid_user",
 }
 
 type TwitchConn struct {
@@ -74,44 +213,152 @@ type TwitchConn struct {
 	Reconnected int
 	Nick string
 	Pass string
-	Conn *tls.Conn
-	Quit chan int
+	// The channels to join. See twitchChannelsFromEnv()
+	Channels []string
+	// Connects to TwitchIrcAddress. Can be replaced with a fake server
+	// in the tests.
+	Dial func(ctx context.Context) (net.Conn, error)
+	Conn net.Conn
 	Incoming chan IrcMsg
 	IncomingQuit chan int
 	Sowon2Msgs chan Song
+	Timers chan internal.Timer
+	// All the outgoing PRIVMSGs go through it
+	Queue *TwitchSendQueue
+
+	ctx context.Context
+	cancel context.CancelFunc
+	// Stops the ircIncomingLoop() of the current Conn
+	connCancel context.CancelFunc
+	// Closed when the connection is completely shut down
+	done chan struct{}
+}
+
+func dialTwitchIrc(ctx context.Context) (net.Conn, error) {
+	dialer := tls.Dialer{}
+	return dialer.DialContext(ctx, "tcp", TwitchIrcAddress)
 }
 
-func (conn *TwitchConn) Close() {
-	// TODO: How to make this block until it's handled?
-	conn.Quit <- 69
+func newTwitchConn(nick string, pass string, channels []string, sowon2Msgs chan Song) *TwitchConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TwitchConn{
+		Nick: nick,
+		Pass: pass,
+		Channels: channels,
+		Dial: dialTwitchIrc,
+		Sowon2Msgs: sowon2Msgs,
+		Timers: make(chan internal.Timer),
+		Queue: newTwitchSendQueue(),
+		ctx: ctx,
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
 }
 
-func twitchIncomingLoop(twitchConn *TwitchConn) {
-	reply := make([]byte, 2048)
+// Blocks until the connection is shut down
+func (twitchConn *TwitchConn) Close() {
+	twitchConn.cancel()
+	<-twitchConn.done
+}
+
+func (twitchConn *TwitchConn) disconnect() {
+	if twitchConn.connCancel != nil {
+		twitchConn.connCancel()
+		twitchConn.connCancel = nil
+	}
+	if twitchConn.Conn != nil {
+		twitchConn.Conn.Close()
+		twitchConn.Conn = nil
+	}
+}
+
+func (twitchConn *TwitchConn) send(msg IrcMsg) bool {
+	err := msg.Send(twitchConn.Conn)
+	if err != nil {
+		log.Println("Twitch:", err)
+		return false
+	}
+	return true
+}
+
+// Sends everything the rate limits allow. Returns when to try again if
+// something is left in the queue.
+func (twitchConn *TwitchConn) flushSendQueue() <-chan time.Time {
 	for {
-		n, err := twitchConn.Conn.Read(reply)
-		if err != nil {
-			log.Println("Could not read the reply:", err)
-			break
+		msg, wait, ok := twitchConn.Queue.Pop(time.Now())
+		if !ok {
+			if wait > 0 {
+				return time.After(wait)
+			}
+			return nil
 		}
+		if !twitchConn.send(msg) {
+			// The ircIncomingLoop() is going to notice the broken
+			// connection as well
+			return nil
+		}
+	}
+}
 
-		lines := strings.Split(string(reply[0:n]), "\n")
-		for _, line := range lines {
-			line = strings.TrimSuffix(line, "\r")
-			if len(line) == 0 {
-				continue
-			}
-			msg, ok := ParseIrcMsg(line)
-			if !ok {
-				// TODO: we should probably restart the connection if parsing commands failed too many times
-				log.Printf("Failed to parse command: |%s| %d\n", line, len(line))
-				continue
-			}
-			twitchConn.Incoming <- msg
+func isTwitchAuthFailure(msg IrcMsg) bool {
+	if msg.Name != IrcCmdNotice || len(msg.Args) < 2 {
+		return false
+	}
+	for _, notice := range TwitchAuthFailureNotices {
+		if strings.Contains(msg.Args[1], notice) {
+			return true
 		}
 	}
+	return false
+}
 
-	twitchConn.IncomingQuit <- 69
+func isTwitchJoinFailure(msg IrcMsg) bool {
+	if msg.Name != IrcCmdNotice {
+		return false
+	}
+	for _, msgId := range TwitchJoinFailureMsgIds {
+		if msg.Tags["msg-id"] == msgId {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs the result of the capability negotiation. The bot keeps working
+// without the capabilities, just without the features that rely on the
+// tags (native replies, etc).
+func handleTwitchCap(msg IrcMsg) {
+	// :tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands
+	if len(msg.Args) < 3 {
+		log.Printf("Twitch: unexpected amount of args of CAP. Expected 3, but got %d\n", len(msg.Args))
+		return
+	}
+	switch msg.Args[1] {
+	case "ACK":
+		log.Printf("Twitch: capabilities acknowledged: %s\n", msg.Args[2])
+	case "NAK":
+		log.Printf("Twitch: capabilities rejected: %s\n", msg.Args[2])
+	}
+}
+
+// Parses the `badges` tag into a map from the badge name to its version,
+// for example "broadcaster/1,subscriber/12" into broadcaster: 1,
+// subscriber: 12
+// https://dev.twitch.tv/docs/irc/tags/#privmsg-tags
+func ParseTwitchBadges(tag string) map[string]string {
+	badges := map[string]string{}
+	for _, badge := range strings.Split(tag, ",") {
+		if len(badge) == 0 {
+			continue
+		}
+		split := strings.SplitN(badge, "/", 2)
+		if len(split) == 2 {
+			badges[split[0]] = split[1]
+		} else {
+			badges[split[0]] = ""
+		}
+	}
+	return badges
 }
 
 // `granum` stands for `Grammatical Number`: https://en.wikipedia.org/wiki/Grammatical_number
@@ -123,146 +370,242 @@ func granum(amount int, singular string, plural string) string {
 }
 
 func startTwitch(db *sql.DB, sowon2Msgs chan Song) (*TwitchConn, bool) {
-	twitchConn := TwitchConn{
-		Quit: make(chan int),
-		Incoming: make(chan IrcMsg),
-		IncomingQuit: make(chan int),
-		Sowon2Msgs: sowon2Msgs,
-	}
-
-	twitchConn.Nick = os.Getenv("GATEKEEPER_TWITCH_IRC_NICK");
-	if twitchConn.Nick == "" {
+	nick := os.Getenv("GATEKEEPER_TWITCH_IRC_NICK");
+	if nick == "" {
 		log.Println("No GATEKEEPER_TWITCH_IRC_NICK envar is provided.")
 		return nil, false
 	}
 
-	twitchConn.Pass = os.Getenv("GATEKEEPER_TWITCH_IRC_PASS");
-	if twitchConn.Pass == "" {
+	pass := os.Getenv("GATEKEEPER_TWITCH_IRC_PASS");
+	if pass == "" {
 		log.Println("No GATEKEEPER_TWITCH_IRC_PASS envar is provided.")
 		return nil, false
 	}
 
-	go func() {
-		for {
-			switch twitchConn.State {
-			case TwitchConnect:
-				// TODO: Can't ^C when the bot keeps reconnecting
-				// Can be reproduced by turning off the Internet
-				if twitchConn.Conn != nil {
-					twitchConn.Conn.Close()
-					twitchConn.Conn = nil
-				}
+	twitchConn := newTwitchConn(nick, pass, twitchChannelsFromEnv(), sowon2Msgs)
+	TwitchChannels.setJoined(twitchConn.Channels)
+	go twitchConn.run(db)
+	return twitchConn, true
+}
 
-				if twitchConn.Reconnected > 0 {
-					seconds := 1 << (twitchConn.Reconnected - 1)
-					log.Printf("Waiting %s before reconnecting Twitch IRC server\n", granum(seconds, "second", "seconds"))
-					time.Sleep(time.Duration(seconds) * time.Second)
-				}
-				twitchConn.Reconnected += 1;
+func (twitchConn *TwitchConn) run(db *sql.DB) {
+	defer close(twitchConn.done)
+	defer twitchConn.disconnect()
 
-				conn, err := tls.Dial("tcp", TwitchIrcAddress, nil)
-				if err != nil {
-					log.Println("Failed to connect to Twitch IRC server:", err)
-					continue
-				}
-				twitchConn.Conn = conn
-				twitchConn.State = TwitchLogin
-			case TwitchLogin:
-				err := IrcMsg{Name: IrcCmdPass, Args: []string{"oauth:"+twitchConn.Pass}}.Send(twitchConn.Conn)
-				if err != nil {
-					log.Println(err)
+	// When the server does not welcome the bot in TwitchJoin
+	var loginTimeout <-chan time.Time
+
+	for {
+		switch twitchConn.State {
+		case TwitchConnect:
+			twitchConn.disconnect()
+
+			if twitchConn.Reconnected > 0 {
+				delay := IrcBackoff(twitchConn.Reconnected)
+				log.Printf("Waiting %s before reconnecting Twitch IRC server\n", delay.Round(time.Millisecond))
+				select {
+				case <-twitchConn.ctx.Done():
+					return
+				case <-time.After(delay):
 				}
-				err = IrcMsg{Name: IrcCmdNick, Args: []string{twitchConn.Nick}}.Send(twitchConn.Conn)
-				if err != nil {
-					log.Println(err)
+			}
+			twitchConn.Reconnected += 1;
+
+			conn, err := twitchConn.Dial(twitchConn.ctx)
+			if err != nil {
+				if twitchConn.ctx.Err() != nil {
+					return
 				}
-				twitchConn.State = TwitchJoin
-				// TODO: check for authentication failures
-				// Reconnection is pointless. Abandon Twitch service at all.
-				go twitchIncomingLoop(&twitchConn)
-			case TwitchJoin:
-				select {
-				case <-twitchConn.IncomingQuit:
+				log.Println("Failed to connect to Twitch IRC server:", err)
+				continue
+			}
+			twitchConn.Conn = conn
+			// Each connection has its own channels, so the messages
+			// of the previous one are never mixed in
+			twitchConn.Incoming = make(chan IrcMsg)
+			twitchConn.IncomingQuit = make(chan int)
+			var connCtx context.Context
+			connCtx, twitchConn.connCancel = context.WithCancel(twitchConn.ctx)
+			go ircIncomingLoop(connCtx, "Twitch", conn, TwitchReadTimeout, twitchConn.Incoming, twitchConn.IncomingQuit)
+			twitchConn.State = TwitchLogin
+		case TwitchLogin:
+			// Requesting capabilities before the authentication
+			// does not delay the registration
+			// https://ircv3.net/specs/extensions/capability-negotiation
+			ok := twitchConn.send(IrcMsg{Name: IrcCmdCap, Args: []string{"REQ", strings.Join(TwitchCapabilities, " ")}}) &&
+				twitchConn.send(IrcMsg{Name: IrcCmdPass, Args: []string{"oauth:"+twitchConn.Pass}}) &&
+				twitchConn.send(IrcMsg{Name: IrcCmdNick, Args: []string{twitchConn.Nick}})
+			if !ok {
+				twitchConn.State = TwitchConnect
+				continue
+			}
+			loginTimeout = time.After(IrcLoginTimeout)
+			twitchConn.State = TwitchJoin
+		case TwitchJoin:
+			select {
+			case <-twitchConn.ctx.Done():
+				return
+			case <-twitchConn.IncomingQuit:
+				twitchConn.State = TwitchConnect
+			case <-loginTimeout:
+				log.Println("Twitch: the server did not welcome us in", IrcLoginTimeout)
+				twitchConn.State = TwitchConnect
+			case msg := <-twitchConn.Incoming:
+				switch msg.Name {
+				case IrcCmdCap:
+					handleTwitchCap(msg)
+				case IrcCmdPing:
+					twitchConn.send(IrcMsg{Name: IrcCmdPong, Args: msg.Args})
+				case IrcCmdReconnect:
+					twitchConn.Reconnected = 0
 					twitchConn.State = TwitchConnect
-					continue
-				case msg := <-twitchConn.Incoming:
-					switch msg.Name {
-					case IrcCmd001:
-						// > 001 is a welcome event, so we join channels there
-						// Source: https://github.com/go-irc/irc#example
-						err := IrcMsg{Name: IrcCmdJoin, Args: []string{TwitchIrcChannel}}.Send(twitchConn.Conn)
-						if err != nil {
-							log.Println(err)
-						}
-						twitchConn.State = TwitchChat
+				case IrcCmdNotice:
+					if isTwitchAuthFailure(msg) {
+						log.Printf("Twitch: authentication failed: %s. Check GATEKEEPER_TWITCH_IRC_NICK and GATEKEEPER_TWITCH_IRC_PASS. Abandoning Twitch.\n", msg.Args[1])
+						return
+					}
+					log.Println("Twitch: notice:", strings.Join(msg.Args, " "))
+				case IrcCmd001:
+					// > 001 is a welcome event, so we join channels there
+					// Source: https://github.com/go-irc/irc#example
+					if !twitchConn.send(IrcMsg{Name: IrcCmdJoin, Args: []string{strings.Join(twitchConn.Channels, ",")}}) {
+						twitchConn.State = TwitchConnect
 						continue
 					}
+					twitchConn.State = TwitchChat
 				}
-			case TwitchChat:
-				select {
-				case <-twitchConn.Quit:
-					log.Println("Twitch: closing connection...")
-					twitchConn.Conn.Close()
-					return
-				case <-twitchConn.IncomingQuit:
-					twitchConn.State = TwitchConnect
-					continue
-				case song := <-twitchConn.Sowon2Msgs:
+			}
+		case TwitchChat:
+			sendRetry := twitchConn.flushSendQueue()
+			select {
+			case <-twitchConn.ctx.Done():
+				log.Println("Twitch: closing connection...")
+				return
+			case <-twitchConn.Queue.Wakeup():
+			case <-sendRetry:
+			case <-twitchConn.IncomingQuit:
+				twitchConn.State = TwitchConnect
+			case song := <-twitchConn.Sowon2Msgs:
+				LogSong(db, song)
+				for _, channel := range twitchConn.Channels {
+					if !TwitchChannels.Settings(channel).Sowon2 {
+						continue
+					}
 					tw := TwitchEnvironment{
 						AuthorHandle: "",
-						Conn: twitchConn.Conn,
-						Channel: TwitchIrcChannel,
+						Queue: twitchConn.Queue,
+						Channel: channel,
 					}
-					LogSong(db, song)
 					if len(song.link) > 0 {
 						tw.SendMessage(fmt.Sprintf("🎶 🎵 Currently Playing: \"%s\" by %s %s 🎵 🎶", song.title, song.artist, song.link));
 					} else {
 						tw.SendMessage(fmt.Sprintf("🎶 🎵 Currently Playing: \"%s\" by %s 🎵 🎶", song.title, song.artist));
 					}
-				case msg := <-twitchConn.Incoming:
-					switch msg.Name {
-					// TODO: Handle RECONNECT command
-					// https://dev.twitch.tv/docs/irc/commands#reconnect
-					case IrcCmdPing:
-						// Reset the Reconnected counter only after
-						// some time. I think the Twitch's Keep-Alive
-						// PING is a good time to reset it.
-						twitchConn.Reconnected = 0
-						err := IrcMsg{Name: IrcCmdPong, Args: msg.Args}.Send(twitchConn.Conn)
-						if err != nil {
-							log.Println(err)
-							continue
-						}
-					case IrcCmdPrivmsg:
-						// TODO: this should be probably verified at parsing
-						// Each IrcCmdName should have an associated arity with it that is verified at parse/serialize.
-						if len(msg.Args) != 2 {
-							log.Printf("Twitch: unexpected amount of args of PRIVMSG. Expected 2, but got %d\n", len(msg.Args))
-							continue
-						}
-
-						command, ok := parseCommand(msg.Args[1])
-						if !ok {
-							// // TODO: consider feeding Twitch logs to the carrotson model
-							// if db != nil {
-							// 	internal.FeedMessageToCarrotson(db, msg.Args[1])
-							// }
-							continue
-						}
-
-						env := &TwitchEnvironment{
-							AuthorHandle: msg.Nick(),
-							Conn: twitchConn.Conn,
-							Channel: TwitchIrcChannel,
-						}
-
-						EvalCommand(db, command, env);
-					}
 				}
-			default: panic("unreachable")
+			case timer := <-twitchConn.Timers:
+				env := &TwitchEnvironment{
+					AuthorHandle: "",
+					Queue: twitchConn.Queue,
+					Channel: timer.Channel,
+				}
+				EvalCommand(db, timerCommand(timer), env)
+			case msg := <-twitchConn.Incoming:
+				twitchConn.handleChatMsg(db, msg)
 			}
+		default: panic("unreachable")
 		}
-	}()
+	}
+}
 
-	return &twitchConn, true
+func (twitchConn *TwitchConn) handleChatMsg(db *sql.DB, msg IrcMsg) {
+	switch msg.Name {
+	// https://dev.twitch.tv/docs/irc/commands#reconnect
+	case IrcCmdReconnect:
+		log.Println("Twitch: the server asked to reconnect")
+		// Twitch is going to close the connection soon anyway, so
+		// there is no point in waiting
+		twitchConn.Reconnected = 0
+		twitchConn.State = TwitchConnect
+	case IrcCmdPing:
+		// Reset the Reconnected counter only after
+		// some time. I think the Twitch's Keep-Alive
+		// PING is a good time to reset it.
+		twitchConn.Reconnected = 0
+		twitchConn.send(IrcMsg{Name: IrcCmdPong, Args: msg.Args})
+	case IrcCmdJoin:
+		// With twitch.tv/membership the server confirms our own JOINs
+		if len(msg.Args) > 0 && strings.EqualFold(msg.Nick(), twitchConn.Nick) {
+			log.Println("Twitch: joined", msg.Args[0])
+		}
+	case IrcCmdNotice:
+		if isTwitchJoinFailure(msg) {
+			log.Printf("Twitch: could not join %s: %s\n", msg.Args[0], msg.Args[len(msg.Args)-1])
+			return
+		}
+		log.Println("Twitch: notice:", strings.Join(msg.Args, " "))
+	case IrcCmdCap:
+		handleTwitchCap(msg)
+	// Sent after joining the channel and after each message of the bot
+	// https://dev.twitch.tv/docs/irc/commands/#userstate
+	case IrcCmdUserstate:
+		if len(msg.Args) < 1 {
+			return
+		}
+		badges := ParseTwitchBadges(msg.Tags["badges"])
+		_, moderator := badges["moderator"]
+		_, broadcaster := badges["broadcaster"]
+		twitchConn.Queue.SetModerator(NormalizeTwitchChannel(msg.Args[0]), moderator || broadcaster || msg.Tags["mod"] == "1")
+	// Subs, gift subs, raids, etc
+	case IrcCmdUsernotice:
+		if event, ok := ParseTwitchUserNotice(msg); ok {
+			EvalTwitchEvent(db, twitchConn.Queue, event)
+		}
+	case IrcCmdPrivmsg:
+		// TODO: this should be probably verified at parsing
+		// Each IrcCmdName should have an associated arity with it that is verified at parse/serialize.
+		if len(msg.Args) != 2 {
+			log.Printf("Twitch: unexpected amount of args of PRIVMSG. Expected 2, but got %d\n", len(msg.Args))
+			return
+		}
+
+		env := &TwitchEnvironment{
+			AuthorHandle: msg.Nick(),
+			MessageId: msg.Tags["id"],
+			UserId: msg.Tags["user-id"],
+			Badges: ParseTwitchBadges(msg.Tags["badges"]),
+			Queue: twitchConn.Queue,
+			// Replies go to the channel the message came from
+			Channel: NormalizeTwitchChannel(msg.Args[0]),
+		}
+
+		TwitchUsers.Seen(db, env)
+		if db != nil {
+			// The moderated messages are logged too
+			logTwitchMessage(db, env, msg.Args[1])
+		}
+
+		removed := ModerateMessage(env, ModMessage{
+			Platform: env.Platform(),
+			Channel: env.ChannelID(),
+			UserId: env.UniversalPlatformAgnosticUserID(),
+			Text: msg.Args[1],
+			Emotes: countTwitchEmotes(msg.Tags["emotes"]),
+		})
+		if removed {
+			return
+		}
+
+		Activity.Record(env.Platform(), env.ChannelID())
+
+		command, ok := parseCommandInEnvironment(env, msg.Args[1])
+		if !ok {
+			EvalTriggers(env, msg.Args[1])
+			if db != nil && shouldFeedTwitchMessageToCarrotson(env, msg.Args[1]) {
+				internal.FeedMessageToCarrotson(db, msg.Args[1])
+			}
+			return
+		}
+
+		EvalCommand(db, command, env);
+	}
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/tsoding/gatekeeper/internal"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTwitchBadges(t *testing.T) {
+	badges := ParseTwitchBadges("broadcaster/1,subscriber/12,glhf-pledge")
+	expected := map[string]string{"broadcaster": "1", "subscriber": "12", "glhf-pledge": ""}
+	if len(badges) != len(expected) {
+		t.Fatalf("expected %q, but got %q", expected, badges)
+	}
+	for name, version := range expected {
+		if actual, ok := badges[name]; !ok || actual != version {
+			t.Errorf("%s: expected %q, but got %q", name, version, actual)
+		}
+	}
+	if badges := ParseTwitchBadges(""); len(badges) != 0 {
+		t.Errorf("expected no badges, but got %q", badges)
+	}
+}
+
+func TestTwitchBadgePermissions(t *testing.T) {
+	withRoles(t, nil)
+	cases := []struct{
+		badges   string
+		expected Permission
+	}{
+		{"", PermissionEveryone},
+		{"subscriber/12", PermissionSubscriber},
+		{"founder/0", PermissionSubscriber},
+		{"vip/1,subscriber/12", PermissionTrusted},
+		{"moderator/1", PermissionModerator},
+		{"broadcaster/1", PermissionModerator},
+	}
+	for _, c := range cases {
+		env := &TwitchEnvironment{AuthorHandle: "rexim", Channel: DefaultTwitchIrcChannel, Badges: ParseTwitchBadges(c.badges)}
+		if !env.HasPermission(c.expected) {
+			t.Errorf("%q: expected to have %s permission", c.badges, c.expected)
+		}
+		if c.expected < PermissionOwner && env.HasPermission(c.expected+1) {
+			t.Errorf("%q: expected not to have %s permission", c.badges, c.expected+1)
+		}
+	}
+
+	// Without the author the badges don't matter
+	system := &TwitchEnvironment{Badges: ParseTwitchBadges("broadcaster/1")}
+	if system.HasPermission(PermissionSubscriber) {
+		t.Errorf("expected the environment without author to have no permissions")
+	}
+}
+
+func TestTwitchStableUserIdRoles(t *testing.T) {
+	withRoles(t, []internal.UserRole{{UserId: "twitch-id#110240192", Role: internal.RoleAdmin}})
+	renamed := &TwitchEnvironment{AuthorHandle: "tsoding_renamed", UserId: "110240192"}
+	if !renamed.HasPermission(PermissionAdmin) || renamed.HasPermission(PermissionOwner) {
+		t.Errorf("expected the role granted to the stable id to be admin")
+	}
+	if got := renamed.UniversalPlatformAgnosticUserID(); got != "twitch-id#110240192" {
+		t.Errorf("expected the stable id, got %s", got)
+	}
+	impostor := &TwitchEnvironment{AuthorHandle: "tsoding_renamed", UserId: "69"}
+	if impostor.HasPermission(PermissionSubscriber) {
+		t.Errorf("expected the role not to be granted by the handle")
+	}
+
+	// The nickname is not an identity anymore once the user-id is known
+	withRoles(t, []internal.UserRole{{UserId: "twitch#tsoding", Role: internal.RoleAdmin}})
+	squatter := &TwitchEnvironment{AuthorHandle: "tsoding", UserId: "69"}
+	if squatter.HasPermission(PermissionAdmin) {
+		t.Errorf("expected the role of the nickname not to be granted when the user-id is present")
+	}
+}
+
+func TestTwitchUserIdOfLogin(t *testing.T) {
+	defer TwitchUsers.update(nil)
+	TwitchUsers.update([]internal.TwitchUser{{UserId: "110240192", Login: "tsoding"}})
+	cases := map[string]string{
+		"tsoding":  "twitch-id#110240192",
+		"@Tsoding": "twitch-id#110240192",
+		"rexim":    "twitch#rexim",
+	}
+	for login, expected := range cases {
+		if got := twitchUserIdOfLogin(login); got != expected {
+			t.Errorf("%s: expected %s, got %s", login, expected, got)
+		}
+	}
+
+	// After the rename the old nickname is free to be taken
+	TwitchUsers.set(internal.TwitchUser{UserId: "110240192", Login: "tsoding_renamed"})
+	if got := twitchUserIdOfLogin("tsoding"); got != "twitch#tsoding" {
+		t.Errorf("expected the old nickname to be forgotten, got %s", got)
+	}
+	if got := twitchUserIdOfLogin("tsoding_renamed"); got != "twitch-id#110240192" {
+		t.Errorf("expected the new nickname to be resolved, got %s", got)
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	for permission := PermissionEveryone; permission <= PermissionOwner; permission += 1 {
+		if parsed, ok := ParsePermission(permission.String()); !ok || parsed != permission {
+			t.Errorf("%s: got %s %v", permission, parsed, ok)
+		}
+	}
+	if parsed, ok := ParsePermission("Moderator"); !ok || parsed != PermissionModerator {
+		t.Errorf("expected the permissions to be case insensitive")
+	}
+	if _, ok := ParsePermission("god"); ok {
+		t.Errorf("expected unknown permission to be rejected")
+	}
+}
+
+const FakeIrcTimeout = 5 * time.Second
+
+// Local plain text IRC server the TwitchConn connects to in the tests
+type FakeIrcServer struct {
+	listener net.Listener
+	clients  chan *FakeIrcClient
+}
+
+type FakeIrcClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newFakeIrcServer(t *testing.T) *FakeIrcServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &FakeIrcServer{listener: listener, clients: make(chan *FakeIrcClient, 16)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.clients <- &FakeIrcClient{conn: conn, reader: bufio.NewReader(conn)}
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+func (server *FakeIrcServer) Dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", server.listener.Addr().String())
+}
+
+func (server *FakeIrcServer) Accept(t *testing.T) *FakeIrcClient {
+	t.Helper()
+	select {
+	case client := <-server.clients:
+		t.Cleanup(func() {
+			client.conn.Close()
+		})
+		return client
+	case <-time.After(FakeIrcTimeout):
+		t.Fatal("the bot did not connect")
+		return nil
+	}
+}
+
+func (server *FakeIrcServer) ExpectNoClient(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case <-server.clients:
+		t.Fatal("the bot unexpectedly connected again")
+	case <-time.After(wait):
+	}
+}
+
+func (client *FakeIrcClient) Expect(t *testing.T, prefix string) string {
+	t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(FakeIrcTimeout))
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected %q, but got error %s", prefix, err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if !strings.HasPrefix(line, prefix) {
+		t.Fatalf("expected %q, but got %q", prefix, line)
+	}
+	return line
+}
+
+func (client *FakeIrcClient) ExpectClosed(t *testing.T) {
+	t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(FakeIrcTimeout))
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Fatal("the bot did not close the connection")
+			}
+			return
+		}
+		// QUIT and the like are fine
+		t.Logf("the bot sent %q before closing the connection", line)
+	}
+}
+
+func (client *FakeIrcClient) Send(t *testing.T, line string) {
+	t.Helper()
+	_, err := client.conn.Write([]byte(line + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Goes through the login sequence up until joining the channels
+func (client *FakeIrcClient) Login(t *testing.T) {
+	t.Helper()
+	client.Expect(t, "CAP REQ :twitch.tv/tags twitch.tv/commands twitch.tv/membership")
+	client.Expect(t, "PASS :oauth:hunter2")
+	client.Expect(t, "NICK :gatekeeper")
+	client.Send(t, ":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands twitch.tv/membership")
+	client.Send(t, ":tmi.twitch.tv 001 gatekeeper :Welcome, GLHF!")
+}
+
+func startFakeTwitchConn(t *testing.T, server *FakeIrcServer, channels ...string) *TwitchConn {
+	withTwitchChannels(t, channels, nil)
+	twitchConn := newTwitchConn("gatekeeper", "hunter2", channels, nil)
+	twitchConn.Dial = server.Dial
+	go twitchConn.run(nil)
+	return twitchConn
+}
+
+func expectClosesIn(t *testing.T, twitchConn *TwitchConn, wait time.Duration) {
+	t.Helper()
+	closed := make(chan struct{})
+	go func() {
+		twitchConn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(wait):
+		t.Fatal("Close() did not return")
+	}
+}
+
+func TestTwitchConnRoutesRepliesToChannel(t *testing.T) {
+	t.Setenv("GATEKEEPER_TWITCH_REPLY_STYLE", "")
+	server := newFakeIrcServer(t)
+	twitchConn := startFakeTwitchConn(t, server, "#tsoding", "#rexim")
+	defer expectClosesIn(t, twitchConn, FakeIrcTimeout)
+
+	client := server.Accept(t)
+	client.Login(t)
+	client.Expect(t, "JOIN :#tsoding,#rexim")
+
+	client.Send(t, "PING :tmi.twitch.tv")
+	client.Expect(t, "PONG :tmi.twitch.tv")
+
+	client.Send(t, "@badges=;id=42;user-id=69 :abc!abc@abc.tmi.twitch.tv PRIVMSG #rexim :!nonexistingcommand")
+	client.Expect(t, "@reply-parent-msg-id=42 PRIVMSG #rexim :. command `nonexistingcommand` does not exist")
+}
+
+func TestTwitchConnReconnectsOnRequest(t *testing.T) {
+	server := newFakeIrcServer(t)
+	twitchConn := startFakeTwitchConn(t, server, "#tsoding")
+	defer expectClosesIn(t, twitchConn, FakeIrcTimeout)
+
+	first := server.Accept(t)
+	first.Login(t)
+	first.Expect(t, "JOIN :#tsoding")
+	first.Send(t, ":tmi.twitch.tv RECONNECT")
+	first.ExpectClosed(t)
+
+	// Immediately, without the backoff
+	second := server.Accept(t)
+	second.Login(t)
+	second.Expect(t, "JOIN :#tsoding")
+}
+
+func TestTwitchConnReconnectsWhenDisconnected(t *testing.T) {
+	server := newFakeIrcServer(t)
+	twitchConn := startFakeTwitchConn(t, server, "#tsoding")
+	defer expectClosesIn(t, twitchConn, FakeIrcTimeout)
+
+	first := server.Accept(t)
+	first.Login(t)
+	first.Expect(t, "JOIN :#tsoding")
+	first.conn.Close()
+
+	second := server.Accept(t)
+	second.Login(t)
+	second.Expect(t, "JOIN :#tsoding")
+}
+
+func TestTwitchConnAbandonsOnAuthFailure(t *testing.T) {
+	server := newFakeIrcServer(t)
+	twitchConn := startFakeTwitchConn(t, server, "#tsoding")
+
+	client := server.Accept(t)
+	client.Expect(t, "CAP REQ")
+	client.Expect(t, "PASS")
+	client.Expect(t, "NICK")
+	client.Send(t, ":tmi.twitch.tv NOTICE * :Login authentication failed")
+	client.ExpectClosed(t)
+
+	select {
+	case <-twitchConn.done:
+	case <-time.After(FakeIrcTimeout):
+		t.Fatal("the connection was not abandoned")
+	}
+	server.ExpectNoClient(t, 100*time.Millisecond)
+	expectClosesIn(t, twitchConn, FakeIrcTimeout)
+}
+
+func TestTwitchConnJoinFailureKeepsConnection(t *testing.T) {
+	server := newFakeIrcServer(t)
+	twitchConn := startFakeTwitchConn(t, server, "#tsoding", "#banned")
+	defer expectClosesIn(t, twitchConn, FakeIrcTimeout)
+
+	client := server.Accept(t)
+	client.Login(t)
+	client.Expect(t, "JOIN :#tsoding,#banned")
+	client.Send(t, "@msg-id=msg_channel_suspended :tmi.twitch.tv NOTICE #banned :This channel has been suspended.")
+	client.Send(t, "PING :tmi.twitch.tv")
+	client.Expect(t, "PONG :tmi.twitch.tv")
+}
+
+func TestTwitchConnCloseDuringBackoff(t *testing.T) {
+	withTwitchChannels(t, []string{"#tsoding"}, nil)
+	twitchConn := newTwitchConn("gatekeeper", "hunter2", []string{"#tsoding"}, nil)
+	dialed := make(chan struct{}, 16)
+	twitchConn.Dial = func(ctx context.Context) (net.Conn, error) {
+		dialed <- struct{}{}
+		return nil, errors.New("no internet")
+	}
+	twitchConn.Reconnected = 10
+	go twitchConn.run(nil)
+
+	// Now it waits for at least IrcMaxBackoff/2 before dialing
+	expectClosesIn(t, twitchConn, FakeIrcTimeout)
+	if len(dialed) != 0 {
+		t.Fatalf("expected no dials, but got %d", len(dialed))
+	}
+}
+
+func TestTwitchConnCloseBlocks(t *testing.T) {
+	server := newFakeIrcServer(t)
+	twitchConn := startFakeTwitchConn(t, server, "#tsoding")
+
+	client := server.Accept(t)
+	client.Login(t)
+	client.Expect(t, "JOIN :#tsoding")
+
+	expectClosesIn(t, twitchConn, FakeIrcTimeout)
+	select {
+	case <-twitchConn.done:
+	default:
+		t.Fatal("Close() returned before the shutdown")
+	}
+	client.ExpectClosed(t)
+}
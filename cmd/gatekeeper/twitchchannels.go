@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTwitchIrcChannel = "#tsoding"
+	TwitchChannelSettingsReloadInterval = 1 * time.Minute
+)
+
+var (
+	TwitchChannels = TwitchChannelList{}
+	TwitchChannelRegexp = regexp.MustCompile("^#[a-z0-9_]{1,25}$")
+	TwitchChannelSettingNames = []string{"commands", "sowon2", "timers", "carrotson", "events"}
+)
+
+// Lowercase with the leading #, the way Twitch IRC refers to the channels
+func NormalizeTwitchChannel(name string) string {
+	return "#" + strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "#")
+}
+
+// Channels from GATEKEEPER_TWITCH_IRC_CHANNELS. The first one is the
+// main channel.
+func twitchChannelsFromEnv() []string {
+	channels := []string{}
+	for _, channel := range strings.Split(os.Getenv("GATEKEEPER_TWITCH_IRC_CHANNELS"), ",") {
+		if len(strings.TrimSpace(channel)) == 0 {
+			continue
+		}
+		channel = NormalizeTwitchChannel(channel)
+		if !TwitchChannelRegexp.MatchString(channel) {
+			log.Printf("Twitch: ignoring invalid channel %s in GATEKEEPER_TWITCH_IRC_CHANNELS\n", channel)
+			continue
+		}
+		channels = appendUnique(channels, channel)
+	}
+	if len(channels) == 0 {
+		channels = append(channels, DefaultTwitchIrcChannel)
+	}
+	return channels
+}
+
+type TwitchChannelList struct {
+	mutex sync.RWMutex
+	// The channels the bot joins
+	joined []string
+	// Live copy of the Twitch_Channel_Settings table. Key is the channel.
+	settings map[string]internal.TwitchChannelSettings
+}
+
+func (channels *TwitchChannelList) setJoined(joined []string) {
+	channels.mutex.Lock()
+	defer channels.mutex.Unlock()
+	channels.joined = joined
+}
+
+func (channels *TwitchChannelList) Joined() []string {
+	channels.mutex.RLock()
+	defer channels.mutex.RUnlock()
+	return append([]string{}, channels.joined...)
+}
+
+// The first of the joined channels. The roles that come from the Twitch
+// badges are fully trusted only there.
+func (channels *TwitchChannelList) Main() string {
+	channels.mutex.RLock()
+	defer channels.mutex.RUnlock()
+	if len(channels.joined) == 0 {
+		return DefaultTwitchIrcChannel
+	}
+	return channels.joined[0]
+}
+
+func (channels *TwitchChannelList) update(rows []internal.TwitchChannelSettings) {
+	settings := map[string]internal.TwitchChannelSettings{}
+	for _, row := range rows {
+		settings[row.Channel] = row
+	}
+
+	channels.mutex.Lock()
+	defer channels.mutex.Unlock()
+	channels.settings = settings
+}
+
+func (channels *TwitchChannelList) Reload(db *sql.DB) error {
+	rows, err := internal.QueryTwitchChannelSettings(db, channels.Main())
+	if err != nil {
+		return err
+	}
+	channels.update(rows)
+	return nil
+}
+
+// Settings of the channel falling back to the defaults. By default
+// everything is enabled except the Sowon2 and Twitch event
+// announcements which are only enabled in the Main() channel and the
+// Carrotson feeding which is opt-in.
+func (channels *TwitchChannelList) Settings(channel string) internal.TwitchChannelSettings {
+	main := channels.Main()
+
+	channels.mutex.RLock()
+	defer channels.mutex.RUnlock()
+	if settings, ok := channels.settings[channel]; ok {
+		return settings
+	}
+	return internal.TwitchChannelSettings{
+		Channel: channel,
+		CustomCommands: true,
+		Sowon2: channel == main,
+		Timers: true,
+		Events: channel == main,
+	}
+}
+
+func PollTwitchChannelSettings(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	err := TwitchChannels.Reload(db)
+	if err != nil {
+		log.Println("Error loading Twitch channel settings:", err)
+	}
+	go func() {
+		for {
+			time.Sleep(TwitchChannelSettingsReloadInterval)
+			err := TwitchChannels.Reload(db)
+			if err != nil {
+				log.Println("Error reloading Twitch channel settings:", err)
+			}
+		}
+	}()
+}
+
+// Channels may opt out of the custom commands. See internal.TwitchChannelSettings
+func customCommandsEnabled(env CommandEnvironment) bool {
+	if env.Platform() == "twitch" {
+		return TwitchChannels.Settings(env.ChannelID()).CustomCommands
+	}
+	return true
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func formatTwitchChannelSettings(settings internal.TwitchChannelSettings) string {
+	return fmt.Sprintf("%s: commands %s, sowon2 %s, timers %s, carrotson %s, events %s", settings.Channel, onOff(settings.CustomCommands), onOff(settings.Sowon2), onOff(settings.Timers), onOff(settings.Carrotson), onOff(settings.Events))
+}
+
+func EvalTwitchChannelCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	usage := "Usage: twitchchannel [<channel> [<" + strings.Join(TwitchChannelSettingNames, "|") + "> <on|off>]]"
+	args := strings.Fields(command.Args)
+
+	if len(args) == 0 {
+		items := []string{}
+		for _, channel := range TwitchChannels.Joined() {
+			items = append(items, formatTwitchChannelSettings(TwitchChannels.Settings(channel)))
+		}
+		if len(items) == 0 {
+			env.Reply("Not connected to Twitch")
+			return nil
+		}
+		env.ReplyRich(internal.RichMessage{Title: "Twitch channels", Items: items})
+		return nil
+	}
+
+	channel := NormalizeTwitchChannel(args[0])
+	if !TwitchChannelRegexp.MatchString(channel) {
+		env.Reply(fmt.Sprintf("`%s` is not a Twitch channel", args[0]))
+		return nil
+	}
+	settings := TwitchChannels.Settings(channel)
+
+	if len(args) == 1 {
+		env.Reply(formatTwitchChannelSettings(settings))
+		return nil
+	}
+	if len(args) != 3 {
+		env.Reply(usage)
+		return nil
+	}
+
+	var value bool
+	switch strings.ToLower(args[2]) {
+	case "on":  value = true
+	case "off": value = false
+	default:
+		env.Reply(usage)
+		return nil
+	}
+
+	switch strings.ToLower(args[1]) {
+	case "commands": settings.CustomCommands = value
+	case "sowon2":   settings.Sowon2 = value
+	case "timers":   settings.Timers = value
+	case "carrotson": settings.Carrotson = value
+	case "events":   settings.Events = value
+	default:
+		env.Reply(usage)
+		return nil
+	}
+
+	err := internal.UpsertTwitchChannelSettings(db, settings)
+	if err != nil {
+		return fmt.Errorf("could not update settings of Twitch channel %s: %w", channel, err)
+	}
+	err = TwitchChannels.Reload(db)
+	if err != nil {
+		return fmt.Errorf("could not reload Twitch channel settings: %w", err)
+	}
+
+	env.Reply(formatTwitchChannelSettings(settings))
+	return nil
+}
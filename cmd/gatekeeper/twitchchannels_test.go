@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"testing"
+)
+
+// Replaces the joined Twitch channels and their settings for the duration of the test
+func withTwitchChannels(t *testing.T, joined []string, settings []internal.TwitchChannelSettings) {
+	TwitchChannels.setJoined(joined)
+	TwitchChannels.update(settings)
+	t.Cleanup(func() {
+		TwitchChannels.setJoined(nil)
+		TwitchChannels.update(nil)
+	})
+}
+
+func TestTwitchChannelsFromEnv(t *testing.T) {
+	t.Setenv("GATEKEEPER_TWITCH_IRC_CHANNELS", "")
+	expectMessages(t, twitchChannelsFromEnv(), "#tsoding")
+
+	t.Setenv("GATEKEEPER_TWITCH_IRC_CHANNELS", " Tsoding, #rexim,,#tsoding,#not a channel")
+	expectMessages(t, twitchChannelsFromEnv(), "#tsoding", "#rexim")
+}
+
+func TestTwitchChannelSettingsDefaults(t *testing.T) {
+	withTwitchChannels(t, []string{"#tsoding", "#rexim", "#abc"}, []internal.TwitchChannelSettings{
+		{Channel: "#abc", CustomCommands: false, Sowon2: true, Timers: false},
+	})
+
+	if main := TwitchChannels.Settings("#tsoding"); !main.CustomCommands || !main.Sowon2 || !main.Timers || !main.Events {
+		t.Errorf("unexpected settings of the main channel %#v", main)
+	}
+	if costreamer := TwitchChannels.Settings("#rexim"); !costreamer.CustomCommands || costreamer.Sowon2 || !costreamer.Timers || costreamer.Events {
+		t.Errorf("unexpected settings of the co-streamer channel %#v", costreamer)
+	}
+	if configured := TwitchChannels.Settings("#abc"); configured.CustomCommands || !configured.Sowon2 || configured.Timers {
+		t.Errorf("unexpected settings of the configured channel %#v", configured)
+	}
+
+	enabled := &TwitchEnvironment{Channel: "#rexim"}
+	disabled := &TransformEnvironment{InnerEnv: &TwitchEnvironment{Channel: "#abc"}}
+	if !customCommandsEnabled(enabled) || customCommandsEnabled(disabled) {
+		t.Errorf("expected custom commands to follow the settings of the channel")
+	}
+}
+
+func TestTwitchBadgesOutsideOfMainChannel(t *testing.T) {
+	withRoles(t, nil)
+	withTwitchChannels(t, []string{"#tsoding", "#rexim"}, nil)
+
+	moderator := &TwitchEnvironment{AuthorHandle: "abc", Channel: "#rexim", Badges: ParseTwitchBadges("moderator/1,subscriber/6")}
+	if !moderator.HasPermission(PermissionSubscriber) || moderator.HasPermission(PermissionTrusted) {
+		t.Errorf("expected only the subscriber badge to count outside of the main channel")
+	}
+	moderator.Channel = "#tsoding"
+	if !moderator.HasPermission(PermissionModerator) {
+		t.Errorf("expected the moderator badge to count in the main channel")
+	}
+}
+
+func TestTwitchChannelCommandWithoutChannels(t *testing.T) {
+	withTwitchChannels(t, nil, nil)
+	env := &FakeEnvironment{PlatformName: "discord", UserId: "69"}
+	err := EvalTwitchChannelCommand(nil, Command{Name: "twitchchannel"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, env.Messages, "@69 Not connected to Twitch")
+}
+
+func TestTwitchChannelCommandShow(t *testing.T) {
+	withTwitchChannels(t, []string{"#tsoding", "#rexim"}, nil)
+	env := &FakeEnvironment{PlatformName: "discord", UserId: "69"}
+	err := EvalTwitchChannelCommand(nil, Command{Name: "twitchchannel", Args: "Rexim"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, env.Messages, "@69 #rexim: commands on, sowon2 off, timers on, carrotson off, events off")
+}
+
+func TestAddTimerWithCustomCommandsOff(t *testing.T) {
+	withTwitchChannels(t, []string{"#tsoding", "#abc"}, []internal.TwitchChannelSettings{
+		{Channel: "#abc", CustomCommands: false, Timers: true},
+	})
+	env := &FakeEnvironment{PlatformName: "twitch", Channel: "#abc", UserId: "admin", Permission: PermissionAdmin}
+	// The db is never touched
+	if err := EvalAddTimerCommand(nil, Command{Name: "addtimer", Args: "15 10 discord"}, env); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expectMessages(t, env.Messages, "@admin Custom commands are disabled in this channel. Timers can only run custom commands")
+}
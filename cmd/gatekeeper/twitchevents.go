@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// The size of the bex column of the Twitch_Event_Templates table
+const TwitchEventTemplateSizeLimit = 1024
+
+// https://dev.twitch.tv/docs/irc/tags/#usernotice-tags
+func twitchSubPlanName(plan string) string {
+	switch plan {
+	case "Prime": return "Prime"
+	case "1000":  return "Tier 1"
+	case "2000":  return "Tier 2"
+	case "3000":  return "Tier 3"
+	default:      return plan
+	}
+}
+
+func twitchIntTag(tags map[string]string, name string) int {
+	value, err := strconv.Atoi(tags[name])
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// Turns the USERNOTICE into the event. Returns false for the notices the
+// bot does not announce (rituals, bits badges, etc).
+// https://dev.twitch.tv/docs/irc/commands/#usernotice
+func ParseTwitchUserNotice(msg IrcMsg) (internal.TwitchEvent, bool) {
+	if msg.Name != IrcCmdUsernotice || len(msg.Args) < 1 {
+		return internal.TwitchEvent{}, false
+	}
+	tags := msg.Tags
+	event := internal.TwitchEvent{
+		Channel: NormalizeTwitchChannel(msg.Args[0]),
+		User: tags["display-name"],
+		Login: tags["login"],
+		Months: twitchIntTag(tags, "msg-param-cumulative-months"),
+		Plan: twitchSubPlanName(tags["msg-param-sub-plan"]),
+	}
+	if len(event.User) == 0 {
+		event.User = event.Login
+	}
+
+	switch tags["msg-id"] {
+	case "sub":
+		event.Type = internal.TwitchEventSub
+		if event.Months == 0 {
+			event.Months = 1
+		}
+	case "resub":
+		event.Type = internal.TwitchEventResub
+	case "subgift", "anonsubgift":
+		// The gifts of a submysterygift come as separate subgifts.
+		// Announcing the submysterygift is enough.
+		if _, ok := tags["msg-param-community-gift-id"]; ok {
+			return internal.TwitchEvent{}, false
+		}
+		event.Type = internal.TwitchEventSubGift
+		event.Recipient = tags["msg-param-recipient-display-name"]
+		if len(event.Recipient) == 0 {
+			event.Recipient = tags["msg-param-recipient-user-name"]
+		}
+		// The months of the recipient
+		event.Months = twitchIntTag(tags, "msg-param-months")
+		event.Count = 1
+	case "submysterygift", "anonsubmysterygift":
+		event.Type = internal.TwitchEventSubMysteryGift
+		event.Count = twitchIntTag(tags, "msg-param-mass-gift-count")
+	case "raid":
+		event.Type = internal.TwitchEventRaid
+		if name := tags["msg-param-displayName"]; len(name) > 0 {
+			event.User = name
+		}
+		if login := tags["msg-param-login"]; len(login) > 0 {
+			event.Login = login
+		}
+		event.Viewers = twitchIntTag(tags, "msg-param-viewerCount")
+		event.Plan = ""
+	default:
+		return internal.TwitchEvent{}, false
+	}
+	return event, true
+}
+
+// Evaluates the template of the event. The event is available to the
+// bex via the event_*() functions. See internal.TwitchEvent.Funcs()
+func evalTwitchEventTemplate(env CommandEnvironment, event internal.TwitchEvent, bex string) error {
+	exprs, err := internal.ParseAllExprs(bex)
+	if err != nil {
+		return fmt.Errorf("could not parse template of %s: %w", event.Type, err)
+	}
+	context := internal.NewEvalContext(env, "", 0)
+	context.PushScope(internal.EvalScope{Funcs: event.Funcs()})
+	for _, expr := range exprs {
+		if _, err := context.EvalExpr(expr); err != nil {
+			return fmt.Errorf("could not evaluate template of %s: %w", event.Type, err)
+		}
+	}
+	return nil
+}
+
+// Announces the event in its channel if there is a template for it and
+// the channel has the events enabled
+func EvalTwitchEvent(db *sql.DB, queue *TwitchSendQueue, event internal.TwitchEvent) {
+	if db == nil || !TwitchChannels.Settings(event.Channel).Events {
+		return
+	}
+	bex, ok, err := internal.QueryTwitchEventTemplate(db, event.Type)
+	if err != nil {
+		log.Printf("Error while querying template of Twitch event %s: %s\n", event.Type, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	env := &TwitchEnvironment{
+		Queue: queue,
+		Channel: event.Channel,
+	}
+	// Thanking the people is the whole point
+	env.AllowMention(event.Login)
+	env.AllowMention(event.User)
+	env.AllowMention(event.Recipient)
+
+	err = evalTwitchEventTemplate(env, event, bex)
+	if err != nil {
+		// Not reporting it to the chat, because nobody asked the bot for anything
+		log.Println("Error while announcing Twitch event:", err)
+	}
+}
+
+func EvalTwitchEventCommand(db *sql.DB, command Command, env CommandEnvironment) error {
+	usage := "Usage: twitchevent [<" + strings.Join(internal.TwitchEventTypes, "|") + "> [<bex>|off]]"
+	fields := strings.SplitN(strings.TrimSpace(command.Args), " ", 2)
+
+	if len(fields[0]) == 0 {
+		templates, err := internal.QueryTwitchEventTemplates(db)
+		if err != nil {
+			return fmt.Errorf("could not query Twitch event templates: %w", err)
+		}
+		if len(templates) == 0 {
+			env.Reply("There are no Twitch event templates. " + usage)
+			return nil
+		}
+		items := []string{}
+		for _, template := range templates {
+			items = append(items, template.Event+": "+template.Bex)
+		}
+		env.ReplyRich(internal.RichMessage{Title: "Twitch event templates", Items: items})
+		return nil
+	}
+
+	event := strings.ToLower(fields[0])
+	if !internal.IsTwitchEventType(event) {
+		env.Reply(fmt.Sprintf("Unknown Twitch event `%s`. %s", fields[0], usage))
+		return nil
+	}
+
+	if len(fields) == 1 {
+		bex, ok, err := internal.QueryTwitchEventTemplate(db, event)
+		if err != nil {
+			return fmt.Errorf("could not query template of Twitch event %s: %w", event, err)
+		}
+		if !ok {
+			env.Reply(fmt.Sprintf("Twitch event %s is not announced", event))
+			return nil
+		}
+		env.Reply(event + ": " + bex)
+		return nil
+	}
+
+	bex := strings.TrimSpace(fields[1])
+	if bex == "off" {
+		deleted, err := internal.DeleteTwitchEventTemplate(db, event)
+		if err != nil {
+			return fmt.Errorf("could not delete template of Twitch event %s: %w", event, err)
+		}
+		if !deleted {
+			env.Reply(fmt.Sprintf("Twitch event %s is not announced", event))
+			return nil
+		}
+		env.Reply(fmt.Sprintf("Twitch event %s is not announced anymore", event))
+		return nil
+	}
+
+	if len(bex) > TwitchEventTemplateSizeLimit {
+		env.Reply(fmt.Sprintf("Template must be max %d bytes long", TwitchEventTemplateSizeLimit))
+		return nil
+	}
+	if _, err := internal.ParseAllExprs(bex); err != nil {
+		env.Reply(fmt.Sprintf("Could not parse the template: %s", err))
+		return nil
+	}
+
+	err := internal.UpsertTwitchEventTemplate(db, internal.TwitchEventTemplate{Event: event, Bex: bex})
+	if err != nil {
+		return fmt.Errorf("could not update template of Twitch event %s: %w", event, err)
+	}
+	env.Reply(fmt.Sprintf("Twitch event %s is announced", event))
+	return nil
+}
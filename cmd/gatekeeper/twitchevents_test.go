@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"testing"
+)
+
+func parseTwitchUserNoticeLine(t *testing.T, line string) (internal.TwitchEvent, bool) {
+	t.Helper()
+	msg, ok := ParseIrcMsg(line)
+	if !ok {
+		t.Fatalf("could not parse %q", line)
+	}
+	return ParseTwitchUserNotice(msg)
+}
+
+func TestParseTwitchUserNotice(t *testing.T) {
+	cases := []struct{
+		line     string
+		expected internal.TwitchEvent
+	}{
+		{
+			"@display-name=Rexim;login=rexim;msg-id=sub;msg-param-cumulative-months=1;msg-param-sub-plan=Prime :tmi.twitch.tv USERNOTICE #tsoding",
+			internal.TwitchEvent{Type: "sub", Channel: "#tsoding", User: "Rexim", Login: "rexim", Months: 1, Plan: "Prime"},
+		},
+		{
+			"@display-name=Rexim;login=rexim;msg-id=resub;msg-param-cumulative-months=42;msg-param-sub-plan=2000 :tmi.twitch.tv USERNOTICE #tsoding :Hello, Mr. Zozin",
+			internal.TwitchEvent{Type: "resub", Channel: "#tsoding", User: "Rexim", Login: "rexim", Months: 42, Plan: "Tier 2"},
+		},
+		{
+			"@display-name=Rexim;login=rexim;msg-id=subgift;msg-param-months=3;msg-param-recipient-display-name=Zozin;msg-param-recipient-user-name=zozin;msg-param-sub-plan=1000 :tmi.twitch.tv USERNOTICE #tsoding",
+			internal.TwitchEvent{Type: "subgift", Channel: "#tsoding", User: "Rexim", Login: "rexim", Months: 3, Recipient: "Zozin", Count: 1, Plan: "Tier 1"},
+		},
+		{
+			"@display-name=AnAnonymousGifter;login=ananonymousgifter;msg-id=anonsubmysterygift;msg-param-mass-gift-count=5;msg-param-sub-plan=1000 :tmi.twitch.tv USERNOTICE #tsoding",
+			internal.TwitchEvent{Type: "submysterygift", Channel: "#tsoding", User: "AnAnonymousGifter", Login: "ananonymousgifter", Count: 5, Plan: "Tier 1"},
+		},
+		{
+			"@display-name=Rexim;login=rexim;msg-id=raid;msg-param-displayName=Rexim;msg-param-login=rexim;msg-param-viewerCount=69 :tmi.twitch.tv USERNOTICE #Tsoding",
+			internal.TwitchEvent{Type: "raid", Channel: "#tsoding", User: "Rexim", Login: "rexim", Viewers: 69},
+		},
+	}
+	for _, c := range cases {
+		event, ok := parseTwitchUserNoticeLine(t, c.line)
+		if !ok {
+			t.Errorf("%q: expected an event", c.line)
+			continue
+		}
+		if event != c.expected {
+			t.Errorf("%q: expected %+v, but got %+v", c.line, c.expected, event)
+		}
+	}
+}
+
+func TestParseTwitchUserNoticeIgnored(t *testing.T) {
+	lines := []string{
+		// Part of a submysterygift which is announced on its own
+		"@display-name=Rexim;login=rexim;msg-id=subgift;msg-param-community-gift-id=123;msg-param-recipient-display-name=Zozin :tmi.twitch.tv USERNOTICE #tsoding",
+		"@display-name=Rexim;login=rexim;msg-id=ritual;msg-param-ritual-name=new_chatter :tmi.twitch.tv USERNOTICE #tsoding :HeyGuys",
+		":tmi.twitch.tv USERNOTICE #tsoding",
+	}
+	for _, line := range lines {
+		if event, ok := parseTwitchUserNoticeLine(t, line); ok {
+			t.Errorf("%q: expected no event, but got %+v", line, event)
+		}
+	}
+}
+
+func TestEvalTwitchEventTemplate(t *testing.T) {
+	env := &FakeEnvironment{PlatformName: "twitch", Channel: "#tsoding"}
+	event := internal.TwitchEvent{Type: "raid", Channel: "#tsoding", User: "Rexim", Login: "rexim", Viewers: 69}
+	err := evalTwitchEventTemplate(env, event, `say("Thank you for the raid, @", event_user(), "! Welcome, ", event_viewers(), " raiders!")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, env.Messages, "Thank you for the raid, @Rexim! Welcome, 69 raiders!")
+
+	if err := evalTwitchEventTemplate(env, event, `say(event_user("x"))`); err == nil {
+		t.Errorf("expected the event functions to reject the arguments")
+	}
+}
+
+func TestTwitchEventFuncsOutsideEvents(t *testing.T) {
+	env := &FakeEnvironment{PlatformName: "twitch", Channel: "#tsoding"}
+	exprs, err := internal.ParseAllExprs(`say(event_user())`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := EvalContextFromCommandEnvironment(env, Command{}, 0)
+	if _, err := context.EvalExpr(exprs[0]); err == nil {
+		t.Errorf("expected event_user() to be unavailable outside of the Twitch events")
+	}
+}
+
+func TestTwitchEventCommandUnknownEvent(t *testing.T) {
+	env := &FakeEnvironment{PlatformName: "discord", UserId: "69"}
+	err := EvalTwitchEventCommand(nil, Command{Name: "twitchevent", Args: "follow say(\"hi\")"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, env.Messages, "@69 Unknown Twitch event `follow`. Usage: twitchevent [<sub|resub|subgift|submysterygift|raid> [<bex>|off]]")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chat bots that commonly hang out in the Twitch channels. Their
+// messages are logged, but not fed to Carrotson.
+var DefaultTwitchBots = []string{"nightbot", "streamelements", "streamlabs", "moobot", "fossabot", "wizebot", "soundalerts"}
+
+// DefaultTwitchBots plus the ones from GATEKEEPER_TWITCH_BOTS
+var TwitchBots = func() []string {
+	bots := append([]string{}, DefaultTwitchBots...)
+	for _, bot := range strings.Split(os.Getenv("GATEKEEPER_TWITCH_BOTS"), ",") {
+		bot = strings.ToLower(strings.TrimSpace(bot))
+		if len(bot) > 0 {
+			bots = appendUnique(bots, bot)
+		}
+	}
+	return bots
+}()
+
+func isTwitchBot(handle string) bool {
+	for _, bot := range TwitchBots {
+		if strings.EqualFold(handle, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+func logTwitchMessage(db *sql.DB, env *TwitchEnvironment, text string) {
+	_, err := db.Exec("INSERT INTO Twitch_Log (message_id, channel, user_id, user_name, text) VALUES ($1, $2, $3, $4, $5)", env.MessageId, env.Channel, env.UserId, env.AuthorHandle, text);
+	if err != nil {
+		log.Println("ERROR: logTwitchMessage: could not insert element", env.Channel, env.AuthorHandle, text, ":", err);
+		return
+	}
+}
+
+// Whether the message (that is not a command of ours) should be fed to
+// Carrotson. Skips the channels that did not opt in, the other bots,
+// their commands and the links.
+func shouldFeedTwitchMessageToCarrotson(env *TwitchEnvironment, text string) bool {
+	if !TwitchChannels.Settings(env.Channel).Carrotson {
+		return false
+	}
+	if isTwitchBot(env.AuthorHandle) {
+		return false
+	}
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return false
+	}
+	// Commands of the other bots like !so, $song, ?uptime
+	first, _ := utf8.DecodeRuneInString(text)
+	if unicode.IsPunct(first) || unicode.IsSymbol(first) {
+		return false
+	}
+	if URLRegexp.MatchString(text) || strings.Contains(strings.ToLower(text), "www.") {
+		return false
+	}
+	return true
+}
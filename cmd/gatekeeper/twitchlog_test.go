@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/tsoding/gatekeeper/internal"
+	"testing"
+)
+
+func TestShouldFeedTwitchMessageToCarrotson(t *testing.T) {
+	withTwitchChannels(t, []string{"#tsoding", "#rexim"}, []internal.TwitchChannelSettings{
+		{Channel: "#tsoding", CustomCommands: true, Timers: true, Carrotson: true},
+	})
+	cases := []struct{
+		channel  string
+		author   string
+		text     string
+		expected bool
+	}{
+		{"#tsoding", "rexim", "Hello chat", true},
+		{"#tsoding", "rexim", "   ", false},
+		// The channel did not opt in
+		{"#rexim", "rexim", "Hello chat", false},
+		{"#tsoding", "Nightbot", "Follow the stream", false},
+		{"#tsoding", "rexim", "$song", false},
+		{"#tsoding", "rexim", "?uptime", false},
+		{"#tsoding", "rexim", "check out https://example.com", false},
+		{"#tsoding", "rexim", "check out www.example.com", false},
+	}
+	for _, c := range cases {
+		env := &TwitchEnvironment{AuthorHandle: c.author, Channel: c.channel}
+		if actual := shouldFeedTwitchMessageToCarrotson(env, c.text); actual != c.expected {
+			t.Errorf("%s %s %q: expected %v, but got %v", c.channel, c.author, c.text, c.expected, actual)
+		}
+	}
+}
+
+func TestSpammersCommandUnsupportedPlatform(t *testing.T) {
+	env := &FakeEnvironment{PlatformName: "irc", UserId: "69"}
+	err := evalSpammersCommand(nil, Command{Name: "topspammers"}, env, "Top Spammers", "desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessages(t, env.Messages, "@69 This command only works in Discord and Twitch, sorry")
+}
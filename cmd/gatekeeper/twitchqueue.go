@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// https://dev.twitch.tv/docs/irc/#rate-limits
+const (
+	TwitchRateLimitWindow = 30 * time.Second
+	TwitchRateLimit = 20
+	// In the channels where the bot is a moderator or the broadcaster
+	TwitchModeratorRateLimit = 100
+	// So the messages are never interpreted as chat commands like /ban
+	TwitchMessagePrefix = ". "
+	// Pushing more than that while the bot is rate limited or
+	// reconnecting drops the messages
+	TwitchSendQueueLimit = 100
+)
+
+type twitchSentMessage struct {
+	text string
+	at   time.Time
+}
+
+// Outgoing messages of the TwitchConn. Unlike the connection itself it
+// survives the reconnects, so the TwitchEnvironments never write into a
+// stale connection.
+type TwitchSendQueue struct {
+	mutex sync.Mutex
+	pending []IrcMsg
+	// Signals the TwitchConn that something was pushed
+	wakeup chan struct{}
+	// When the messages within the TwitchRateLimitWindow were sent
+	sentAt []time.Time
+	// The last message sent to the channel. Key is the channel.
+	lastSent map[string]twitchSentMessage
+	// The channels where the bot is a moderator or the broadcaster.
+	// Comes from the USERSTATE.
+	moderator map[string]bool
+}
+
+func newTwitchSendQueue() *TwitchSendQueue {
+	return &TwitchSendQueue{
+		wakeup: make(chan struct{}, 1),
+		lastSent: map[string]twitchSentMessage{},
+		moderator: map[string]bool{},
+	}
+}
+
+// Splits the text into the parts of at most limit characters and
+// byteLimit bytes, preferably at the spaces
+func SplitChatMessage(text string, limit int, byteLimit int) []string {
+	parts := []string{}
+	runes := []rune(strings.TrimSpace(text))
+	for len(runes) > 0 {
+		// The longest prefix that fits into both of the limits
+		fit, size := 0, 0
+		for fit < len(runes) && fit < limit && size + utf8.RuneLen(runes[fit]) <= byteLimit {
+			size += utf8.RuneLen(runes[fit])
+			fit += 1
+		}
+		if fit == len(runes) {
+			parts = append(parts, string(runes))
+			break
+		}
+		split := fit
+		for i := fit; i > fit/2; i -= 1 {
+			if runes[i] == ' ' {
+				split = i
+				break
+			}
+		}
+		parts = append(parts, strings.TrimSpace(string(runes[:split])))
+		runes = []rune(strings.TrimSpace(string(runes[split:])))
+	}
+	return parts
+}
+
+func (queue *TwitchSendQueue) Push(channel string, tags map[string]string, text string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	// Longer messages are split instead of being dropped by Twitch or
+	// truncated by IrcMsg.Send()
+	byteLimit := IrcMaxMessageLength - len(IrcCmdPrivmsg + " " + channel + " :" + TwitchMessagePrefix + "\r\n")
+	for _, part := range SplitChatMessage(text, TwitchMessageLimit, byteLimit) {
+		if len(queue.pending) >= TwitchSendQueueLimit {
+			log.Printf("Twitch: send queue is full, dropping message for channel %s: %s\n", channel, part)
+			continue
+		}
+		queue.pending = append(queue.pending, IrcMsg{
+			Tags: tags,
+			Name: IrcCmdPrivmsg,
+			Args: []string{channel, TwitchMessagePrefix + part},
+		})
+	}
+
+	select {
+	case queue.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (queue *TwitchSendQueue) Wakeup() <-chan struct{} {
+	return queue.wakeup
+}
+
+func (queue *TwitchSendQueue) SetModerator(channel string, moderator bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.moderator[channel] = moderator
+}
+
+// Returns the next message if the rate limit allows to send it at the
+// moment now and records it as sent. Otherwise returns how long to wait
+// before trying again. The wait is 0 when the queue is empty.
+func (queue *TwitchSendQueue) Pop(now time.Time) (IrcMsg, time.Duration, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	recent := []time.Time{}
+	for _, at := range queue.sentAt {
+		if now.Sub(at) < TwitchRateLimitWindow {
+			recent = append(recent, at)
+		}
+	}
+	queue.sentAt = recent
+
+	for len(queue.pending) > 0 {
+		msg := queue.pending[0]
+		channel, text := msg.Args[0], msg.Args[1]
+
+		// Twitch silently drops the message identical to the previous
+		// one within the window anyway
+		if last, ok := queue.lastSent[channel]; ok && last.text == text && now.Sub(last.at) < TwitchRateLimitWindow {
+			log.Printf("Twitch: dropping duplicate message for channel %s: %s\n", channel, text)
+			queue.pending = queue.pending[1:]
+			continue
+		}
+
+		limit := TwitchRateLimit
+		if queue.moderator[channel] {
+			limit = TwitchModeratorRateLimit
+		}
+		if len(queue.sentAt) >= limit {
+			// Wait until enough of the recent messages leave the window
+			return IrcMsg{}, queue.sentAt[len(queue.sentAt)-limit].Add(TwitchRateLimitWindow).Sub(now), false
+		}
+
+		queue.pending = queue.pending[1:]
+		queue.sentAt = append(queue.sentAt, now)
+		queue.lastSent[channel] = twitchSentMessage{text: text, at: now}
+		return msg, 0, true
+	}
+
+	return IrcMsg{}, 0, false
+}
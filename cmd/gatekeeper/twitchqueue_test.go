@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitChatMessage(t *testing.T) {
+	expectMessages(t, SplitChatMessage("hello world", 5, 500), "hello", "world")
+	expectMessages(t, SplitChatMessage("abcdefgh", 3, 500), "abc", "def", "gh")
+	expectMessages(t, SplitChatMessage("  short  ", 500, 500), "short")
+	expectMessages(t, SplitChatMessage("", 500, 500))
+	// Splits by the characters, not the bytes
+	expectMessages(t, SplitChatMessage("привет мир", 6, 500), "привет", "мир")
+	// Unless the bytes don't fit
+	expectMessages(t, SplitChatMessage("привет мир", 500, 13), "привет", "мир")
+	expectMessages(t, SplitChatMessage("приветмир", 500, 7), "при", "вет", "мир")
+}
+
+func TestTwitchSendQueueFitsIrcMessage(t *testing.T) {
+	// Distinct words, so the parts are not dropped as duplicates
+	words := func(word string) string {
+		sb := strings.Builder{}
+		for i := 0; i < 300; i += 1 {
+			sb.WriteString(fmt.Sprintf("%s%d ", word, i))
+		}
+		return sb.String()
+	}
+	for _, text := range []string{words("a"), words("я"), words("🍆"), strings.Repeat("я", 300)} {
+		queue := newTwitchSendQueue()
+		queue.Push("#tsoding", nil, text)
+		sent := strings.Builder{}
+		for {
+			msg, _, ok := queue.Pop(time.Now())
+			if !ok {
+				break
+			}
+			if length := len([]rune(msg.Args[1])); length > 500 {
+				t.Errorf("part of %d characters is too long for Twitch", length)
+			}
+			if _, ok := msg.String(); !ok {
+				t.Errorf("part %q does not fit into IRC message", msg.Args[1])
+			}
+			sent.WriteString(strings.TrimPrefix(msg.Args[1], TwitchMessagePrefix))
+		}
+		if strings.ReplaceAll(sent.String(), " ", "") != strings.ReplaceAll(text, " ", "") {
+			t.Errorf("the parts don't add up to the original message")
+		}
+	}
+}
+
+func popAll(queue *TwitchSendQueue, now time.Time) []string {
+	texts := []string{}
+	for {
+		msg, _, ok := queue.Pop(now)
+		if !ok {
+			return texts
+		}
+		texts = append(texts, msg.Args[0]+" "+msg.Args[1])
+	}
+}
+
+func TestTwitchSendQueueSplitsLongMessages(t *testing.T) {
+	queue := newTwitchSendQueue()
+	queue.Push("#tsoding", map[string]string{"reply-parent-msg-id": "42"}, strings.Repeat("x", TwitchMessageLimit+10))
+	now := time.Now()
+	first, _, ok := queue.Pop(now)
+	if !ok || first.Args[1] != TwitchMessagePrefix+strings.Repeat("x", TwitchMessageLimit) || first.Tags["reply-parent-msg-id"] != "42" {
+		t.Fatalf("unexpected first part %#v", first)
+	}
+	expectMessages(t, popAll(queue, now), "#tsoding "+TwitchMessagePrefix+strings.Repeat("x", 10))
+}
+
+func TestTwitchSendQueueRateLimit(t *testing.T) {
+	queue := newTwitchSendQueue()
+	for i := 0; i < TwitchRateLimit+1; i += 1 {
+		queue.Push("#tsoding", nil, strings.Repeat("x", i+1))
+	}
+
+	start := time.Now()
+	if sent := popAll(queue, start); len(sent) != TwitchRateLimit {
+		t.Fatalf("expected %d messages to be sent, but got %d", TwitchRateLimit, len(sent))
+	}
+	_, wait, ok := queue.Pop(start.Add(time.Second))
+	if ok || wait != TwitchRateLimitWindow-time.Second {
+		t.Fatalf("expected to wait %s, but got %s %v", TwitchRateLimitWindow-time.Second, wait, ok)
+	}
+	if sent := popAll(queue, start.Add(TwitchRateLimitWindow)); len(sent) != 1 {
+		t.Fatalf("expected the last message to be sent after the window, but got %q", sent)
+	}
+	if _, wait, ok := queue.Pop(start.Add(TwitchRateLimitWindow)); ok || wait != 0 {
+		t.Fatalf("expected the queue to be empty")
+	}
+}
+
+func TestTwitchSendQueueModeratorRateLimit(t *testing.T) {
+	queue := newTwitchSendQueue()
+	queue.SetModerator("#tsoding", true)
+	for i := 0; i < TwitchRateLimit+1; i += 1 {
+		queue.Push("#tsoding", nil, strings.Repeat("x", i+1))
+	}
+	queue.Push("#rexim", nil, "not a moderator here")
+
+	now := time.Now()
+	if sent := popAll(queue, now); len(sent) != TwitchRateLimit+1 {
+		t.Fatalf("expected %d messages to be sent, but got %d", TwitchRateLimit+1, len(sent))
+	}
+	if _, wait, ok := queue.Pop(now); ok || wait <= 0 {
+		t.Fatalf("expected the message to #rexim to wait for the rate limit")
+	}
+}
+
+func TestTwitchSendQueueDropsDuplicates(t *testing.T) {
+	queue := newTwitchSendQueue()
+	queue.Push("#tsoding", nil, "hello")
+	queue.Push("#tsoding", nil, "hello")
+	queue.Push("#rexim", nil, "hello")
+	queue.Push("#tsoding", nil, "world")
+	queue.Push("#tsoding", nil, "hello")
+
+	now := time.Now()
+	expectMessages(t, popAll(queue, now),
+		"#tsoding . hello",
+		"#rexim . hello",
+		"#tsoding . world",
+		"#tsoding . hello")
+
+	// The same message is fine after the window
+	queue.Push("#tsoding", nil, "hello")
+	expectMessages(t, popAll(queue, now.Add(time.Second)))
+	queue.Push("#tsoding", nil, "hello")
+	expectMessages(t, popAll(queue, now.Add(TwitchRateLimitWindow)), "#tsoding . hello")
+}
+
+func TestTwitchSendQueueLimit(t *testing.T) {
+	queue := newTwitchSendQueue()
+	for i := 0; i < TwitchSendQueueLimit+10; i += 1 {
+		queue.Push("#tsoding", nil, strings.Repeat("x", i+1))
+	}
+	if len(queue.pending) != TwitchSendQueueLimit {
+		t.Fatalf("expected %d pending messages, but got %d", TwitchSendQueueLimit, len(queue.pending))
+	}
+}
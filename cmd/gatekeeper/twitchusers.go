@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/tsoding/gatekeeper/internal"
+	"log"
+	"strings"
+	"sync"
+)
+
+var TwitchUsers = TwitchUserList{}
+
+// Live copy of the Twitch_Users table. The logins of the users are only
+// needed to refer to them by the nickname, the identity is the stable
+// user id. See TwitchEnvironment.UniversalPlatformAgnosticUserID()
+type TwitchUserList struct {
+	mutex sync.RWMutex
+	// Key is the user id
+	logins map[string]string
+	// Key is the login
+	userIds map[string]string
+}
+
+func (users *TwitchUserList) update(rows []internal.TwitchUser) {
+	logins := map[string]string{}
+	userIds := map[string]string{}
+	for _, row := range rows {
+		logins[row.UserId] = row.Login
+		userIds[row.Login] = row.UserId
+	}
+
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	users.logins = logins
+	users.userIds = userIds
+}
+
+func (users *TwitchUserList) set(user internal.TwitchUser) {
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	if users.logins == nil {
+		users.logins = map[string]string{}
+		users.userIds = map[string]string{}
+	}
+	if previous, ok := users.logins[user.UserId]; ok && users.userIds[previous] == user.UserId {
+		delete(users.userIds, previous)
+	}
+	users.logins[user.UserId] = user.Login
+	users.userIds[user.Login] = user.UserId
+}
+
+func (users *TwitchUserList) Reload(db *sql.DB) error {
+	rows, err := internal.QueryTwitchUsers(db)
+	if err != nil {
+		return err
+	}
+	users.update(rows)
+	return nil
+}
+
+func (users *TwitchUserList) Login(userId string) (string, bool) {
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+	login, ok := users.logins[userId]
+	return login, ok
+}
+
+func (users *TwitchUserList) UserId(login string) (string, bool) {
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+	userId, ok := users.userIds[strings.ToLower(login)]
+	return userId, ok
+}
+
+// Remembers the login of the author. The first time the author is seen
+// the state attached to their nickname is moved to the stable id.
+func (users *TwitchUserList) Seen(db *sql.DB, env *TwitchEnvironment) {
+	if db == nil || len(env.UserId) == 0 || len(env.AuthorHandle) == 0 {
+		return
+	}
+	user := internal.TwitchUser{UserId: env.UserId, Login: strings.ToLower(env.AuthorHandle)}
+	if login, ok := users.Login(user.UserId); ok && login == user.Login {
+		return
+	}
+
+	migrated, err := internal.RecordTwitchUser(db, user, twitchLegacyUserId(user.Login), twitchStableUserId(user.UserId))
+	if err != nil {
+		log.Printf("Error while recording Twitch user %s (%s): %s\n", user.Login, user.UserId, err)
+		return
+	}
+	users.set(user)
+	if migrated {
+		log.Printf("Moved the state of Twitch user %s to their stable id %s\n", user.Login, user.UserId)
+		if err := Roles.Reload(db); err != nil {
+			log.Println("Error reloading roles:", err)
+		}
+		if err := Identities.Reload(db); err != nil {
+			log.Println("Error reloading identity links:", err)
+		}
+	}
+}
+
+func LoadTwitchUsers(db *sql.DB) {
+	if db == nil {
+		return
+	}
+	err := TwitchUsers.Reload(db)
+	if err != nil {
+		log.Println("Error loading Twitch users:", err)
+	}
+}
+
+func twitchStableUserId(userId string) string {
+	return "twitch-id#" + userId
+}
+
+// The ids of the Twitch users before the stable ids
+func twitchLegacyUserId(login string) string {
+	return "twitch#" + strings.ToLower(login)
+}
+
+// The stable id of the user with the login if they were ever seen, the
+// legacy one otherwise. The legacy one is moved to the stable id when
+// the user shows up.
+func twitchUserIdOfLogin(login string) string {
+	login = strings.ToLower(strings.TrimPrefix(login, "@"))
+	if userId, ok := TwitchUsers.UserId(login); ok {
+		return twitchStableUserId(userId)
+	}
+	return twitchLegacyUserId(login)
+}
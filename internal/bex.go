@@ -1,5 +1,5 @@
 // Stolen from: https://gitlab.com/tsoding/bex/
-package main
+package internal
 
 import (
 	"fmt"
@@ -7,6 +7,8 @@ import (
 	"unicode"
 	"strings"
 	"strconv"
+	"math/rand"
+	"time"
 )
 
 type ExprType int
@@ -144,7 +146,7 @@ func parseFuncallArgs(sourceRunes []rune) ([]rune, []Expr, error) {
 	}
 
 	for {
-		restRunes, arg, err := parseExpr(sourceRunes)
+		restRunes, arg, err := ParseExpr(sourceRunes)
 		args = append(args, arg)
 		if err != nil {
 			return restRunes, args, err
@@ -167,11 +169,9 @@ func parseFuncallArgs(sourceRunes []rune) ([]rune, []Expr, error) {
 		sourceRunes = sourceRunes[1:]
 		sourceRunes = trimRunes(sourceRunes)
 	}
-
-	panic("parseFuncallArgs: unreachable")
 }
 
-func parseExpr(sourceRunes []rune) ([]rune, Expr, error) {
+func ParseExpr(sourceRunes []rune) ([]rune, Expr, error) {
 	sourceRunes = trimRunes(sourceRunes)
 	expr := Expr{}
 	if len(sourceRunes) > 0 {
@@ -255,7 +255,7 @@ func ParseAllExprs(source string) ([]Expr, error) {
 	sourceRunes := []rune(source)
 	exprs := []Expr{}
 	for {
-		restRunes, expr, err := parseExpr(sourceRunes)
+		restRunes, expr, err := ParseExpr(sourceRunes)
 		if err != nil {
 			if err == EndOfSource {
 				err = nil
@@ -274,6 +274,25 @@ type EvalScope struct {
 type EvalContext struct {
 	Scopes []EvalScope
 	EvalPoints int
+	// Sources of randomness and time for the functions. If not set
+	// the global ones are used. Set them to make the evaluation
+	// deterministic, for instance, in tests.
+	Rand *rand.Rand
+	Now func() time.Time
+}
+
+func (context *EvalContext) Intn(n int) int {
+	if context.Rand != nil {
+		return context.Rand.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+func (context *EvalContext) TimeNow() time.Time {
+	if context.Now != nil {
+		return context.Now()
+	}
+	return time.Now()
 }
 
 func (context *EvalContext) LookUpFunc(name string) (Func, bool) {
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingBexEnvironment struct {
+	platform string
+	messages []string
+}
+
+func (env *recordingBexEnvironment) AtAuthor() string {
+	return "@alice"
+}
+
+func (env *recordingBexEnvironment) Platform() string {
+	return env.platform
+}
+
+func (env *recordingBexEnvironment) SendMessage(message string) {
+	env.messages = append(env.messages, message)
+}
+
+func (env *recordingBexEnvironment) SendRichMessage(message RichMessage) {
+	env.messages = append(env.messages, message.Flatten())
+}
+
+// Evaluates the source the same way the custom commands are evaluated
+// and returns the sent messages
+func evalBex(t *testing.T, platform string, input string, source string) ([]string, error) {
+	t.Helper()
+	exprs, err := ParseAllExprs(source)
+	if err != nil {
+		t.Fatalf("could not parse %q: %s", source, err)
+	}
+	env := &recordingBexEnvironment{platform: platform}
+	context := NewEvalContext(env, input, 1)
+	context.Rand = rand.New(rand.NewSource(69))
+	context.Now = func() time.Time {
+		return time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	for _, expr := range exprs {
+		if _, err := context.EvalExpr(expr); err != nil {
+			return env.messages, err
+		}
+	}
+	return env.messages, nil
+}
+
+func TestParseAllExprs(t *testing.T) {
+	exprs, err := ParseAllExprs(`say("hello", 69) foo() 420`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exprs) != 3 {
+		t.Fatalf("expected 3 expressions, but got %d", len(exprs))
+	}
+	if exprs[0].String() != `say("hello", 69)` || exprs[1].String() != "foo" || exprs[2].String() != "420" {
+		t.Fatalf("unexpected expressions %s %s %s", exprs[0].String(), exprs[1].String(), exprs[2].String())
+	}
+
+	for _, source := range []string{`say(`, `say("hello"`, `say("a" "b")`, `"unclosed`} {
+		if _, err := ParseAllExprs(source); err == nil {
+			t.Errorf("%q: expected a parse error", source)
+		}
+	}
+}
+
+func TestBexFuncs(t *testing.T) {
+	cases := []struct {
+		platform string
+		input    string
+		source   string
+		expected []string
+	}{
+		{"twitch", "", `say("Hello, ", author(), "!")`, []string{"Hello, @alice!"}},
+		{"twitch", "world", `say(concat("hello ", input()), count())`, []string{"hello world1"}},
+		{"twitch", "", `say(add(34, 35), " ", sub(500, 80), " ", sub(5))`, []string{"69 420 -5"}},
+		{"twitch", "", `say(uppercase("abc", 1)) say(urlencode("a b/c"))`, []string{"ABC1", "a%20b%2Fc"}},
+		{"twitch", "", `say(or("", 0, "x", "y"))`, []string{"x"}},
+		{"twitch", "", `say(replace("o+", "foo boo", "0"))`, []string{"f0 b0"}},
+		{"twitch", "", `say(year(), " ", days_left_until("2000-01-31"))`, []string{"2000 30"}},
+		{"twitch", "", `say(twitch_or_discord("twitch", "discord"))`, []string{"twitch"}},
+		{"discord", "", `say(twitch_or_discord("twitch", "discord"))`, []string{"discord"}},
+		{"twitch", "", `discord(say("secret"))`, []string{"@alice This command is only for discord, sorry"}},
+		{"discord", "", `discord(say("secret"))`, []string{"secret"}},
+		{"twitch", "", `let(x(34), y(35), do(say(add(x, y))))`, []string{"69"}},
+		{"twitch", "", `do(say("a"), say("b"))`, []string{"a", "b"}},
+		{"twitch", "", `say(fancy("ab"))`, []string{"𝓪𝓫"}},
+		{"twitch", "", `rich(rich_title("Schedule"), "Streams ", 3, rich_item("Mon"), rich_item("Fri"))`, []string{"Schedule: Streams 3 | Mon, Fri"}},
+		{"twitch", "", `rich(rich_numbered(), rich_item("a"), rich_item("b"), rich_field("x", 1), rich_link("Docs", "https://example.com"))`, []string{"x: 1 | 1. a, 2. b | Docs https://example.com"}},
+		{"twitch", "", `let(t(rich_title("Hi")), do(rich(t, rich_code("a  b"))))`, []string{"Hi | a b"}},
+		// The names of the parts are free to be used in the let-bindings
+		{"twitch", "", `let(title("Hi"), link("https://example.com"), do(say(title, " ", link)))`, []string{"Hi https://example.com"}},
+	}
+	for _, c := range cases {
+		messages, err := evalBex(t, c.platform, c.input, c.source)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.source, err)
+			continue
+		}
+		if len(messages) != len(c.expected) {
+			t.Errorf("%s: expected %q, but got %q", c.source, c.expected, messages)
+			continue
+		}
+		for i := range messages {
+			if messages[i] != c.expected[i] {
+				t.Errorf("%s: expected %q, but got %q", c.source, c.expected, messages)
+				break
+			}
+		}
+	}
+}
+
+func TestBexErrors(t *testing.T) {
+	for _, source := range []string{
+		`nonexistent()`,
+		`say(add(1, "2"))`,
+		`choice()`,
+		`let(x(1), x(2), do())`,
+		`let(x(1), say(x))`,
+		`days_left_until("tomorrow")`,
+		`replace("(", "a", "b")`,
+		`rich()`,
+		`rich(say("x"))`,
+		`rich(rich_link("javascript:alert(1)"))`,
+		`rich(rich_title("a", "b"))`,
+		`rich(add(1, 2), rich_item())`,
+	} {
+		if _, err := evalBex(t, "twitch", "", source); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestBexChoiceIsDeterministic(t *testing.T) {
+	source := `say(choice("a", "b", "c", "d", "e", "f", "g", "h"))`
+	first, err := evalBex(t, "twitch", "", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i += 1 {
+		again, err := evalBex(t, "twitch", "", source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again[0] != first[0] {
+			t.Fatalf("the same seed chose %q and %q", first[0], again[0])
+		}
+	}
+}
+
+func TestBexEvalPoints(t *testing.T) {
+	// Each evaluated expression costs a point, so this can't run forever
+	source := `say(concat(1` + strings.Repeat(", 1", 200) + `))`
+	if _, err := evalBex(t, "twitch", "", source); err == nil {
+		t.Fatalf("expected the evaluation to run out of points")
+	}
+}
+
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The part of the environment of a command the custom commands have
+// access to. Kept small so the custom commands can be evaluated
+// outside of the bot, for instance by `gaslighter cmd test`.
+type BexEnvironment interface {
+	AtAuthor() string
+	// The name of the platform the command came from ("discord", "twitch", etc)
+	Platform() string
+	SendMessage(message string)
+	SendRichMessage(message RichMessage)
+}
+
+func NewEvalContext(env BexEnvironment, input string, count int64) EvalContext {
+	context := EvalContext{
+		EvalPoints: 100,
+		Scopes: []EvalScope{
+			EvalScope{
+				Funcs: map[string]Func{
+					"count": func(context *EvalContext, args []Expr) (Expr, error) {
+						return NewExprInt(int(count)), nil
+					},
+					"days_left_until": func(context *EvalContext, args []Expr) (Expr, error) {
+						if len(args) != 1 {
+							return Expr{}, fmt.Errorf("Expected 1 arguments")
+						}
+						result, err := context.EvalExpr(args[0])
+						if err != nil {
+							return Expr{}, err
+						}
+						if result.Type != ExprStr {
+							return Expr{}, fmt.Errorf("%s is not a String. Expected a String in a format YYYY-MM-DD.", result.String())
+						}
+						date, err := time.Parse("2006-01-02", result.AsStr)
+						if err != nil {
+							return Expr{}, fmt.Errorf("`%s` is not a valid date. Expected format YYYY-MM-DD.", result.AsStr)
+						}
+						return NewExprInt(int(math.Ceil(date.Sub(context.TimeNow()).Hours()/24))), nil
+					},
+					"twitch_or_discord": func(context *EvalContext, args []Expr) (result Expr, err error) {
+						if len(args) != 2 {
+							return Expr{}, fmt.Errorf("Expected 2 arguments")
+						}
+
+						if env.Platform() != "discord" {
+							result, err = context.EvalExpr(args[0])
+						} else {
+							result, err = context.EvalExpr(args[1])
+						}
+						return
+					},
+					"input": func(context *EvalContext, args []Expr) (Expr, error) {
+						if len(args) > 0 {
+							return Expr{}, fmt.Errorf("Too many arguments")
+						}
+						return NewExprStr(input), nil
+					},
+					"replace": func(context *EvalContext, args[]Expr) (Expr, error) {
+						arity := 3;
+						strlimit := 1024; // one replacement could potentially create a strlimit*strlimit string inside this block
+						if len(args) != arity {
+							return Expr{}, fmt.Errorf("replace: Expected %d arguments but got %d", arity, len(args))
+						}
+
+						regExpr, err := context.EvalExpr(args[0])
+						if err != nil {
+							return Expr{}, err
+						}
+						if regExpr.Type != ExprStr {
+							return Expr{}, fmt.Errorf("replace: Argument 1 is expected to be %s, but got %s", ExprTypeName(ExprStr), ExprTypeName(regExpr.Type))
+						}
+						if len(regExpr.AsStr) > strlimit {
+							return Expr{}, fmt.Errorf("replace: regexp exceeded string size limit of %d bytes",strlimit)
+						}
+
+						srcExpr, err := context.EvalExpr(args[1])
+						if err != nil {
+							return Expr{}, err
+						}
+						if srcExpr.Type != ExprStr {
+							return Expr{}, fmt.Errorf("replace: Argument 2 is expected to be %s, but got %s", ExprTypeName(ExprStr), ExprTypeName(srcExpr.Type))
+						}
+						if len(srcExpr.AsStr) > strlimit {
+							return Expr{}, fmt.Errorf("replace: source exceeded string size limit of %d bytes",strlimit)
+						}
+
+						replExpr, err := context.EvalExpr(args[2])
+						if err != nil {
+							return Expr{}, err
+						}
+						if replExpr.Type != ExprStr {
+							return Expr{}, fmt.Errorf("replace: Argument 3 is expected to be %s, but got %s", ExprTypeName(ExprStr), ExprTypeName(replExpr.Type))
+						}
+						if len(replExpr.AsStr) > strlimit {
+							return Expr{}, fmt.Errorf("replace: replacement exceeded string size limit of %d bytes",strlimit)
+						}
+
+						reg, err := regexp.Compile(regExpr.AsStr);
+						if err != nil {
+							return Expr{}, fmt.Errorf("replace: Could not compile regexp `%s`: %w", regExpr.AsStr, err)
+						}
+
+						out := string(reg.ReplaceAll([]byte(srcExpr.AsStr), []byte(replExpr.AsStr)))
+						if len(out) > strlimit {
+							out = out[:strlimit]
+						}
+
+						return NewExprStr(out), nil
+					},
+					"year": func(context *EvalContext, args []Expr) (Expr, error) {
+						if len(args) > 0 {
+							return Expr{}, fmt.Errorf("Too many arguments");
+						}
+						return NewExprInt(context.TimeNow().Year()), nil
+					},
+					"do": func(context *EvalContext, args []Expr) (result Expr, err error) {
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return result, err
+							}
+						}
+						return Expr{}, nil
+					},
+					"concat": func(context *EvalContext, args []Expr) (Expr, error) {
+						sb := strings.Builder{}
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return result, err
+							}
+							switch result.Type {
+							case ExprVoid:
+							case ExprInt: sb.WriteString(strconv.Itoa(result.AsInt))
+							case ExprStr: sb.WriteString(result.AsStr)
+							case ExprFuncall: return Expr{}, fmt.Errorf("`%s` is neither String nor Integer", result.String())
+							}
+						}
+						return NewExprStr(sb.String()), nil
+					},
+					"add": func(context *EvalContext, args []Expr) (Expr, error) {
+						sum := 0
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return result, err
+							}
+							if result.Type != ExprInt {
+								return Expr{}, fmt.Errorf("%s is not an integer", result.String())
+							}
+							sum += result.AsInt
+						}
+						return NewExprInt(sum), nil
+					},
+					"sub": func(context *EvalContext, args []Expr) (Expr, error) {
+						if len(args) == 0 {
+							return NewExprInt(0), nil
+						}
+						first, err := context.EvalExpr(args[0])
+						if err != nil {
+							return first, err
+						}
+						if first.Type != ExprInt {
+							return Expr{}, fmt.Errorf("%s is not an integer", first.String())
+						}
+						if len(args) == 1 {
+							return NewExprInt(-first.AsInt), nil
+						}
+						sum := first.AsInt
+						for _, arg := range args[1:] {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return result, err
+							}
+							if result.Type != ExprInt {
+								return Expr{}, fmt.Errorf("%s is not an integer", result.String())
+							}
+							sum -= result.AsInt
+						}
+						return NewExprInt(sum), nil
+					},
+					"author": func(context *EvalContext, args []Expr) (Expr, error) {
+						if len(args) > 0 {
+							return Expr{}, fmt.Errorf("Too many arguments");
+						}
+						return NewExprStr(env.AtAuthor()), nil
+					},
+					"or": func(context *EvalContext, args []Expr) (Expr, error) {
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return Expr{}, err
+							}
+							switch result.Type {
+							case ExprInt:
+								if result.AsInt != 0 {
+									return result, nil
+								}
+							case ExprStr:
+								if len(result.AsStr) != 0 {
+									return result, nil
+								}
+							case ExprFuncall:
+								return result, nil
+							}
+						}
+						return Expr{}, nil
+					},
+					"uppercase": func(context *EvalContext, args []Expr) (Expr, error) {
+						sb := strings.Builder{}
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return Expr{}, err
+							}
+
+							switch result.Type {
+							case ExprVoid:
+							case ExprInt:
+								sb.WriteString(strconv.Itoa(result.AsInt))
+							case ExprStr:
+								sb.WriteString(strings.ToUpper(result.AsStr));
+							default:
+								return Expr{}, fmt.Errorf("%s evaluated into %s which is neither Int, Str, nor Void. `uppercase` command cannot display that.", arg.String(), result.String());
+							}
+						}
+
+						return NewExprStr(sb.String()), nil
+					},
+					"urlencode": func(context *EvalContext, args []Expr) (Expr, error) {
+						sb := strings.Builder{}
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return Expr{}, err
+							}
+
+							switch result.Type {
+							case ExprVoid:
+							case ExprInt:
+								sb.WriteString(strconv.Itoa(result.AsInt))
+							case ExprStr:
+								sb.WriteString(result.AsStr);
+							default:
+								return Expr{}, fmt.Errorf("%s evaluated into %s which is neither Int, Str, nor Void. `urlencode` command cannot display that.", arg.String(), result.String());
+							}
+						}
+						return NewExprStr(url.PathEscape(sb.String())), nil
+					},
+					"say": func(context *EvalContext, args []Expr) (Expr, error) {
+						sb := strings.Builder{}
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return Expr{}, err
+							}
+
+							switch result.Type {
+							case ExprVoid:
+							case ExprInt:
+								sb.WriteString(strconv.Itoa(result.AsInt))
+							case ExprStr:
+								sb.WriteString(result.AsStr);
+							default:
+								return Expr{}, fmt.Errorf("%s evaluated into %s which is neither Int, Str, nor Void. `say` command cannot display that.", arg.String(), result.String());
+							}
+						}
+						env.SendMessage(sb.String())
+						return Expr{}, nil
+					},
+					"discord": func(context *EvalContext, args []Expr) (result Expr, err error) {
+						if env.Platform() != "discord" {
+							env.SendMessage(env.AtAuthor() + " This command is only for discord, sorry")
+							return
+						}
+						result, err = context.EvalExprs(args)
+						return
+					},
+					"choice": func(context *EvalContext, args []Expr) (result Expr, err error) {
+						if len(args) <= 0 {
+							return Expr{}, fmt.Errorf("Can't choose among zero options")
+						}
+						return context.EvalExpr(args[context.Intn(len(args))])
+					},
+					"let": func(context *EvalContext, args []Expr) (result Expr, err error) {
+						if len(args) <= 0 {
+							return Expr{}, nil
+						}
+						binds := args[:len(args)-1]
+						body := args[len(args)-1]
+						context.PushScope(EvalScope{
+							Funcs: map[string]Func{},
+						})
+						defer context.PopScope()
+						scope := &context.Scopes[len(context.Scopes)-1]
+						for _, bind := range binds {
+							if bind.Type != ExprFuncall {
+								return Expr{}, fmt.Errorf("`%s` is not a Funcall. Bindings must be Funcalls. For example: let(x(34), y(35), say(add(x, y))).", bind.String())
+							}
+							value := Expr{}
+							for _, arg := range bind.AsFuncall.Args {
+								value, err = context.EvalExpr(arg)
+								if err != nil {
+									return Expr{}, err
+								}
+							}
+							_, exists := context.LookUpFunc(bind.AsFuncall.Name)
+							if exists {
+								return Expr{}, fmt.Errorf("Redefinition of the let-binding `%s`", bind.AsFuncall.Name)
+							}
+							name := bind.AsFuncall.Name
+							scope.Funcs[name] = func(context *EvalContext, args []Expr) (Expr, error) {
+								if len(args) > 0 {
+									return Expr{}, fmt.Errorf("Let binding `%s` accepts 0 arguments, but you provided %v", name, len(args))
+								}
+								return value, nil
+							};
+						}
+						if body.Type == ExprFuncall && body.AsFuncall.Name != "do" {
+							return Expr{}, fmt.Errorf("Wrap `%s` in `do(%s)`", body.String(), body.String())
+						}
+						return context.EvalExpr(body)
+					},
+					"fancy": func(context *EvalContext, args []Expr) (result Expr, err error) {
+						sb := strings.Builder{}
+						for _, arg := range args {
+							result, err := context.EvalExpr(arg)
+							if err != nil {
+								return Expr{}, err
+							}
+
+							switch result.Type {
+							case ExprVoid:
+							case ExprInt:
+								sb.WriteString(strconv.Itoa(result.AsInt))
+							case ExprStr:
+								sb.WriteString(FancyTransform.Apply(env.Platform(), result.AsStr));
+							default:
+								return Expr{}, fmt.Errorf("%s evaluated into %s which is neither Int, Str, nor Void. `fancy` command cannot display that.", arg.String(), result.String());
+							}
+						}
+						return NewExprStr(sb.String()), nil
+					},
+				},
+			},
+		},
+	}
+	for name, fun := range richMessageFuncs(env) {
+		context.Scopes[0].Funcs[name] = fun
+	}
+	return context
+}
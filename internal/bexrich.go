@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const RichMessageSizeLimit = 4096
+
+// The functions that make the parts are prefixed, so they don't take
+// the common names like `title` or `link` away from let().
+const RichPartFuncPrefix = "rich_"
+
+// The parts of the rich message and the amount of the arguments they
+// accept. Evaluated into Funcalls with all the arguments evaluated into
+// Strs, so they can be passed around as values, for example with let().
+var RichMessageParts = map[string][]int{
+	"title":    {1},
+	"field":    {2},
+	"item":     {1},
+	"numbered": {0},
+	"code":     {1},
+	"link":     {1, 2},
+}
+
+func evalRichPartArg(context *EvalContext, arg Expr) (string, error) {
+	result, err := context.EvalExpr(arg)
+	if err != nil {
+		return "", err
+	}
+	switch result.Type {
+	case ExprVoid:
+		return "", nil
+	case ExprInt:
+		return strconv.Itoa(result.AsInt), nil
+	case ExprStr:
+		return result.AsStr, nil
+	default:
+		return "", fmt.Errorf("%s evaluated into %s which is neither Int, Str, nor Void", arg.String(), result.String())
+	}
+}
+
+func richPartFunc(name string, arities []int) Func {
+	return func(context *EvalContext, args []Expr) (Expr, error) {
+		arityOk := false
+		for _, arity := range arities {
+			arityOk = arityOk || arity == len(args)
+		}
+		if !arityOk {
+			return Expr{}, fmt.Errorf("%s%s: unexpected amount of arguments %d", RichPartFuncPrefix, name, len(args))
+		}
+		part := Funcall{Name: name}
+		for _, arg := range args {
+			value, err := evalRichPartArg(context, arg)
+			if err != nil {
+				return Expr{}, err
+			}
+			part.Args = append(part.Args, NewExprStr(value))
+		}
+		return Expr{Type: ExprFuncall, AsFuncall: part}, nil
+	}
+}
+
+func addRichPart(message *RichMessage, part Funcall) error {
+	if _, ok := RichMessageParts[part.Name]; !ok {
+		return fmt.Errorf("`%s` is not a part of a rich message", part.String())
+	}
+	args := []string{}
+	for _, arg := range part.Args {
+		if arg.Type != ExprStr {
+			return fmt.Errorf("%s: malformed part of a rich message", part.Name)
+		}
+		args = append(args, arg.AsStr)
+	}
+	arityOk := false
+	for _, arity := range RichMessageParts[part.Name] {
+		arityOk = arityOk || arity == len(args)
+	}
+	if !arityOk {
+		return fmt.Errorf("%s: malformed part of a rich message", part.Name)
+	}
+	switch part.Name {
+	case "title":
+		message.Title = args[0]
+	case "field":
+		message.Fields = append(message.Fields, RichField{Name: args[0], Value: args[1]})
+	case "item":
+		message.Items = append(message.Items, args[0])
+	case "numbered":
+		message.Numbered = true
+	case "code":
+		message.Code = args[0]
+	case "link":
+		link := RichLink{URL: args[len(args)-1]}
+		if len(args) == 2 {
+			link.Text = args[0]
+		}
+		if !strings.HasPrefix(link.URL, "https://") && !strings.HasPrefix(link.URL, "http://") {
+			return fmt.Errorf("link: `%s` is not an http(s) URL", link.URL)
+		}
+		message.Links = append(message.Links, link)
+	}
+	return nil
+}
+
+func richMessageFuncs(env BexEnvironment) map[string]Func {
+	funcs := map[string]Func{}
+	for name, arities := range RichMessageParts {
+		funcs[RichPartFuncPrefix+name] = richPartFunc(name, arities)
+	}
+	// Strs and Ints become the text of the message, the parts
+	// (rich_title(), rich_field(), etc) become the corresponding parts. For
+	// example: rich(rich_title("Schedule"), "Streams on", rich_item("Monday"), rich_item("Friday"))
+	funcs["rich"] = func(context *EvalContext, args []Expr) (Expr, error) {
+		message := RichMessage{}
+		size := 0
+		for _, arg := range args {
+			result, err := context.EvalExpr(arg)
+			if err != nil {
+				return Expr{}, err
+			}
+			switch result.Type {
+			case ExprVoid:
+			case ExprInt:
+				message.Text += strconv.Itoa(result.AsInt)
+			case ExprStr:
+				message.Text += result.AsStr
+			case ExprFuncall:
+				if err := addRichPart(&message, result.AsFuncall); err != nil {
+					return Expr{}, err
+				}
+				for _, partArg := range result.AsFuncall.Args {
+					size += len(partArg.AsStr)
+				}
+			}
+		}
+		size += len(message.Text)
+		if size > RichMessageSizeLimit {
+			return Expr{}, fmt.Errorf("rich: the message exceeded size limit of %d bytes", RichMessageSizeLimit)
+		}
+		if message.IsEmpty() {
+			return Expr{}, fmt.Errorf("rich: the message is empty")
+		}
+		env.SendRichMessage(message)
+		return Expr{}, nil
+	}
+	return funcs
+}
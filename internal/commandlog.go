@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const CommandLogErrorSize = 256
+
+type CommandInvocation struct {
+	Name     string
+	Platform string
+	Channel  string
+	UserId   string
+	Duration time.Duration
+	Err      error
+}
+
+func LogCommandInvocation(db *sql.DB, invocation CommandInvocation) error {
+	var errorText string
+	if invocation.Err != nil {
+		errorText = invocation.Err.Error()
+		if len([]rune(errorText)) > CommandLogErrorSize {
+			errorText = string([]rune(errorText)[:CommandLogErrorSize])
+		}
+	}
+	durationMs := float64(invocation.Duration) / float64(time.Millisecond)
+	_, err := db.Exec("INSERT INTO Command_Log (name, platform, channel, user_id, duration_ms, success, error) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		invocation.Name, invocation.Platform, invocation.Channel, invocation.UserId, durationMs, invocation.Err == nil, errorText)
+	return err
+}
+
+type CommandStats struct {
+	Name          string
+	Invocations   int64
+	Failures      int64
+	AvgDurationMs float64
+	MaxDurationMs float64
+}
+
+func (stats CommandStats) FailureRate() float64 {
+	if stats.Invocations == 0 {
+		return 0
+	}
+	return float64(stats.Failures) / float64(stats.Invocations)
+}
+
+type CommandStatsOrder int
+
+const (
+	ByInvocations CommandStatsOrder = iota
+	ByFailureRate
+	ByAvgDuration
+)
+
+func (order CommandStatsOrder) sql() string {
+	switch order {
+	case ByInvocations: return "invocations DESC"
+	case ByFailureRate: return "(failures::float / invocations) DESC, failures DESC"
+	case ByAvgDuration: return "avg_duration DESC"
+	}
+	panic("unreachable")
+}
+
+const commandStatsColumns = "name, count(*) AS invocations, count(*) FILTER (WHERE NOT success) AS failures, coalesce(avg(duration_ms), 0) AS avg_duration, coalesce(max(duration_ms), 0) AS max_duration"
+
+func scanCommandStats(rows *sql.Rows) ([]CommandStats, error) {
+	defer rows.Close()
+
+	result := []CommandStats{}
+	for rows.Next() {
+		stats := CommandStats{}
+		if err := rows.Scan(&stats.Name, &stats.Invocations, &stats.Failures, &stats.AvgDurationMs, &stats.MaxDurationMs); err != nil {
+			return nil, err
+		}
+		result = append(result, stats)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func QueryCommandStats(db *sql.DB, since time.Time, order CommandStatsOrder, limit int) ([]CommandStats, error) {
+	query := fmt.Sprintf("SELECT %s FROM Command_Log WHERE invoked_at >= $1 GROUP BY name ORDER BY %s LIMIT $2", commandStatsColumns, order.sql())
+	rows, err := db.Query(query, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCommandStats(rows)
+}
+
+func QueryCommandStatsByName(db *sql.DB, name string, since time.Time) (CommandStats, error) {
+	query := fmt.Sprintf("SELECT %s FROM Command_Log WHERE invoked_at >= $1 AND name = $2 GROUP BY name", commandStatsColumns)
+	rows, err := db.Query(query, since, name)
+	if err != nil {
+		return CommandStats{}, err
+	}
+	stats, err := scanCommandStats(rows)
+	if err != nil {
+		return CommandStats{}, err
+	}
+	if len(stats) == 0 {
+		return CommandStats{Name: name}, nil
+	}
+	return stats[0], nil
+}
+
+type DailyCommandStats struct {
+	Day   time.Time
+	Stats []CommandStats
+}
+
+func QueryDailyTopCommands(db *sql.DB, since time.Time, limit int) ([]DailyCommandStats, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT day, name, invocations, failures, avg_duration, max_duration FROM (
+    SELECT date_trunc('day', invoked_at) AS day, %s,
+           row_number() OVER (PARTITION BY date_trunc('day', invoked_at) ORDER BY count(*) DESC) AS place
+    FROM Command_Log WHERE invoked_at >= $1 GROUP BY day, name
+) AS daily WHERE place <= $2 ORDER BY day DESC, invocations DESC`, commandStatsColumns), since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []DailyCommandStats{}
+	for rows.Next() {
+		var day time.Time
+		stats := CommandStats{}
+		if err := rows.Scan(&day, &stats.Name, &stats.Invocations, &stats.Failures, &stats.AvgDurationMs, &stats.MaxDurationMs); err != nil {
+			return nil, err
+		}
+		if n := len(result); n == 0 || !result[n-1].Day.Equal(day) {
+			result = append(result, DailyCommandStats{Day: day})
+		}
+		result[len(result)-1].Stats = append(result[len(result)-1].Stats, stats)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
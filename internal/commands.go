@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+// NOTE: the size of Commands.name
+const CommandNameSizeLimit = 64
+
+var (
+	CommandNameDef    = "[a-zA-Z0-9\\-_]+"
+	CommandNameRegexp = regexp.MustCompile("^" + CommandNameDef + "$")
+)
+
+func VerifyCommandName(name string) error {
+	if !CommandNameRegexp.MatchString(name) {
+		return fmt.Errorf("Command name `%s` may only contain letters, digits, - and _", name)
+	}
+	if len(name) > CommandNameSizeLimit {
+		return fmt.Errorf("Command name `%s` is too long (max %d bytes)", name, CommandNameSizeLimit)
+	}
+	return nil
+}
+
+// A row of the Commands table
+type CustomCommand struct {
+	Name        string `json:"name"`
+	Bex         string `json:"bex"`
+	Count       int64  `json:"count"`
+	Description string `json:"description"`
+	// NOTE: "everyone" if the command is not restricted. See PermissionNames
+	Permission string `json:"permission"`
+}
+
+func QueryAllCustomCommands(db *sql.DB) ([]CustomCommand, error) {
+	rows, err := db.Query("SELECT name, bex, coalesce(count, 0), coalesce(description, ''), coalesce(permission, 'everyone') FROM Commands ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []CustomCommand{}
+	for rows.Next() {
+		command := CustomCommand{}
+		if err := rows.Scan(&command.Name, &command.Bex, &command.Count, &command.Description, &command.Permission); err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return commands, nil
+}
+
+// The usage counter of the existing command is only replaced if
+// overwriteCount is true
+func UpsertCustomCommand(tx *sql.Tx, command CustomCommand, overwriteCount bool) error {
+	query := "INSERT INTO Commands (name, bex, count, description, permission) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (name) DO UPDATE SET bex = EXCLUDED.bex, description = EXCLUDED.description, permission = EXCLUDED.permission"
+	if overwriteCount {
+		query += ", count = EXCLUDED.count"
+	}
+	_, err := tx.Exec(query+";", command.Name, command.Bex, command.Count, command.Description, command.Permission)
+	return err
+}
+
+func QueryCustomCommand(db *sql.DB, name string) (CustomCommand, bool, error) {
+	command := CustomCommand{}
+	err := db.QueryRow("SELECT name, bex, coalesce(count, 0), coalesce(description, ''), coalesce(permission, 'everyone') FROM Commands WHERE name = $1", name).Scan(&command.Name, &command.Bex, &command.Count, &command.Description, &command.Permission)
+	if err == sql.ErrNoRows {
+		return CustomCommand{}, false, nil
+	}
+	if err != nil {
+		return CustomCommand{}, false, err
+	}
+	return command, true, nil
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A row of the Identity_Links table
+type IdentityLink struct {
+	UserId      string
+	CanonicalId string
+}
+
+func QueryIdentityLinks(db *sql.DB) ([]IdentityLink, error) {
+	rows, err := db.Query("SELECT user_id, canonical_id FROM Identity_Links ORDER BY linked_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []IdentityLink{}
+	for rows.Next() {
+		link := IdentityLink{}
+		if err := rows.Scan(&link.UserId, &link.CanonicalId); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// Replaces any previous link code of the user
+func CreateLinkCode(db *sql.DB, userId string, code string, expiresAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM Link_Codes WHERE user_id = $1 OR expires_at < now()", userId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO Link_Codes (code, user_id, expires_at) VALUES ($1, $2, $3)", code, userId, expiresAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Consumes the code. Returns the user that created it or false if the
+// code does not exist or expired.
+func RedeemLinkCode(db *sql.DB, code string) (string, bool, error) {
+	var userId string
+	err := db.QueryRow("DELETE FROM Link_Codes WHERE code = $1 AND expires_at >= now() RETURNING user_id", code).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return userId, true, nil
+}
+
+// Attaches the user and everybody linked to them to the canonical user.
+// The canonicalId must not be linked to anybody else itself.
+func LinkIdentity(db *sql.DB, userId string, canonicalId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE Identity_Links SET canonical_id = $2 WHERE canonical_id = $1", userId, canonicalId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO Identity_Links (user_id, canonical_id) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET canonical_id = EXCLUDED.canonical_id, linked_at = now()", userId, canonicalId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Detaches the user from all the identities they are linked to. If the
+// user was the canonical one, the longest linked identity becomes the
+// canonical one for the rest.
+func UnlinkIdentity(db *sql.DB, userId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM Identity_Links WHERE user_id = $1", userId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var heirId string
+	err = tx.QueryRow("DELETE FROM Identity_Links WHERE user_id = (SELECT user_id FROM Identity_Links WHERE canonical_id = $1 ORDER BY linked_at LIMIT 1) RETURNING user_id", userId).Scan(&heirId)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE Identity_Links SET canonical_id = $2 WHERE canonical_id = $1", userId, heirId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"database/sql"
+)
+
+// A row of the Mod_Rules table
+type ModRule struct {
+	Id             int64
+	Kind           string
+	Pattern        string
+	Action         string
+	TimeoutSeconds int
+	// Only report the matches to the mod log without acting on them
+	DryRun bool
+}
+
+func QueryModRules(db *sql.DB) ([]ModRule, error) {
+	rows, err := db.Query("SELECT id, kind, pattern, action, timeout_seconds, dry_run FROM Mod_Rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []ModRule{}
+	for rows.Next() {
+		rule := ModRule{}
+		if err := rows.Scan(&rule.Id, &rule.Kind, &rule.Pattern, &rule.Action, &rule.TimeoutSeconds, &rule.DryRun); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func InsertModRule(db *sql.DB, rule ModRule) (int64, error) {
+	var id int64
+	err := db.QueryRow("INSERT INTO Mod_Rules (kind, pattern, action, timeout_seconds, dry_run) VALUES ($1, $2, $3, $4, $5) RETURNING id", rule.Kind, rule.Pattern, rule.Action, rule.TimeoutSeconds, rule.DryRun).Scan(&id)
+	return id, err
+}
+
+func modRuleAffected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// Returns false if there was no such rule
+func DeleteModRule(db *sql.DB, id int64) (bool, error) {
+	return modRuleAffected(db.Exec("DELETE FROM Mod_Rules WHERE id = $1", id))
+}
+
+// Returns false if there was no such rule
+func SetModRuleDryRun(db *sql.DB, id int64, dryRun bool) (bool, error) {
+	return modRuleAffected(db.Exec("UPDATE Mod_Rules SET dry_run = $1 WHERE id = $2", dryRun, id))
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	CommandPrefixSizeLimit  = 16
+	MaxCommandPrefixesCount = 5
+)
+
+type CommandPrefix struct {
+	Platform string
+	Channel  string
+	Prefix   string
+}
+
+func QueryCommandPrefixes(db *sql.DB) ([]CommandPrefix, error) {
+	rows, err := db.Query("SELECT platform, channel, prefix FROM Command_Prefixes ORDER BY platform, channel, prefix")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefixes := []CommandPrefix{}
+	for rows.Next() {
+		prefix := CommandPrefix{}
+		if err := rows.Scan(&prefix.Platform, &prefix.Channel, &prefix.Prefix); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return prefixes, nil
+}
+
+func VerifyCommandPrefix(prefix string) error {
+	if len(prefix) == 0 {
+		return fmt.Errorf("Prefix cannot be empty")
+	}
+	if len(prefix) > CommandPrefixSizeLimit {
+		return fmt.Errorf("Prefix `%s` is too long (max %d bytes)", prefix, CommandPrefixSizeLimit)
+	}
+	if strings.IndexFunc(prefix, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Prefix `%s` contains spaces", prefix)
+	}
+	return nil
+}
+
+// Checks the whole list of the prefixes of a channel before
+// SetCommandPrefixes()
+func VerifyCommandPrefixes(prefixes []string) error {
+	if len(prefixes) > MaxCommandPrefixesCount {
+		return fmt.Errorf("You may have %d prefixes maximum", MaxCommandPrefixesCount)
+	}
+	for _, prefix := range prefixes {
+		if err := VerifyCommandPrefix(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces all the prefixes of the platform and channel. Empty list of
+// prefixes resets them back to the defaults.
+func SetCommandPrefixes(db *sql.DB, platform string, channel string, prefixes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM Command_Prefixes WHERE platform = $1 AND channel = $2", platform, channel)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		_, err = tx.Exec("INSERT INTO Command_Prefixes (platform, channel, prefix) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", platform, channel, prefix)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestVerifyCommandPrefixes(t *testing.T) {
+	for _, prefixes := range [][]string{
+		{},
+		{"!"},
+		{"$", "!!", "gk,"},
+	} {
+		if err := VerifyCommandPrefixes(prefixes); err != nil {
+			t.Errorf("%q: unexpected error: %s", prefixes, err)
+		}
+	}
+	for _, prefixes := range [][]string{
+		{""},
+		{"! "},
+		{"!", "way-too-long-prefix"},
+		{"a", "b", "c", "d", "e", "f"},
+	} {
+		if err := VerifyCommandPrefixes(prefixes); err == nil {
+			t.Errorf("%q: expected an error", prefixes)
+		}
+	}
+}
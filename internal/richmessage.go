@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+type RichField struct {
+	Name  string
+	Value string
+}
+
+type RichLink struct {
+	Text string
+	URL  string
+}
+
+// Structured message. Platforms that support it render it natively
+// (for instance, Discord embeds). The rest use Flatten().
+type RichMessage struct {
+	Title    string
+	Text     string
+	Fields   []RichField
+	Items    []string
+	// Render Items as 1. 2. 3. instead of bullets
+	Numbered bool
+	Code     string
+	Links    []RichLink
+}
+
+func (message RichMessage) IsEmpty() bool {
+	return len(message.Title) == 0 && len(message.Text) == 0 && len(message.Fields) == 0 && len(message.Items) == 0 && len(message.Code) == 0 && len(message.Links) == 0
+}
+
+// Items as lines of text with bullets or numbers
+func (message RichMessage) ItemLines() []string {
+	lines := []string{}
+	for i, item := range message.Items {
+		if message.Numbered {
+			lines = append(lines, fmt.Sprintf("%d. %s", i+1, item))
+		} else {
+			lines = append(lines, "• "+item)
+		}
+	}
+	return lines
+}
+
+// Compact single line representation for the platforms without rich
+// messages, like Twitch chat
+func (message RichMessage) Flatten() string {
+	parts := []string{}
+	if len(message.Title) > 0 && len(message.Text) > 0 {
+		parts = append(parts, message.Title+": "+message.Text)
+	} else if len(message.Title) > 0 {
+		parts = append(parts, message.Title)
+	} else if len(message.Text) > 0 {
+		parts = append(parts, message.Text)
+	}
+	for _, field := range message.Fields {
+		parts = append(parts, field.Name+": "+field.Value)
+	}
+	if len(message.Items) > 0 {
+		items := message.ItemLines()
+		if !message.Numbered {
+			items = message.Items
+		}
+		parts = append(parts, strings.Join(items, ", "))
+	}
+	if len(message.Code) > 0 {
+		parts = append(parts, strings.Join(strings.Fields(message.Code), " "))
+	}
+	for _, link := range message.Links {
+		if len(link.Text) > 0 {
+			parts = append(parts, link.Text+" "+link.URL)
+		} else {
+			parts = append(parts, link.URL)
+		}
+	}
+	return strings.Join(parts, " | ")
+}
+
+// Applies f to all the human readable text of the message. Leaves the
+// code and the URLs intact.
+func (message RichMessage) MapText(f func(string) string) RichMessage {
+	apply := f
+	f = func(text string) string {
+		// Some transforms make up text out of nothing
+		if len(text) == 0 {
+			return text
+		}
+		return apply(text)
+	}
+	result := RichMessage{
+		Title:    f(message.Title),
+		Text:     f(message.Text),
+		Numbered: message.Numbered,
+		Code:     message.Code,
+	}
+	for _, field := range message.Fields {
+		result.Fields = append(result.Fields, RichField{Name: f(field.Name), Value: f(field.Value)})
+	}
+	for _, item := range message.Items {
+		result.Items = append(result.Items, f(item))
+	}
+	for _, link := range message.Links {
+		result.Links = append(result.Links, RichLink{Text: f(link.Text), URL: link.URL})
+	}
+	return result
+}
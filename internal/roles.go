@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type Role string
+
+// Ordered from the most to the least powerful one. Each role has all
+// the permissions of the roles after it.
+const (
+	RoleOwner     Role = "owner"
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleTrusted   Role = "trusted"
+)
+
+var AllRoles = []Role{RoleOwner, RoleAdmin, RoleModerator, RoleTrusted}
+
+func ParseRole(name string) (Role, error) {
+	for _, role := range AllRoles {
+		if string(role) == strings.ToLower(name) {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown role `%s`. Available roles: owner, admin, moderator, trusted", name)
+}
+
+// Names of the permissions required by the commands. Ordered from the
+// least to the most powerful one, the same way as Permission in the bot.
+var PermissionNames = []string{"everyone", "subscriber", "trusted", "moderator", "admin", "owner"}
+
+func ParsePermissionName(name string) (string, error) {
+	for _, permission := range PermissionNames {
+		if permission == strings.ToLower(name) {
+			return permission, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown permission `%s`. Available permissions: %s", name, strings.Join(PermissionNames, ", "))
+}
+
+// A row of the Roles table
+type UserRole struct {
+	UserId string
+	Role   Role
+}
+
+func QueryRoles(db *sql.DB) ([]UserRole, error) {
+	rows, err := db.Query("SELECT user_id, role FROM Roles ORDER BY granted_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []UserRole{}
+	for rows.Next() {
+		userRole := UserRole{}
+		if err := rows.Scan(&userRole.UserId, &userRole.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, userRole)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func GrantRole(db *sql.DB, userId string, role Role) error {
+	_, err := db.Exec("INSERT INTO Roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING", userId, role)
+	return err
+}
+
+// Returns false if the user didn't have the role
+func RevokeRole(db *sql.DB, userId string, role Role) (bool, error) {
+	res, err := db.Exec("DELETE FROM Roles WHERE user_id = $1 AND role = $2", userId, role)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A row of the Timers table
+type Timer struct {
+	Id              int64
+	Platform        string
+	Channel         string
+	CommandName     string
+	CommandArgs     string
+	IntervalMinutes int
+	MinChatMessages int
+	LastFiredAt     time.Time
+}
+
+func (timer Timer) Interval() time.Duration {
+	return time.Duration(timer.IntervalMinutes) * time.Minute
+}
+
+func (timer Timer) IsDue(now time.Time) bool {
+	return !now.Before(timer.LastFiredAt.Add(timer.Interval()))
+}
+
+func queryTimers(db *sql.DB, query string, args ...interface{}) ([]Timer, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timers := []Timer{}
+	for rows.Next() {
+		timer := Timer{}
+		if err := rows.Scan(&timer.Id, &timer.Platform, &timer.Channel, &timer.CommandName, &timer.CommandArgs, &timer.IntervalMinutes, &timer.MinChatMessages, &timer.LastFiredAt); err != nil {
+			return nil, err
+		}
+		timers = append(timers, timer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return timers, nil
+}
+
+func QueryAllTimers(db *sql.DB) ([]Timer, error) {
+	return queryTimers(db, "SELECT id, platform, channel, command_name, coalesce(command_args, ''), interval_minutes, coalesce(min_chat_messages, 0), last_fired_at FROM Timers ORDER BY id")
+}
+
+func QueryChannelTimers(db *sql.DB, platform string, channel string) ([]Timer, error) {
+	return queryTimers(db, "SELECT id, platform, channel, command_name, coalesce(command_args, ''), interval_minutes, coalesce(min_chat_messages, 0), last_fired_at FROM Timers WHERE platform = $1 AND channel = $2 ORDER BY id", platform, channel)
+}
+
+func InsertTimer(db *sql.DB, timer Timer) (int64, error) {
+	var id int64
+	err := db.QueryRow("INSERT INTO Timers (platform, channel, command_name, command_args, interval_minutes, min_chat_messages) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		timer.Platform, timer.Channel, timer.CommandName, timer.CommandArgs, timer.IntervalMinutes, timer.MinChatMessages).Scan(&id)
+	return id, err
+}
+
+// Deletes the timer only if it belongs to the platform and channel.
+// Returns false if there was no such timer.
+func DeleteChannelTimer(db *sql.DB, platform string, channel string, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM Timers WHERE id = $1 AND platform = $2 AND channel = $3", id, platform, channel)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func MarkTimerFired(db *sql.DB, id int64, firedAt time.Time) error {
+	_, err := db.Exec("UPDATE Timers SET last_fired_at = $2 WHERE id = $1", id, firedAt)
+	return err
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Parts of a message that must survive any transform untouched,
+// otherwise they stop working: Discord emojis, mentions and
+// timestamps, Twitch mentions, links and Unicode emoji sequences.
+var ProtectedTextRegexp = regexp.MustCompile(`<a?:[a-zA-Z_0-9]+:[0-9]+>|<(?:@[!&]?|#)[0-9]+>|<t:[0-9]+(?::[a-zA-Z])?>|@[a-zA-Z0-9_]+|https?://\S+|[\p{So}\p{Sk}][\x{FE0F}\x{200D}\p{So}\p{Sk}\p{M}]*`)
+
+type TextSegment struct {
+	Text      string
+	Protected bool
+}
+
+func SplitProtectedText(message string) []TextSegment {
+	segments := []TextSegment{}
+	last := 0
+	for _, loc := range ProtectedTextRegexp.FindAllStringIndex(message, -1) {
+		if loc[0] > last {
+			segments = append(segments, TextSegment{Text: message[last:loc[0]]})
+		}
+		segments = append(segments, TextSegment{Text: message[loc[0]:loc[1]], Protected: true})
+		last = loc[1]
+	}
+	if last < len(message) {
+		segments = append(segments, TextSegment{Text: message[last:]})
+	}
+	return segments
+}
+
+// Applies f only to the parts of the message that are not protected
+func MapUnprotectedText(message string, f func(string) string) string {
+	var sb strings.Builder
+	for _, segment := range SplitProtectedText(message) {
+		if segment.Protected {
+			sb.WriteString(segment.Text)
+		} else {
+			sb.WriteString(f(segment.Text))
+		}
+	}
+	return sb.String()
+}
+
+type Transform struct {
+	Name        string
+	Description string
+	// The platform is "discord", "twitch", etc. Must keep the
+	// protected parts of the message intact. See ProtectedTextRegexp.
+	Apply func(platform string, message string) string
+}
+
+var (
+	CyrilTransform = Transform{
+		Name:        "cyril",
+		Description: "Cyrillify the text or the output of a command",
+		Apply: func(platform string, message string) string {
+			return MapUnprotectedText(message, Cyrillify)
+		},
+	}
+	FancyTransform = Transform{
+		Name:        "fancy",
+		Description: "Make the text or the output of a command 𝓯𝓪𝓷𝓬𝔂",
+		Apply: func(platform string, message string) string {
+			return MapUnprotectedText(message, FancyString)
+		},
+	}
+	ReverseTransform = Transform{
+		Name:        "reverse",
+		Description: "Reverse the text or the output of a command",
+		Apply: func(platform string, message string) string {
+			segments := SplitProtectedText(message)
+			var sb strings.Builder
+			for i := len(segments) - 1; i >= 0; i -= 1 {
+				if segments[i].Protected {
+					sb.WriteString(segments[i].Text)
+				} else {
+					sb.WriteString(reverseString(segments[i].Text))
+				}
+			}
+			return sb.String()
+		},
+	}
+	UwuTransform = Transform{
+		Name:        "uwu",
+		Description: "Uwuify the text or the output of a command",
+		Apply: func(platform string, message string) string {
+			return MapUnprotectedText(message, uwuify) + " UwU"
+		},
+	}
+	LeetTransform = Transform{
+		Name:        "leet",
+		Description: "Translate the text or the output of a command to 1337",
+		Apply: func(platform string, message string) string {
+			return MapUnprotectedText(message, func(text string) string {
+				return LeetReplacer.Replace(text)
+			})
+		},
+	}
+	SpoilerTransform = Transform{
+		Name:        "spoiler",
+		Description: "Hide the text or the output of a command behind a spoiler on Discord",
+		Apply: func(platform string, message string) string {
+			if platform != "discord" {
+				// Twitch chat does not have spoilers
+				return message
+			}
+			// A zero width space so the message can't close the spoiler early
+			return "||" + strings.ReplaceAll(message, "||", "|\u200b|") + "||"
+		},
+	}
+)
+
+var Transforms = []Transform{
+	CyrilTransform,
+	FancyTransform,
+	ReverseTransform,
+	UwuTransform,
+	LeetTransform,
+	SpoilerTransform,
+}
+
+func FindTransform(name string) (Transform, bool) {
+	for _, transform := range Transforms {
+		if transform.Name == name {
+			return transform, true
+		}
+	}
+	return Transform{}, false
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+var UwuReplacer = strings.NewReplacer(
+	"r", "w", "l", "w", "R", "W", "L", "W",
+	"na", "nya", "ne", "nye", "ni", "nyi", "no", "nyo", "nu", "nyu",
+	"Na", "Nya", "Ne", "Nye", "Ni", "Nyi", "No", "Nyo", "Nu", "Nyu",
+	"ove", "uv",
+)
+
+func uwuify(text string) string {
+	return UwuReplacer.Replace(text)
+}
+
+var LeetReplacer = strings.NewReplacer(
+	"a", "4", "A", "4",
+	"e", "3", "E", "3",
+	"i", "1", "I", "1",
+	"o", "0", "O", "0",
+	"s", "5", "S", "5",
+	"t", "7", "T", "7",
+)
+
+func FancyRune(chr rune) rune {
+	if chr >= 'A' && chr <= 'Z' {
+		return '𝓐' + chr - 'A'
+	}
+
+	if chr >= 'a' && chr <= 'z' {
+		return '𝓪' + chr - 'a'
+	}
+
+	return chr
+}
+
+func FancyString(peasantString string) string {
+	fancyRunes := []rune{}
+
+	for _, peasantRune := range peasantString {
+		fancyRunes = append(fancyRunes, FancyRune(peasantRune))
+	}
+
+	return string(fancyRunes)
+}
+
+func Cyrillify(message string) string {
+	result := []rune{}
+	for _, x := range []rune(message) {
+		if y, ok := CyrilMap[x]; ok {
+			result = append(result, y)
+		} else {
+			result = append(result, x)
+		}
+	}
+	return string(result)
+}
+
+var CyrilMap = map[rune]rune{
+	'a': 'д',
+	'e': 'ё',
+	'b': 'б',
+	'h': 'н',
+	'k': 'к',
+	'm': 'м',
+	'n': 'п',
+	'o': 'ф',
+	'r': 'г',
+	't': 'т',
+	'u': 'ц',
+	'x': 'ж',
+	'w': 'ш',
+	'A': 'Д',
+	'G': 'Б',
+	'E': 'Ё',
+	'N': 'Й',
+	'O': 'Ф',
+	'R': 'Я',
+	'U': 'Ц',
+	'W': 'Ш',
+	'X': 'Ж',
+	'Y': 'У',
+}
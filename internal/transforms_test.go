@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransformsKeepProtectedText(t *testing.T) {
+	protected := []string{
+		"<@123>",
+		"<@!123>",
+		"<@&123>",
+		"<#123>",
+		"<:tsodinPog:123>",
+		"<a:tsodinDance:123>",
+		"<t:946684800:R>",
+		"@tsoding",
+		"https://example.com/Some/Path?q=Test",
+		"👍🏽",
+	}
+	for _, transform := range Transforms {
+		for _, text := range protected {
+			for _, platform := range []string{"discord", "twitch"} {
+				result := transform.Apply(platform, "hello "+text+" world")
+				if !strings.Contains(result, text) {
+					t.Errorf("%s on %s: %q lost %q", transform.Name, platform, result, text)
+				}
+			}
+		}
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	cases := []struct {
+		transform Transform
+		platform  string
+		input     string
+		expected  string
+	}{
+		{CyrilTransform, "twitch", "Hello @world", "Hёllф @world"},
+		{FancyTransform, "twitch", "Hi 69", "𝓗𝓲 69"},
+		{ReverseTransform, "twitch", "abc <@123> def", "fed <@123> cba"},
+		{UwuTransform, "twitch", "really nice", "weawwy nyice UwU"},
+		{LeetTransform, "twitch", "test", "7357"},
+		{SpoilerTransform, "discord", "a||b", "||a|​|b||"},
+		{SpoilerTransform, "twitch", "a||b", "a||b"},
+	}
+	for _, c := range cases {
+		if actual := c.transform.Apply(c.platform, c.input); actual != c.expected {
+			t.Errorf("%s %q on %s: expected %q, but got %q", c.transform.Name, c.input, c.platform, c.expected, actual)
+		}
+	}
+}
+
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A row of the Triggers table
+type Trigger struct {
+	Id              int64
+	Regex           string
+	Bex             string
+	CooldownSeconds int
+}
+
+func (trigger Trigger) Cooldown() time.Duration {
+	return time.Duration(trigger.CooldownSeconds) * time.Second
+}
+
+func QueryTriggers(db *sql.DB) ([]Trigger, error) {
+	rows, err := db.Query("SELECT id, regex, bex, coalesce(cooldown_seconds, 0) FROM Triggers ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	triggers := []Trigger{}
+	for rows.Next() {
+		trigger := Trigger{}
+		if err := rows.Scan(&trigger.Id, &trigger.Regex, &trigger.Bex, &trigger.CooldownSeconds); err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, trigger)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return triggers, nil
+}
+
+func InsertTrigger(db *sql.DB, trigger Trigger) (int64, error) {
+	var id int64
+	err := db.QueryRow("INSERT INTO Triggers (regex, bex, cooldown_seconds) VALUES ($1, $2, $3) RETURNING id", trigger.Regex, trigger.Bex, trigger.CooldownSeconds).Scan(&id)
+	return id, err
+}
+
+// Returns false if there was no such trigger
+func DeleteTrigger(db *sql.DB, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM Triggers WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"database/sql"
+)
+
+// A row of the Twitch_Channel_Settings table
+type TwitchChannelSettings struct {
+	Channel        string
+	CustomCommands bool
+	// Announce the songs from Sowon2 in the channel
+	Sowon2         bool
+	Timers         bool
+	// Feed the chat of the channel to the Carrotson model
+	Carrotson      bool
+	// Announce the subs, gift subs and raids in the channel
+	Events         bool
+}
+
+// The main channel is the one that has the events enabled by default
+func QueryTwitchChannelSettings(db *sql.DB, mainChannel string) ([]TwitchChannelSettings, error) {
+	rows, err := db.Query("SELECT channel, custom_commands, sowon2, timers, carrotson, coalesce(events, channel = $1) FROM Twitch_Channel_Settings ORDER BY channel", mainChannel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []TwitchChannelSettings{}
+	for rows.Next() {
+		settings := TwitchChannelSettings{}
+		if err := rows.Scan(&settings.Channel, &settings.CustomCommands, &settings.Sowon2, &settings.Timers, &settings.Carrotson, &settings.Events); err != nil {
+			return nil, err
+		}
+		result = append(result, settings)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func UpsertTwitchChannelSettings(db *sql.DB, settings TwitchChannelSettings) error {
+	_, err := db.Exec("INSERT INTO Twitch_Channel_Settings (channel, custom_commands, sowon2, timers, carrotson, events) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (channel) DO UPDATE SET custom_commands = EXCLUDED.custom_commands, sowon2 = EXCLUDED.sowon2, timers = EXCLUDED.timers, carrotson = EXCLUDED.carrotson, events = EXCLUDED.events;",
+		settings.Channel, settings.CustomCommands, settings.Sowon2, settings.Timers, settings.Carrotson, settings.Events)
+	return err
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The USERNOTICE events the bot can announce. The keys of the
+// Twitch_Event_Templates table.
+const (
+	TwitchEventSub            = "sub"
+	TwitchEventResub          = "resub"
+	TwitchEventSubGift        = "subgift"
+	TwitchEventSubMysteryGift = "submysterygift"
+	TwitchEventRaid           = "raid"
+)
+
+var TwitchEventTypes = []string{TwitchEventSub, TwitchEventResub, TwitchEventSubGift, TwitchEventSubMysteryGift, TwitchEventRaid}
+
+func IsTwitchEventType(name string) bool {
+	for _, eventType := range TwitchEventTypes {
+		if eventType == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriptions, gifts and raids. The fields that don't make sense for
+// the Type are left zero.
+type TwitchEvent struct {
+	Type    string
+	Channel string
+	// Display name of the subscriber, the gifter or the raider
+	User string
+	// Login of the User, for the mentions
+	Login string
+	// Cumulative months of the subscription
+	Months int
+	// Recipient of the gifted subscription
+	Recipient string
+	// Amount of the gifted subscriptions in the submysterygift
+	Count int
+	// "Prime", "Tier 1", "Tier 2" or "Tier 3"
+	Plan string
+	// Amount of the viewers that came with the raid
+	Viewers int
+}
+
+func twitchEventFunc(name string, value Expr) Func {
+	return func(context *EvalContext, args []Expr) (Expr, error) {
+		if len(args) > 0 {
+			return Expr{}, fmt.Errorf("%s: Too many arguments", name)
+		}
+		return value, nil
+	}
+}
+
+// The functions available to the templates of the events. For example:
+// say("Thank you for the raid ", event_user(), "! Welcome, ", event_viewers(), " raiders!")
+func (event TwitchEvent) Funcs() map[string]Func {
+	values := map[string]Expr{
+		"event_type":      NewExprStr(event.Type),
+		"event_user":      NewExprStr(event.User),
+		"event_months":    NewExprInt(event.Months),
+		"event_recipient": NewExprStr(event.Recipient),
+		"event_count":     NewExprInt(event.Count),
+		"event_plan":      NewExprStr(event.Plan),
+		"event_viewers":   NewExprInt(event.Viewers),
+	}
+	funcs := map[string]Func{}
+	for name, value := range values {
+		funcs[name] = twitchEventFunc(name, value)
+	}
+	return funcs
+}
+
+// A row of the Twitch_Event_Templates table
+type TwitchEventTemplate struct {
+	Event string
+	Bex   string
+}
+
+func QueryTwitchEventTemplates(db *sql.DB) ([]TwitchEventTemplate, error) {
+	rows, err := db.Query("SELECT event, bex FROM Twitch_Event_Templates ORDER BY event")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []TwitchEventTemplate{}
+	for rows.Next() {
+		template := TwitchEventTemplate{}
+		if err := rows.Scan(&template.Event, &template.Bex); err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return templates, nil
+}
+
+// Returns false if the event has no template
+func QueryTwitchEventTemplate(db *sql.DB, event string) (string, bool, error) {
+	var bex string
+	err := db.QueryRow("SELECT bex FROM Twitch_Event_Templates WHERE event = $1", event).Scan(&bex)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return bex, true, nil
+}
+
+func UpsertTwitchEventTemplate(db *sql.DB, template TwitchEventTemplate) error {
+	_, err := db.Exec("INSERT INTO Twitch_Event_Templates (event, bex) VALUES ($1, $2) ON CONFLICT (event) DO UPDATE SET bex = EXCLUDED.bex;", template.Event, template.Bex)
+	return err
+}
+
+// Returns false if the event had no template
+func DeleteTwitchEventTemplate(db *sql.DB, event string) (bool, error) {
+	res, err := db.Exec("DELETE FROM Twitch_Event_Templates WHERE event = $1", event)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"database/sql"
+)
+
+// A row of the Twitch_Users table
+type TwitchUser struct {
+	UserId string
+	Login  string
+}
+
+func QueryTwitchUsers(db *sql.DB) ([]TwitchUser, error) {
+	rows, err := db.Query("SELECT user_id, login FROM Twitch_Users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []TwitchUser{}
+	for rows.Next() {
+		user := TwitchUser{}
+		if err := rows.Scan(&user.UserId, &user.Login); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// The tables that refer to the users by their
+// UniversalPlatformAgnosticUserID()
+var userIdMigrations = []string{
+	// The unique ones keep the row of the new id if both exist
+	"INSERT INTO Roles (user_id, role, granted_at) SELECT $2, role, granted_at FROM Roles WHERE user_id = $1 ON CONFLICT DO NOTHING",
+	"DELETE FROM Roles WHERE user_id = $1",
+	"UPDATE Ed_State SET user_id = $2 WHERE user_id = $1 AND NOT EXISTS (SELECT 1 FROM Ed_State WHERE user_id = $2)",
+	"DELETE FROM Ed_State WHERE user_id = $1",
+	"UPDATE Identity_Links SET user_id = $2 WHERE user_id = $1 AND NOT EXISTS (SELECT 1 FROM Identity_Links WHERE user_id = $2)",
+	"DELETE FROM Identity_Links WHERE user_id = $1",
+	"UPDATE Identity_Links SET canonical_id = $2 WHERE canonical_id = $1",
+	"UPDATE Link_Codes SET user_id = $2 WHERE user_id = $1",
+	"UPDATE Command_Log SET user_id = $2 WHERE user_id = $1",
+}
+
+// Remembers the current login of the user. The first time the user is
+// seen, moves everything attached to the nickname (legacyId) to the
+// stable id. Returns true if that happened.
+func RecordTwitchUser(db *sql.DB, user TwitchUser, legacyId string, stableId string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var known bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM Twitch_Users WHERE user_id = $1)", user.UserId).Scan(&known)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	_, err = tx.Exec("INSERT INTO Twitch_Users (user_id, login) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET login = EXCLUDED.login, seen_at = now()", user.UserId, user.Login)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if !known {
+		for _, query := range userIdMigrations {
+			_, err = tx.Exec(query, legacyId, stableId)
+			if err != nil {
+				tx.Rollback()
+				return false, err
+			}
+		}
+	}
+
+	return !known, tx.Commit()
+}
@@ -0,0 +1 @@
+ALTER TABLE Commands ADD COLUMN description varchar(256) DEFAULT '';
@@ -0,0 +1,13 @@
+CREATE TABLE Command_Log(
+    name varchar(64),
+    -- NOTE: "discord", "twitch", etc. See CommandEnvironment.Platform()
+    platform varchar(16),
+    channel varchar(64),
+    -- NOTE: same format as Ed_State.user_id. See CommandEnvironment.UniversalPlatformAgnosticUserID()
+    user_id varchar(32),
+    invoked_at timestamptz DEFAULT now(),
+    duration_ms double precision,
+    success boolean,
+    error varchar(256)
+);
+CREATE INDEX Command_Log_invoked_at ON Command_Log(invoked_at);
@@ -0,0 +1,8 @@
+CREATE TABLE Command_Prefixes(
+    -- NOTE: "discord", "twitch", etc. See CommandEnvironment.Platform()
+    platform varchar(16),
+    -- NOTE: empty channel means the prefix applies to all the channels of the platform
+    channel varchar(64) DEFAULT '',
+    prefix varchar(16),
+    UNIQUE(platform, channel, prefix)
+);
@@ -0,0 +1,12 @@
+CREATE TABLE Timers(
+    id bigserial primary key,
+    -- NOTE: "discord", "twitch", etc. See CommandEnvironment.Platform()
+    platform varchar(16) NOT NULL,
+    channel varchar(64) NOT NULL,
+    command_name varchar(64) NOT NULL,
+    command_args varchar(256) DEFAULT '',
+    interval_minutes integer NOT NULL,
+    -- NOTE: the amount of chat messages in the channel since the last time the timer fired required to fire it again
+    min_chat_messages integer DEFAULT 0,
+    last_fired_at timestamptz DEFAULT now()
+);
@@ -0,0 +1,7 @@
+CREATE TABLE Triggers(
+    id bigserial primary key,
+    -- NOTE: https://github.com/google/re2/wiki/Syntax
+    regex varchar(256) NOT NULL,
+    bex text NOT NULL,
+    cooldown_seconds integer DEFAULT 60
+);
@@ -0,0 +1,8 @@
+CREATE TABLE Roles(
+    -- NOTE: See CommandEnvironment.UniversalPlatformAgnosticUserID()
+    user_id varchar(64) NOT NULL,
+    -- NOTE: "owner", "admin", "moderator" or "trusted"
+    role varchar(16) NOT NULL,
+    granted_at timestamptz DEFAULT now(),
+    UNIQUE(user_id, role)
+);
@@ -0,0 +1,16 @@
+CREATE TABLE Identity_Links(
+    -- NOTE: See CommandEnvironment.UniversalPlatformAgnosticUserID().
+    -- The users that are not linked to anybody don't have a row here
+    -- and are canonical to themselves.
+    user_id varchar(32) PRIMARY KEY,
+    -- NOTE: the user all the state (ed, reminders, stats, etc) of the
+    -- linked identities is attached to. Never has a row in this table itself.
+    canonical_id varchar(32) NOT NULL,
+    linked_at timestamptz DEFAULT now()
+);
+
+CREATE TABLE Link_Codes(
+    code varchar(16) PRIMARY KEY,
+    user_id varchar(32) NOT NULL,
+    expires_at timestamptz NOT NULL
+);
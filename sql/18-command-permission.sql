@@ -0,0 +1,2 @@
+-- NOTE: "everyone", "subscriber", "trusted", "moderator", "admin" or "owner". See Permission.String()
+ALTER TABLE Commands ADD COLUMN permission varchar(16) DEFAULT 'everyone';
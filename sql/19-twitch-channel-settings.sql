@@ -0,0 +1,7 @@
+CREATE TABLE Twitch_Channel_Settings(
+    -- NOTE: with the leading #, for example "#tsoding"
+    channel varchar(64) PRIMARY KEY,
+    custom_commands boolean NOT NULL DEFAULT true,
+    sowon2 boolean NOT NULL DEFAULT false,
+    timers boolean NOT NULL DEFAULT true
+);
@@ -0,0 +1,13 @@
+CREATE TABLE Twitch_Log(
+    message_id varchar(64),
+    -- NOTE: with the leading #, for example "#tsoding"
+    channel varchar(64),
+    user_id varchar(32),
+    user_name varchar(32),
+    posted_at timestamp DEFAULT now(),
+    text varchar(512)
+);
+CREATE INDEX Twitch_Log_channel ON Twitch_Log(channel);
+
+-- Feeding the chat of the channel to the Carrotson model
+ALTER TABLE Twitch_Channel_Settings ADD COLUMN carrotson boolean NOT NULL DEFAULT false;
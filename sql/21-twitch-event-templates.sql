@@ -0,0 +1,5 @@
+-- NOTE: see internal.TwitchEventTypes for the possible events
+CREATE TABLE Twitch_Event_Templates(
+    event varchar(32) PRIMARY KEY,
+    bex varchar(1024) NOT NULL
+);
@@ -0,0 +1,12 @@
+CREATE TABLE Mod_Rules(
+    id bigserial primary key,
+    -- NOTE: phrase, regex, domain, links, caps, repeat, emoji. See ModRuleKinds
+    kind varchar(16) NOT NULL,
+    -- NOTE: meaning depends on the kind: the phrase, the regexp, the domains, the threshold
+    pattern varchar(256) NOT NULL,
+    -- NOTE: delete, timeout, warn, log. See ModActions
+    action varchar(16) NOT NULL,
+    timeout_seconds integer NOT NULL DEFAULT 0,
+    -- NOTE: the matches of the dry run rules are only reported to the mod log
+    dry_run boolean NOT NULL DEFAULT false
+);
@@ -0,0 +1,11 @@
+-- NOTE: the Twitch users are identified by their stable user id
+-- ("twitch-id#110240192") that survives renames. The state that was
+-- attached to the nicknames ("twitch#tsoding") is moved to the stable id
+-- the first time the user with that login is seen in the chat.
+-- See internal.RecordTwitchUser
+CREATE TABLE Twitch_Users(
+    user_id varchar(32) PRIMARY KEY,
+    -- NOTE: the last known login of the user
+    login varchar(32) NOT NULL,
+    seen_at timestamptz DEFAULT now()
+);
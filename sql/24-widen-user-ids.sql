@@ -0,0 +1,8 @@
+-- NOTE: the user ids in the UniversalPlatformAgnosticUserID() format
+-- don't fit into 32 characters anymore. For example the IRC ones are
+-- "irc#<network>/<account>". Using the same size as Roles.user_id.
+ALTER TABLE Identity_Links ALTER COLUMN user_id TYPE varchar(64);
+ALTER TABLE Identity_Links ALTER COLUMN canonical_id TYPE varchar(64);
+ALTER TABLE Link_Codes ALTER COLUMN user_id TYPE varchar(64);
+ALTER TABLE Command_Log ALTER COLUMN user_id TYPE varchar(64);
+ALTER TABLE Ed_State ALTER COLUMN user_id TYPE varchar(64);
@@ -0,0 +1,5 @@
+-- NOTE: announce the subs, gift subs and raids in the channel. See
+-- Twitch_Event_Templates. NULL means the default: only in the main
+-- channel (the first one of GATEKEEPER_TWITCH_IRC_CHANNELS), the same
+-- way as sowon2.
+ALTER TABLE Twitch_Channel_Settings ADD COLUMN events boolean;
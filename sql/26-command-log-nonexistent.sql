@@ -0,0 +1,3 @@
+-- NOTE: the messages that did not match any command are not logged
+-- anymore. See LogCommandInvocation
+DELETE FROM Command_Log WHERE error = 'CommandDoesNotExist';
@@ -0,0 +1,9 @@
+-- NOTE: the owners that used to be hardcoded in the bot (AdminID and
+-- BotAdminTwitchHandle), so the deployments that don't set
+-- GATEKEEPER_OWNERS don't lose them. The Twitch one is moved to the
+-- stable id the first time the user chats if it's not known yet. See
+-- internal.RecordTwitchUser
+INSERT INTO Roles (user_id, role) VALUES ('discord#180406039500292096', 'owner') ON CONFLICT DO NOTHING;
+INSERT INTO Roles (user_id, role)
+    SELECT coalesce((SELECT 'twitch-id#' || user_id FROM Twitch_Users WHERE login = 'tsoding'), 'twitch#tsoding'), 'owner'
+ON CONFLICT DO NOTHING;